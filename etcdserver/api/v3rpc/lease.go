@@ -17,6 +17,7 @@ package v3rpc
 import (
 	"context"
 	"io"
+	"sync"
 
 	"go.etcd.io/etcd/v3/etcdserver"
 	"go.etcd.io/etcd/v3/etcdserver/api/v3rpc/rpctypes"
@@ -26,14 +27,25 @@ import (
 	"go.uber.org/zap"
 )
 
+// maxKeepAliveBatch is the maximum number of coalesced renewals renewed at
+// once.
+const maxKeepAliveBatch = 1024
+
 type LeaseServer struct {
 	lg  *zap.Logger
 	hdr header
 	le  etcdserver.Lessor
+	rb  *renewBatcher
 }
 
 func NewLeaseServer(s *etcdserver.EtcdServer) pb.LeaseServer {
-	return &LeaseServer{lg: s.Cfg.Logger, le: s, hdr: newHeader(s)}
+	// cancel the renewals in flight once the server stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.StopNotify()
+		cancel()
+	}()
+	return &LeaseServer{lg: s.Cfg.Logger, le: s, hdr: newHeader(s), rb: newRenewBatcher(ctx, s, maxKeepAliveBatch)}
 }
 
 func (ls *LeaseServer) LeaseGrant(ctx context.Context, cr *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
@@ -136,7 +148,7 @@ func (ls *LeaseServer) leaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) erro
 		resp := &pb.LeaseKeepAliveResponse{ID: req.ID, Header: &pb.ResponseHeader{}}
 		ls.hdr.fill(resp.Header)
 
-		ttl, err := ls.le.LeaseRenew(stream.Context(), lease.LeaseID(req.ID))
+		ttl, err := ls.rb.renew(stream.Context(), lease.LeaseID(req.ID))
 		if err == lease.ErrLeaseNotFound {
 			err = nil
 			ttl = 0
@@ -167,3 +179,82 @@ func (ls *LeaseServer) leaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) erro
 		}
 	}
 }
+
+// renewBatcher coalesces the renewals received from all keepalive streams
+// into batches, so that clients renewing at nearly the same moment, as after
+// reconnecting, take the lessor lock once per batch. A renewal is flushed at
+// once, together with the renewals queued until the flush runs; batches are
+// renewed concurrently, so a batch slowed down by forwarding its renewals to
+// the leader does not hold back the next ones.
+type renewBatcher struct {
+	// ctx is canceled once the server stops.
+	ctx      context.Context
+	le       etcdserver.Lessor
+	maxBatch int
+
+	mu      sync.Mutex
+	pending []*renewCall
+	// scheduled is set while a flush of the pending renewals is started but
+	// has not taken them yet.
+	scheduled bool
+}
+
+type renewCall struct {
+	id    lease.LeaseID
+	ttl   int64
+	err   error
+	donec chan struct{}
+}
+
+func newRenewBatcher(ctx context.Context, le etcdserver.Lessor, maxBatch int) *renewBatcher {
+	return &renewBatcher{ctx: ctx, le: le, maxBatch: maxBatch}
+}
+
+// renew renews the lease with the batch it is coalesced into.
+func (rb *renewBatcher) renew(ctx context.Context, id lease.LeaseID) (int64, error) {
+	c := &renewCall{id: id, donec: make(chan struct{})}
+	rb.mu.Lock()
+	rb.pending = append(rb.pending, c)
+	if !rb.scheduled {
+		rb.scheduled = true
+		go rb.flush()
+	}
+	rb.mu.Unlock()
+
+	select {
+	case <-c.donec:
+		return c.ttl, c.err
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+// flush renews up to maxBatch pending renewals, and starts another flush for
+// the rest.
+func (rb *renewBatcher) flush() {
+	rb.mu.Lock()
+	calls := rb.pending
+	if len(calls) > rb.maxBatch {
+		calls = calls[:rb.maxBatch]
+	}
+	rb.pending = rb.pending[len(calls):]
+	if len(rb.pending) != 0 {
+		go rb.flush()
+	} else {
+		rb.pending = nil
+		rb.scheduled = false
+	}
+	rb.mu.Unlock()
+
+	ids := make([]lease.LeaseID, len(calls))
+	for i, c := range calls {
+		ids[i] = c.id
+	}
+	// the batch outlives the streams it serves; LeaseRenewBatch bounds the
+	// forwarding to the leader with the request timeout.
+	ttls, errs := rb.le.LeaseRenewBatch(rb.ctx, ids)
+	for i, c := range calls {
+		c.ttl, c.err = ttls[i], errs[i]
+		close(c.donec)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/v3/etcdserver"
+	"go.etcd.io/etcd/v3/lease"
+)
+
+type batchRecorder struct {
+	etcdserver.Lessor
+
+	mu      sync.Mutex
+	batches [][]lease.LeaseID
+	// renewals of lease 1 wait for unblock or the batch context, as if
+	// forwarded to a slow leader.
+	unblock chan struct{}
+}
+
+func (br *batchRecorder) LeaseRenewBatch(ctx context.Context, ids []lease.LeaseID) ([]int64, []error) {
+	br.mu.Lock()
+	br.batches = append(br.batches, ids)
+	br.mu.Unlock()
+	ttls := make([]int64, len(ids))
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		switch id {
+		case 0:
+			ttls[i], errs[i] = -1, lease.ErrLeaseNotFound
+			continue
+		case 1:
+			if br.unblock != nil {
+				select {
+				case <-br.unblock:
+				case <-ctx.Done():
+					ttls[i], errs[i] = -1, ctx.Err()
+					continue
+				}
+			}
+		}
+		ttls[i] = int64(id) * 10
+	}
+	return ttls, errs
+}
+
+// queue queues n renewals from lease ID first on, with the flush held back,
+// and returns the channel their results are sent to.
+func queue(rb *renewBatcher, first, n int) chan error {
+	rb.mu.Lock()
+	rb.scheduled = true
+	rb.mu.Unlock()
+	errc := make(chan error, n)
+	for i := first; i < first+n; i++ {
+		go func(id lease.LeaseID) {
+			ttl, err := rb.renew(context.Background(), id)
+			if err == nil && ttl != int64(id)*10 {
+				err = fmt.Errorf("ttl of lease %x = %d, want %d", id, ttl, int64(id)*10)
+			}
+			errc <- err
+		}(lease.LeaseID(i))
+	}
+	for {
+		rb.mu.Lock()
+		queued := len(rb.pending)
+		rb.mu.Unlock()
+		if queued == n {
+			return errc
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestRenewBatcher ensures renewals received together are renewed in one
+// batch, and each caller gets the result for its own lease.
+func TestRenewBatcher(t *testing.T) {
+	br := &batchRecorder{}
+	rb := newRenewBatcher(context.Background(), br, 1024)
+
+	errc := queue(rb, 0, 10)
+	rb.flush()
+	for i := 0; i < 10; i++ {
+		if err := <-errc; err != nil && err != lease.ErrLeaseNotFound {
+			t.Error(err)
+		}
+	}
+	if len(br.batches) != 1 || len(br.batches[0]) != 10 {
+		t.Errorf("batches = %v, want one batch of 10 renewals", br.batches)
+	}
+
+	// a lone renewal is flushed at once
+	if ttl, err := rb.renew(context.Background(), 2); err != nil || ttl != 20 {
+		t.Errorf("renewal of lease 2 = %d, %v, want 20, <nil>", ttl, err)
+	}
+}
+
+// TestRenewBatcherMaxBatch ensures the pending renewals are split into
+// batches of at most maxBatch renewals.
+func TestRenewBatcherMaxBatch(t *testing.T) {
+	br := &batchRecorder{}
+	rb := newRenewBatcher(context.Background(), br, 2)
+
+	errc := queue(rb, 2, 5)
+	rb.flush()
+	for i := 0; i < 5; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	var sizes []int
+	for _, b := range br.batches {
+		sizes = append(sizes, len(b))
+	}
+	if !reflect.DeepEqual(sizes, []int{2, 2, 1}) {
+		t.Errorf("batch sizes = %v, want [2 2 1]", sizes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rb.renew(ctx, 3); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+// TestRenewBatcherSlowBatch ensures a slow batch does not hold back the
+// next ones, and is canceled once the server stops.
+func TestRenewBatcherSlowBatch(t *testing.T) {
+	br := &batchRecorder{unblock: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	rb := newRenewBatcher(ctx, br, 1024)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rb.renew(context.Background(), 1)
+		errc <- err
+	}()
+	// wait for the batch of lease 1 to be in flight
+	for {
+		br.mu.Lock()
+		n := len(br.batches)
+		br.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		if ttl, err := rb.renew(context.Background(), 2); err != nil || ttl != 20 {
+			t.Errorf("renewal of lease 2 = %d, %v, want 20, <nil>", ttl, err)
+		}
+	}()
+	select {
+	case <-donec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renewal held back by a slow batch")
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("err of slow renewal = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow renewal not canceled")
+	}
+}
@@ -16,6 +16,7 @@ package v3rpc
 
 import (
 	"context"
+	"errors"
 	"strings"
 
 	"go.etcd.io/etcd/v3/auth"
@@ -53,9 +54,10 @@ var toGRPCErrorMap = map[error]error{
 	etcdserver.ErrKeyNotFound:                rpctypes.ErrGRPCKeyNotFound,
 	etcdserver.ErrCorrupt:                    rpctypes.ErrGRPCCorrupt,
 
-	lease.ErrLeaseNotFound:    rpctypes.ErrGRPCLeaseNotFound,
-	lease.ErrLeaseExists:      rpctypes.ErrGRPCLeaseExist,
-	lease.ErrLeaseTTLTooLarge: rpctypes.ErrGRPCLeaseTTLTooLarge,
+	lease.ErrLeaseNotFound:     rpctypes.ErrGRPCLeaseNotFound,
+	lease.ErrLeaseExists:       rpctypes.ErrGRPCLeaseExist,
+	lease.ErrLeaseTTLTooLarge:  rpctypes.ErrGRPCLeaseTTLTooLarge,
+	lease.ErrGrantRateExceeded: rpctypes.ErrGRPCLeaseRateLimited,
 
 	auth.ErrRootUserNotExist:     rpctypes.ErrGRPCRootUserNotExist,
 	auth.ErrRootRoleNotExist:     rpctypes.ErrGRPCRootRoleNotExist,
@@ -80,6 +82,10 @@ func togRPCError(err error) error {
 	}
 	grpcErr, ok := toGRPCErrorMap[err]
 	if !ok {
+		// a GrantRateError carries the token of the denied caller
+		if errors.Is(err, lease.ErrGrantRateExceeded) {
+			return rpctypes.ErrGRPCLeaseRateLimited
+		}
 		return status.Error(codes.Unknown, err.Error())
 	}
 	return grpcErr
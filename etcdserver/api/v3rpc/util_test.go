@@ -20,6 +20,7 @@ import (
 	"testing"
 
 	"go.etcd.io/etcd/v3/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/v3/lease"
 	"go.etcd.io/etcd/v3/mvcc"
 
 	"google.golang.org/grpc/codes"
@@ -33,6 +34,8 @@ func TestGRPCError(t *testing.T) {
 	}{
 		{err: mvcc.ErrCompacted, exp: rpctypes.ErrGRPCCompacted},
 		{err: mvcc.ErrFutureRev, exp: rpctypes.ErrGRPCFutureRev},
+		{err: lease.ErrGrantRateExceeded, exp: rpctypes.ErrGRPCLeaseRateLimited},
+		{err: &lease.GrantRateError{Token: "a"}, exp: rpctypes.ErrGRPCLeaseRateLimited},
 		{err: context.Canceled, exp: context.Canceled},
 		{err: context.DeadlineExceeded, exp: context.DeadlineExceeded},
 		{err: errors.New("foo"), exp: status.Error(codes.Unknown, "foo")},
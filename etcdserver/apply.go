@@ -574,8 +574,9 @@ func (a *applierV3backend) LeaseGrant(lc *pb.LeaseGrantRequest) (*pb.LeaseGrantR
 	l, err := a.s.lessor.Grant(lease.LeaseID(lc.ID), lc.TTL)
 	resp := &pb.LeaseGrantResponse{}
 	if err == nil {
-		resp.ID = int64(l.ID)
-		resp.TTL = l.TTL()
+		r := l.GrantResult()
+		resp.ID = int64(r.ID)
+		resp.TTL = r.TTL
 		resp.Header = newHeader(a.s)
 	}
 	return resp, err
@@ -153,6 +153,10 @@ type ServerConfig struct {
 	// LeaseCheckpointInterval time.Duration is the wait duration between lease checkpoints.
 	LeaseCheckpointInterval time.Duration
 
+	// IDCounterBits is the width of the counter of the request and lease ID
+	// generator, below idutil.MaxCounterLen. Zero means the default of 8 bits.
+	IDCounterBits uint
+
 	EnableGRPCGateway bool
 }
 
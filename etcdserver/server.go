@@ -184,6 +184,8 @@ type EtcdServer struct {
 	committedIndex    uint64 // must use atomic operations to access; keep 64-bit aligned.
 	term              uint64 // must use atomic operations to access; keep 64-bit aligned.
 	lead              uint64 // must use atomic operations to access; keep 64-bit aligned.
+	// leaseIDHigh is the lease ID with the highest suffix nextLeaseID handed out.
+	leaseIDHigh int64 // must use atomic operations to access; keep 64-bit aligned.
 
 	// consistIndex used to hold the offset of current executing entry
 	// It is initialized to 0 before executing any entry.
@@ -285,6 +287,10 @@ func NewServer(cfg ServerConfig) (srv *EtcdServer, err error) {
 		cl *membership.RaftCluster
 	)
 
+	if cfg.IDCounterBits >= idutil.MaxCounterLen {
+		return nil, fmt.Errorf("ID counter width %d exceeds %d bits", cfg.IDCounterBits, idutil.MaxCounterLen-1)
+	}
+
 	if cfg.MaxRequestBytes > recommendedMaxRequestBytes {
 		if cfg.Logger != nil {
 			cfg.Logger.Warn(
@@ -511,7 +517,7 @@ func NewServer(cfg ServerConfig) (srv *EtcdServer, err error) {
 		lstats:           lstats,
 		SyncTicker:       time.NewTicker(500 * time.Millisecond),
 		peerRt:           prt,
-		reqIDGen:         idutil.NewGenerator(uint16(id), time.Now()),
+		reqIDGen:         newReqIDGenerator(uint16(id), cfg.IDCounterBits),
 		forceVersionC:    make(chan struct{}),
 		AccessController: &AccessController{CORS: cfg.CORS, HostWhitelist: cfg.HostWhitelist},
 	}
@@ -524,7 +530,10 @@ func NewServer(cfg ServerConfig) (srv *EtcdServer, err error) {
 
 	// always recover lessor before kv. When we recover the mvcc.KV it will reattach keys to its leases.
 	// If we recover mvcc.KV first, it will attach the keys to the wrong lessor before it recovers.
-	srv.lessor = lease.NewLessor(srv.getLogger(), srv.be, lease.LessorConfig{MinLeaseTTL: int64(math.Ceil(minTTL.Seconds())), CheckpointInterval: cfg.LeaseCheckpointInterval})
+	srv.lessor, err = lease.NewLessorWithConfig(srv.getLogger(), srv.be, lease.LessorConfig{MinLeaseTTL: int64(math.Ceil(minTTL.Seconds())), CheckpointInterval: cfg.LeaseCheckpointInterval})
+	if err != nil {
+		return nil, err
+	}
 	srv.kv = mvcc.New(srv.getLogger(), srv.be, srv.lessor, &srv.consistIndex)
 	if beExist {
 		kvindex := srv.kv.ConsistentIndex()
@@ -554,6 +563,9 @@ func NewServer(cfg ServerConfig) (srv *EtcdServer, err error) {
 	}()
 
 	srv.consistIndex.setConsistentIndex(srv.kv.ConsistentIndex())
+	// the kv has reattached the keys of the leases whose revocation was
+	// interrupted; finish it before applying further entries.
+	srv.lessor.ResumeRevokes()
 	tp, err := auth.NewTokenProvider(cfg.Logger, cfg.AuthToken,
 		func(index uint64) <-chan struct{} {
 			return srv.applyWait.Wait(index)
@@ -618,6 +630,15 @@ func NewServer(cfg ServerConfig) (srv *EtcdServer, err error) {
 	return srv, nil
 }
 
+// newReqIDGenerator creates the request ID generator with a counter of
+// cntBits, or of the default width if zero.
+func newReqIDGenerator(memberID uint16, cntBits uint) *idutil.Generator {
+	if cntBits == 0 {
+		return idutil.NewGenerator(memberID, time.Now())
+	}
+	return idutil.NewGeneratorWithCounterLen(memberID, time.Now(), cntBits)
+}
+
 func (s *EtcdServer) getLogger() *zap.Logger {
 	s.lgMu.RLock()
 	l := s.lg
@@ -920,8 +941,13 @@ func (s *EtcdServer) run() {
 		return
 	}
 	rh := &raftReadyHandler{
-		getLead:    func() (lead uint64) { return s.getLead() },
-		updateLead: func(lead uint64) { s.setLead(lead) },
+		getLead: func() (lead uint64) { return s.getLead() },
+		updateLead: func(lead uint64) {
+			s.setLead(lead)
+			if s.lessor != nil {
+				s.lessor.SetPrimaryLeader(lead)
+			}
+		},
 		updateLeadership: func(newLeader bool) {
 			if !s.isLeader() {
 				if s.lessor != nil {
@@ -1009,9 +1035,9 @@ func (s *EtcdServer) run() {
 		close(s.done)
 	}()
 
-	var expiredLeaseC <-chan []*lease.Lease
+	var expiredLeaseC <-chan lease.ExpiredLeaseBatch
 	if s.lessor != nil {
-		expiredLeaseC = s.lessor.ExpiredLeasesC()
+		expiredLeaseC = s.lessor.ExpiredLeaseBatchC()
 	}
 
 	for {
@@ -1019,20 +1045,34 @@ func (s *EtcdServer) run() {
 		case ap := <-s.r.apply():
 			f := func(context.Context) { s.applyAll(&ep, &ap) }
 			sched.Schedule(f)
-		case leases := <-expiredLeaseC:
+		case batch, ok := <-expiredLeaseC:
+			if !ok {
+				// the lessor has stopped
+				expiredLeaseC = nil
+				continue
+			}
+			gen := batch.Generation
 			s.goAttach(func() {
 				// Increases throughput of expired leases deletion process through parallelization
 				c := make(chan struct{}, maxPendingRevokes)
-				for _, lease := range leases {
+				for _, l := range batch.Leases {
 					select {
 					case c <- struct{}{}:
 					case <-s.stopping:
 						return
 					}
-					lid := lease.ID
+					// the lessor was demoted or re-promoted since the batch was found;
+					// the current primary decides the expiration of the remaining leases.
+					if s.lessor.Generation() != gen {
+						<-c
+						return
+					}
+					lid := l.ID
 					s.goAttach(func() {
 						ctx := s.authStore.WithRoot(s.ctx)
 						_, lerr := s.LeaseRevoke(ctx, &pb.LeaseRevokeRequest{ID: int64(lid)})
+						// the lessor delivers the lease again if revoking failed
+						s.lessor.ExpiredAck([]lease.LeaseID{lid}, lerr == nil)
 						if lerr == nil {
 							leaseExpired.Inc()
 						} else {
@@ -1159,7 +1199,13 @@ func (s *EtcdServer) applySnapshot(ep *etcdProgress, apply *apply) {
 			plog.Info("recovering lessor...")
 		}
 
-		s.lessor.Recover(newbe, func() lease.TxnDelete { return s.kv.Write() })
+		if err := s.lessor.Recover(newbe, func() lease.TxnDelete { return s.kv.Write() }); err != nil {
+			if lg != nil {
+				lg.Panic("failed to restore lease store", zap.Error(err))
+			} else {
+				plog.Panicf("restore lease store error: %v", err)
+			}
+		}
 
 		if lg != nil {
 			lg.Info("restored lease store")
@@ -1183,6 +1229,9 @@ func (s *EtcdServer) applySnapshot(ep *etcdProgress, apply *apply) {
 	}
 
 	s.consistIndex.setConsistentIndex(s.kv.ConsistentIndex())
+	if s.lessor != nil {
+		s.lessor.ResumeRevokes()
+	}
 	if lg != nil {
 		lg.Info("restored mvcc store")
 	} else {
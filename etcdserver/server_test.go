@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"path"
@@ -1789,3 +1790,164 @@ func (s *sendMsgAppRespTransporter) Send(m []raftpb.Message) {
 	}
 	s.sendC <- send
 }
+
+// TestNextLeaseIDAfterRestart ensures lease IDs chosen after a restart with
+// the clock stepped backwards are above the IDs granted before, including
+// revoked ones.
+func TestNextLeaseIDAfterRestart(t *testing.T) {
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	defer os.RemoveAll(tmpPath)
+	defer be.Close()
+
+	now := time.Now()
+	le := lease.NewLessor(zap.NewExample(), be, lease.LessorConfig{MinLeaseTTL: 1})
+	var ci consistentIndex
+	kv := mvcc.New(zap.NewExample(), be, le, &ci)
+	s := &EtcdServer{reqIDGen: idutil.NewGenerator(1, now), lessor: le}
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id := s.nextLeaseID()
+		if _, err := le.Grant(lease.LeaseID(id), 10); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	last := ids[len(ids)-1]
+	if err := le.Revoke(lease.LeaseID(last)); err != nil {
+		t.Fatal(err)
+	}
+	kv.Close()
+	le.Stop()
+
+	le = lease.NewLessor(zap.NewExample(), be, lease.LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	s = &EtcdServer{reqIDGen: idutil.NewGenerator(1, now.Add(-time.Hour)), lessor: le}
+	for i := 0; i < 3; i++ {
+		id := s.nextLeaseID()
+		if id <= last {
+			t.Fatalf("lease id after restart = %x, want above %x", id, last)
+		}
+		if _, err := le.Grant(lease.LeaseID(id), 10); err != nil {
+			t.Fatal(err)
+		}
+		last = id
+	}
+}
+
+// TestNextLeaseIDMemberPrefix ensures lease IDs keep the member ID prefix
+// when the highest granted ID is from another member.
+func TestNextLeaseIDMemberPrefix(t *testing.T) {
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	defer os.RemoveAll(tmpPath)
+	defer be.Close()
+
+	now := time.Now()
+	le := lease.NewLessor(zap.NewExample(), be, lease.LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	max := int64(idutil.NewGenerator(2, now.Add(time.Hour)).Next())
+	if _, err := le.Grant(lease.LeaseID(max), 10); err != nil {
+		t.Fatal(err)
+	}
+	s := &EtcdServer{reqIDGen: idutil.NewGenerator(1, now), lessor: le}
+	for i := 0; i < 3; i++ {
+		id := s.nextLeaseID()
+		if member := uint16(id >> 48); member != 1 {
+			t.Fatalf("member of lease id %x = %d, want 1", id, member)
+		}
+		if id&idutil.SuffixMask <= max&idutil.SuffixMask {
+			t.Fatalf("suffix of lease id %x not above the suffix of %x", id, max)
+		}
+	}
+}
+
+// TestNextLeaseIDConcurrent ensures concurrent callers get distinct lease IDs
+// while the ID generator lags behind the highest granted ID.
+func TestNextLeaseIDConcurrent(t *testing.T) {
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	defer os.RemoveAll(tmpPath)
+	defer be.Close()
+
+	now := time.Now()
+	le := lease.NewLessor(zap.NewExample(), be, lease.LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	max := int64(idutil.NewGenerator(1, now).Next())
+	if _, err := le.Grant(lease.LeaseID(max), 10); err != nil {
+		t.Fatal(err)
+	}
+	s := &EtcdServer{reqIDGen: idutil.NewGenerator(1, now.Add(-time.Hour)), lessor: le}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = make(map[int64]bool)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := s.nextLeaseID()
+				mu.Lock()
+				if seen[id] || id <= max {
+					t.Errorf("lease id %x is taken or not above %x", id, max)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestNextLeaseIDCounterOverflow ensures lease IDs stay unique when grants
+// overflow the counter of the ID generator, and valid once the highest lease
+// ID is taken.
+func TestNextLeaseIDCounterOverflow(t *testing.T) {
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	defer os.RemoveAll(tmpPath)
+	defer be.Close()
+
+	le := lease.NewLessor(zap.NewExample(), be, lease.LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	// a 1 bit counter overflows every other grant within a millisecond
+	s := &EtcdServer{reqIDGen: idutil.NewGeneratorWithCounterLen(1, time.Now(), 1), lessor: le}
+
+	seen := make(map[int64]bool)
+	for i := 0; i < 1000; i++ {
+		id := s.nextLeaseID()
+		if seen[id] {
+			t.Fatalf("lease id %x generated twice", id)
+		}
+		seen[id] = true
+		if _, err := le.Grant(lease.LeaseID(id), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := le.Grant(math.MaxInt64, 10); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		id := s.nextLeaseID()
+		if id <= 0 || id == math.MaxInt64 {
+			t.Fatalf("lease id = %x after the highest id is taken", id)
+		}
+		if _, err := le.Grant(lease.LeaseID(id), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestNewReqIDGenerator ensures the request ID generator uses the configured
+// counter width, or one byte by default.
+func TestNewReqIDGenerator(t *testing.T) {
+	for _, tt := range []struct {
+		cntBits, wbits uint
+	}{{0, 8}, {16, 16}} {
+		id := newReqIDGenerator(1, tt.cntBits).Next()
+		if cnt := id & (1<<tt.wbits - 1); cnt != 1 {
+			t.Errorf("counter of first id with width %d = %x, want 1", tt.cntBits, cnt)
+		}
+	}
+}
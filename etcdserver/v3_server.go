@@ -18,6 +18,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/v3/auth"
@@ -26,6 +29,7 @@ import (
 	"go.etcd.io/etcd/v3/lease"
 	"go.etcd.io/etcd/v3/lease/leasehttp"
 	"go.etcd.io/etcd/v3/mvcc"
+	"go.etcd.io/etcd/v3/pkg/idutil"
 	"go.etcd.io/etcd/v3/raft"
 
 	"github.com/gogo/protobuf/proto"
@@ -58,6 +62,10 @@ type Lessor interface {
 	// is returned.
 	LeaseRenew(ctx context.Context, id lease.LeaseID) (int64, error)
 
+	// LeaseRenewBatch renews the leases with given IDs like LeaseRenew. The
+	// TTL and the error of each renewal are returned in the order of ids.
+	LeaseRenewBatch(ctx context.Context, ids []lease.LeaseID) ([]int64, []error)
+
 	// LeaseTimeToLive retrieves lease information.
 	LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error)
 
@@ -215,15 +223,56 @@ func (s *EtcdServer) Compact(ctx context.Context, r *pb.CompactionRequest) (*pb.
 
 func (s *EtcdServer) LeaseGrant(ctx context.Context, r *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
 	// no id given? choose one
-	for r.ID == int64(lease.NoLease) {
+	auto := r.ID == int64(lease.NoLease)
+	for {
+		if auto {
+			r.ID = s.nextLeaseID()
+		}
+		resp, err := s.raftRequestOnce(ctx, pb.InternalRaftRequest{LeaseGrant: r})
+		if auto && err == lease.ErrLeaseExists {
+			// raced with a concurrent grant for the same ID; the next
+			// one is above it.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pb.LeaseGrantResponse), nil
+	}
+}
+
+// nextLeaseID returns a lease ID whose suffix, the part below the member ID,
+// is above the suffix of the highest ID ever granted, so that lease IDs keep
+// increasing across restarts, which reseed reqIDGen from a clock that may have
+// stepped backwards. The member ID prefix is kept, so that members never pick
+// the same ID. IDs handed out but not yet granted are tracked in leaseIDHigh,
+// so that concurrent grants get distinct IDs while reqIDGen lags behind. Once
+// the highest suffix is taken, it returns the ID from reqIDGen as is;
+// LeaseGrant retries taken IDs.
+func (s *EtcdServer) nextLeaseID() int64 {
+	var id int64
+	for id == int64(lease.NoLease) {
 		// only use positive int64 id's
-		r.ID = int64(s.reqIDGen.Next() & ((1 << 63) - 1))
+		id = int64(s.reqIDGen.Next() & ((1 << 63) - 1))
 	}
-	resp, err := s.raftRequestOnce(ctx, pb.InternalRaftRequest{LeaseGrant: r})
-	if err != nil {
-		return nil, err
+	prefix := id &^ idutil.SuffixMask
+	for {
+		high := atomic.LoadInt64(&s.leaseIDHigh)
+		floor := high & idutil.SuffixMask
+		if max := int64(s.lessor.MaxLeaseID()) & idutil.SuffixMask; max > floor {
+			floor = max
+		}
+		if floor == idutil.SuffixMask {
+			return id
+		}
+		next := id
+		if next&idutil.SuffixMask <= floor {
+			next = prefix | (floor + 1)
+		}
+		if atomic.CompareAndSwapInt64(&s.leaseIDHigh, high, next) {
+			return next
+		}
 	}
-	return resp.(*pb.LeaseGrantResponse), nil
 }
 
 func (s *EtcdServer) LeaseRevoke(ctx context.Context, r *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
@@ -239,7 +288,7 @@ func (s *EtcdServer) LeaseRenew(ctx context.Context, id lease.LeaseID) (int64, e
 	if err == nil { // already requested to primary lessor(leader)
 		return ttl, nil
 	}
-	if err != lease.ErrNotPrimary {
+	if !errors.Is(err, lease.ErrNotPrimary) {
 		return -1, err
 	}
 
@@ -263,6 +312,26 @@ func (s *EtcdServer) LeaseRenew(ctx context.Context, id lease.LeaseID) (int64, e
 	return -1, ErrTimeout
 }
 
+func (s *EtcdServer) LeaseRenewBatch(ctx context.Context, ids []lease.LeaseID) ([]int64, []error) {
+	ttls, errs := s.lessor.RenewBatch(ids)
+
+	// forward the renewals the local lessor is not primary for, in parallel
+	// as LeaseRenew would be called.
+	var wg sync.WaitGroup
+	for i, err := range errs {
+		if !errors.Is(err, lease.ErrNotPrimary) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ttls[i], errs[i] = s.LeaseRenew(ctx, ids[i])
+		}(i)
+	}
+	wg.Wait()
+	return ttls, errs
+}
+
 func (s *EtcdServer) LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error) {
 	if s.Leader() == s.ID() {
 		// primary; timetolive directly from leader
@@ -271,7 +340,7 @@ func (s *EtcdServer) LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveR
 			return nil, lease.ErrLeaseNotFound
 		}
 		// TODO: fill out ResponseHeader
-		resp := &pb.LeaseTimeToLiveResponse{Header: &pb.ResponseHeader{}, ID: r.ID, TTL: int64(le.Remaining().Seconds()), GrantedTTL: le.TTL()}
+		resp := &pb.LeaseTimeToLiveResponse{Header: &pb.ResponseHeader{}, ID: r.ID, TTL: le.TimeToLive(), GrantedTTL: le.TTL()}
 		if r.Keys {
 			ks := le.Keys()
 			kbs := make([][]byte, len(ks))
@@ -0,0 +1,42 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import "time"
+
+// clock is the time source of the lessor. Lease expiries are tracked on its
+// monotonic reading, so steps of the wall clock, e.g. by NTP, neither extend
+// nor shorten lease lifetimes.
+type clock interface {
+	// Now returns the wall clock time. It is only used for timestamps
+	// persisted across restarts.
+	Now() time.Time
+	// Elapsed returns the monotonic time elapsed since the clock started.
+	Elapsed() time.Duration
+}
+
+// systemClock reads the system clock.
+type systemClock struct {
+	start time.Time
+}
+
+func newSystemClock() *systemClock {
+	return &systemClock{start: time.Now()}
+}
+
+func (c *systemClock) Now() time.Time { return time.Now() }
+
+// Elapsed relies on the monotonic clock reading of time.Time.
+func (c *systemClock) Elapsed() time.Duration { return time.Since(c.start) }
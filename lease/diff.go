@@ -0,0 +1,85 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import "sort"
+
+// Equal returns true if both leases have the same ID, TTL and items. The
+// expiry is local to each lessor and not compared.
+func (l *Lease) Equal(other *Lease) bool {
+	if l == nil || other == nil {
+		return l == other
+	}
+	if l.ID != other.ID || l.TTLDuration() != other.TTLDuration() {
+		return false
+	}
+
+	l.mu.RLock()
+	items := make([]LeaseItem, 0, len(l.itemSet))
+	for it := range l.itemSet {
+		items = append(items, it)
+	}
+	l.mu.RUnlock()
+
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	if len(items) != len(other.itemSet) {
+		return false
+	}
+	for _, it := range items {
+		if _, ok := other.itemSet[it]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// LeaseDiff is a lease that differs between two lessors. A or B is nil if the
+// lease is missing from the respective lessor.
+type LeaseDiff struct {
+	ID LeaseID
+	A  *Lease
+	B  *Lease
+}
+
+// DiffLeases compares the leases of a and b, e.g. to verify that a follower
+// converged to the state of the leader. It returns the differing leases
+// ordered by ID.
+func DiffLeases(a, b Lessor) []LeaseDiff {
+	la := leasesByID(a.Leases())
+	lb := leasesByID(b.Leases())
+
+	var diffs []LeaseDiff
+	for id, l := range la {
+		if !l.Equal(lb[id]) {
+			diffs = append(diffs, LeaseDiff{ID: id, A: l, B: lb[id]})
+		}
+	}
+	for id, l := range lb {
+		if _, ok := la[id]; !ok {
+			diffs = append(diffs, LeaseDiff{ID: id, B: l})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].ID < diffs[j].ID })
+	return diffs
+}
+
+func leasesByID(leases []*Lease) map[LeaseID]*Lease {
+	m := make(map[LeaseID]*Lease, len(leases))
+	for _, l := range leases {
+		m[l.ID] = l
+	}
+	return m
+}
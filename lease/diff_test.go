@@ -0,0 +1,82 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// TestDiffLeases ensures DiffLeases reports leases missing from either lessor
+// or differing in TTL or items, but not in expiry.
+func TestDiffLeases(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+	dir2, be2 := NewTestBackend(t)
+	defer os.RemoveAll(dir2)
+	defer be2.Close()
+
+	leader := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer leader.Stop()
+	follower := newLessor(lg, be2, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer follower.Stop()
+	// expiries differ between the primary and the others
+	leader.Promote(0)
+
+	for _, le := range []*lessor{leader, follower} {
+		for _, id := range []LeaseID{1, 2, 3} {
+			if _, err := le.Grant(id, 100); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := le.Attach(1, []LeaseItem{{"foo"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diffs := DiffLeases(leader, follower); len(diffs) != 0 {
+		t.Fatalf("diffs of converged lessors = %v, want none", diffs)
+	}
+	if !leader.Lookup(1).Equal(follower.Lookup(1)) {
+		t.Error("lease 1 differs between converged lessors")
+	}
+
+	if _, err := leader.Grant(4, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := follower.Grant(5, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Attach(2, []LeaseItem{{"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := DiffLeases(leader, follower)
+	if len(diffs) != 3 {
+		t.Fatalf("diffs = %v, want 3", diffs)
+	}
+	if d := diffs[0]; d.ID != 2 || d.A != leader.Lookup(2) || d.B != follower.Lookup(2) {
+		t.Errorf("diff of lease 2 = %+v, want both leases", d)
+	}
+	if d := diffs[1]; d.ID != 4 || d.A != leader.Lookup(4) || d.B != nil {
+		t.Errorf("diff of lease 4 = %+v, want lease missing from follower", d)
+	}
+	if d := diffs[2]; d.ID != 5 || d.A != nil || d.B != follower.Lookup(5) {
+		t.Errorf("diff of lease 5 = %+v, want lease missing from leader", d)
+	}
+}
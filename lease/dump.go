@@ -0,0 +1,232 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+
+	"go.etcd.io/etcd/v3/lease/leasepb"
+)
+
+// A lease dump starts with its version and the number of leases, followed by
+// a record per lease:
+//
+//	uint32 length | leasepb.Lease
+//	uint32 number of keys | (uint32 length | key)...
+//
+// All integers are big endian.
+const leaseDumpVersion = uint32(1)
+
+// leaseDumpRecord is a lease as written to a dump.
+type leaseDumpRecord struct {
+	lease leasepb.Lease
+	keys  []string
+}
+
+func (le *lessor) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	// encode under the lock for a consistent view, but write after
+	// releasing it so that a slow writer does not block the lessor.
+	le.mu.RLock()
+	ids := make([]LeaseID, 0, len(le.leaseMap))
+	for id := range le.leaseMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	writeUint32(&buf, leaseDumpVersion)
+	writeUint64(&buf, uint64(len(ids)))
+	for _, id := range ids {
+		l := le.leaseMap[id]
+		lpb := l.proto()
+		// unlike the backend, which all members must agree on, the dump
+		// carries the local grant time.
+		if !l.grantedAt.IsZero() {
+			lpb.GrantedAt = l.grantedAt.UnixNano()
+		}
+		val, err := lpb.Marshal()
+		if err != nil {
+			le.mu.RUnlock()
+			return 0, err
+		}
+		writeBytes(&buf, val)
+
+		keys := l.Keys()
+		sort.Strings(keys)
+		writeUint32(&buf, uint32(len(keys)))
+		for _, k := range keys {
+			writeBytes(&buf, []byte(k))
+		}
+	}
+	le.mu.RUnlock()
+
+	return buf.WriteTo(w)
+}
+
+func (le *lessor) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	records, err := readLeaseDump(cr)
+	if err != nil {
+		return cr.n, err
+	}
+
+	tx := le.lockTx()
+	defer le.unlockTx(tx)
+	if le.closed {
+		return cr.n, ErrLessorStopped
+	}
+
+	for _, rec := range records {
+		if _, ok := le.leaseMap[LeaseID(rec.lease.ID)]; ok {
+			return cr.n, ErrLeaseExists
+		}
+	}
+	for _, rec := range records {
+		l := &Lease{
+			ID:           LeaseID(rec.lease.ID),
+			ttl:          rec.lease.TTL,
+			ttlDuration:  time.Duration(rec.lease.TTLNanos),
+			remainingTTL: rec.lease.RemainingTTL,
+			retainKeys:   rec.lease.RetainKeys,
+			permanent:    rec.lease.Permanent,
+			itemSet:      make(map[LeaseItem]struct{}),
+			revokec:      make(chan struct{}),
+			clock:        le.clock,
+			grid:         le.expiryGranularity,
+		}
+		if rec.lease.GrantedAt != 0 {
+			l.grantedAt = time.Unix(0, rec.lease.GrantedAt)
+		}
+		if le.isPrimary() && !l.permanent {
+			l.refresh(0)
+			le.capLifetime(l)
+			le.unsafePushExpiry(l)
+			le.scheduleCheckpointIfNeeded(l)
+		} else {
+			l.untrack()
+		}
+		le.leaseMap[l.ID] = l
+
+		items := make([]LeaseItem, len(rec.keys))
+		for i, k := range rec.keys {
+			items[i] = LeaseItem{Key: k}
+		}
+		le.unsafeAttach(l, items)
+		l.unsafePersistTo(tx, le.bucketName)
+		le.unsafeRaiseMaxID(tx, l.ID)
+	}
+	return cr.n, nil
+}
+
+func readLeaseDump(r io.Reader) ([]leaseDumpRecord, error) {
+	version, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != leaseDumpVersion {
+		return nil, ErrLeaseDumpVersion
+	}
+	n, err := readUint64(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []leaseDumpRecord
+	for i := uint64(0); i < n; i++ {
+		var rec leaseDumpRecord
+		val, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		if err = unmarshalLease(val, &rec.lease); err != nil {
+			return nil, err
+		}
+		nkeys, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		for j := uint32(0); j < nkeys; j++ {
+			k, err := readBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			rec.keys = append(rec.keys, string(k))
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeBytes(buf *bytes.Buffer, p []byte) {
+	writeUint32(buf, uint32(len(p)))
+	buf.Write(p)
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, n)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
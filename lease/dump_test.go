@@ -0,0 +1,157 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// TestLessorDumpRoundTrip ensures a dump written by WriteTo restores the
+// same leases with ReadFrom.
+func TestLessorDumpRoundTrip(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	ids := []LeaseID{1, 2, math.MaxInt64}
+	for _, id := range ids {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Attach(math.MaxInt64, []LeaseItem{{"baz"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Checkpoint(2, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := le.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("written = %d, want %d", n, buf.Len())
+	}
+	size := buf.Len()
+
+	dir2, be2 := NewTestBackend(t)
+	defer os.RemoveAll(dir2)
+	defer be2.Close()
+
+	le2 := newLessor(lg, be2, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le2.Stop()
+
+	if n, err = le2.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(size) {
+		t.Errorf("read = %d, want %d", n, size)
+	}
+
+	for _, id := range ids {
+		l, l2 := le.Lookup(id), le2.Lookup(id)
+		if l2 == nil {
+			t.Fatalf("lease %x is not restored", id)
+		}
+		if l2.ttl != l.ttl || l2.remainingTTL != l.remainingTTL || !l2.grantedAt.Equal(l.grantedAt) {
+			t.Errorf("restored lease %x = (%d, %d, %v), want (%d, %d, %v)",
+				id, l2.ttl, l2.remainingTTL, l2.grantedAt, l.ttl, l.remainingTTL, l.grantedAt)
+		}
+		keys, keys2 := l.Keys(), l2.Keys()
+		sort.Strings(keys)
+		sort.Strings(keys2)
+		if !reflect.DeepEqual(keys2, keys) {
+			t.Errorf("keys of restored lease %x = %v, want %v", id, keys2, keys)
+		}
+	}
+	if id := le2.GetLease(LeaseItem{"baz"}); id != math.MaxInt64 {
+		t.Errorf("lease of baz = %x, want %x", id, LeaseID(math.MaxInt64))
+	}
+
+	// a second dump of the restored lessor is identical
+	var buf2 bytes.Buffer
+	if _, err = le2.WriteTo(&buf2); err != nil {
+		t.Fatal(err)
+	}
+	var buf1 bytes.Buffer
+	if _, err = le.WriteTo(&buf1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+		t.Error("dump of restored lessor differs from the original dump")
+	}
+
+	// restoring leases that already exist fails
+	if _, err = le2.ReadFrom(&buf1); err != ErrLeaseExists {
+		t.Errorf("restore existing leases = %v, want %v", err, ErrLeaseExists)
+	}
+}
+
+// TestLessorReadFromInvalidDump ensures ReadFrom rejects dumps of an unknown
+// version or cut short without restoring anything.
+func TestLessorReadFromInvalidDump(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	if _, err := le.Grant(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := le.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.Bytes()
+
+	dir2, be2 := NewTestBackend(t)
+	defer os.RemoveAll(dir2)
+	defer be2.Close()
+
+	le2 := newLessor(lg, be2, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le2.Stop()
+
+	bad := append([]byte{}, dump...)
+	bad[3] = 2
+	if _, err := le2.ReadFrom(bytes.NewReader(bad)); err != ErrLeaseDumpVersion {
+		t.Errorf("restore with unknown version = %v, want %v", err, ErrLeaseDumpVersion)
+	}
+	if _, err := le2.ReadFrom(bytes.NewReader(dump[:len(dump)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("restore of truncated dump = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if len(le2.Leases()) != 0 {
+		t.Errorf("restored %d leases from invalid dumps, want 0", len(le2.Leases()))
+	}
+}
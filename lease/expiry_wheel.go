@@ -0,0 +1,149 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryWheel schedules lease expiries in slots of the expiry granularity
+// instead of one heap item per lease. As expiries are rounded up to the
+// granularity, the leases of a slot expire together and the expiry scan takes
+// them slot by slot. Scheduling a lease is O(1); only the first lease of a
+// slot pushes the slot onto a heap of the far fewer slots.
+type expiryWheel struct {
+	grid  time.Duration
+	slots map[int64]*expirySlot
+	// order is a min-heap of the slots by number.
+	order slotQueue
+	// n is the number of scheduled leases.
+	n int
+}
+
+// expirySlot holds the leases expiring within one granularity interval.
+type expirySlot struct {
+	num int64
+	// expiry is the latest expiry scheduled in the slot, on the monotonic
+	// clock of the lessor.
+	expiry int64
+	leases []*Lease
+	index  int
+}
+
+func newExpiryWheel(grid time.Duration) *expiryWheel {
+	return &expiryWheel{grid: grid, slots: make(map[int64]*expirySlot)}
+}
+
+func (w *expiryWheel) Len() int { return w.n }
+
+// push schedules the lease to expire at expiry, moving it out of the slot it
+// was scheduled in before.
+func (w *expiryWheel) push(l *Lease, expiry int64) {
+	num := expiry / int64(w.grid)
+	if s := l.slot; s != nil && w.slots[s.num] == s {
+		if s.num == num {
+			if expiry > s.expiry {
+				s.expiry = expiry
+			}
+			return
+		}
+		w.remove(l)
+	}
+
+	s := w.slots[num]
+	if s == nil {
+		s = &expirySlot{num: num, expiry: expiry}
+		w.slots[num] = s
+		heap.Push(&w.order, s)
+	} else if expiry > s.expiry {
+		s.expiry = expiry
+	}
+	l.slot, l.slotIndex = s, len(s.leases)
+	s.leases = append(s.leases, l)
+	w.n++
+}
+
+// remove unschedules the lease.
+func (w *expiryWheel) remove(l *Lease) {
+	s := l.slot
+	l.slot = nil
+	if s == nil || w.slots[s.num] != s {
+		// scheduled before a reset
+		return
+	}
+	last := len(s.leases) - 1
+	moved := s.leases[last]
+	s.leases[l.slotIndex] = moved
+	moved.slotIndex = l.slotIndex
+	s.leases[last] = nil
+	s.leases = s.leases[:last]
+	w.n--
+	if len(s.leases) == 0 {
+		delete(w.slots, s.num)
+		heap.Remove(&w.order, s.index)
+	}
+}
+
+// peek returns a lease of the earliest slot and the expiry of the slot.
+func (w *expiryWheel) peek() (l *Lease, expiry int64, ok bool) {
+	if len(w.order) == 0 {
+		return nil, 0, false
+	}
+	s := w.order[0]
+	return s.leases[len(s.leases)-1], s.expiry, true
+}
+
+// pop unschedules the lease returned by peek.
+func (w *expiryWheel) pop() {
+	if l, _, ok := w.peek(); ok {
+		w.remove(l)
+	}
+}
+
+// reset unschedules all leases.
+func (w *expiryWheel) reset() {
+	w.slots = make(map[int64]*expirySlot)
+	w.order = nil
+	w.n = 0
+}
+
+type slotQueue []*expirySlot
+
+func (q slotQueue) Len() int { return len(q) }
+
+func (q slotQueue) Less(i, j int) bool { return q[i].num < q[j].num }
+
+func (q slotQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *slotQueue) Push(x interface{}) {
+	s := x.(*expirySlot)
+	s.index = len(*q)
+	*q = append(*q, s)
+}
+
+func (q *slotQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.index = -1
+	*q = old[:n-1]
+	return s
+}
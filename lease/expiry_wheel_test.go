@@ -0,0 +1,81 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExpiryWheel(t *testing.T) {
+	w := newExpiryWheel(time.Second)
+	leases := make([]*Lease, 6)
+	for i := range leases {
+		leases[i] = &Lease{ID: LeaseID(i + 1)}
+		// two leases per slot, in reverse order of expiry
+		w.push(leases[i], int64(time.Duration(3-i/2)*time.Second))
+	}
+	if w.Len() != 6 || len(w.slots) != 3 {
+		t.Fatalf("leases, slots = %d, %d, want 6, 3", w.Len(), len(w.slots))
+	}
+
+	// rescheduling within the slot keeps the lease in place
+	w.push(leases[0], int64(3*time.Second))
+	// moving the last lease out of the slot at 1s removes the slot
+	w.push(leases[4], int64(5*time.Second))
+	w.push(leases[5], int64(5*time.Second))
+	w.remove(leases[1])
+	if w.Len() != 5 || len(w.slots) != 3 {
+		t.Fatalf("leases, slots = %d, %d, want 5, 3", w.Len(), len(w.slots))
+	}
+
+	var (
+		expiries []time.Duration
+		ids      = make(map[time.Duration][]LeaseID)
+	)
+	for {
+		l, expiry, ok := w.peek()
+		if !ok {
+			break
+		}
+		w.pop()
+		d := time.Duration(expiry)
+		if len(ids[d]) == 0 {
+			expiries = append(expiries, d)
+		}
+		ids[d] = append(ids[d], l.ID)
+	}
+	if w.Len() != 0 || len(w.slots) != 0 {
+		t.Fatalf("leases, slots = %d, %d after popping all, want 0, 0", w.Len(), len(w.slots))
+	}
+
+	wexpiries := []time.Duration{2 * time.Second, 3 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(expiries, wexpiries) {
+		t.Fatalf("slot expiries = %v, want %v", expiries, wexpiries)
+	}
+	wids := map[time.Duration][]LeaseID{
+		2 * time.Second: {3, 4},
+		3 * time.Second: {1},
+		5 * time.Second: {5, 6},
+	}
+	for _, ls := range ids {
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+	}
+	if !reflect.DeepEqual(ids, wids) {
+		t.Errorf("leases by expiry = %v, want %v", ids, wids)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"container/heap"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// itemExpiry schedules the early expiry of an item attached with a TTL. The
+// item expires independently of the lease it is attached to, which renewals
+// of the lease do not change.
+type itemExpiry struct {
+	item LeaseItem
+	// expiry is on the monotonic clock of the lessor.
+	expiry int64
+	index  int
+}
+
+// itemExpiryQueue is a min-heap of item expiries.
+type itemExpiryQueue []*itemExpiry
+
+func (q itemExpiryQueue) Len() int { return len(q) }
+
+func (q itemExpiryQueue) Less(i, j int) bool { return q[i].expiry < q[j].expiry }
+
+func (q itemExpiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *itemExpiryQueue) Push(x interface{}) {
+	ie := x.(*itemExpiry)
+	ie.index = len(*q)
+	*q = append(*q, ie)
+}
+
+func (q *itemExpiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	ie := old[n-1]
+	old[n-1] = nil
+	ie.index = -1
+	*q = old[:n-1]
+	return ie
+}
+
+// unsafeSetItemExpiry schedules the items to expire after ttl, or unschedules
+// them if ttl is zero. The caller must hold mu exclusively.
+func (le *lessor) unsafeSetItemExpiry(items []LeaseItem, ttl time.Duration) {
+	if ttl == 0 {
+		le.unsafeClearItemExpiry(items)
+		return
+	}
+	expiry := int64(le.clock.Elapsed() + ttl)
+	for _, it := range items {
+		if ie := le.itemExpiryMap[it]; ie != nil {
+			ie.expiry = expiry
+			heap.Fix(&le.itemExpiries, ie.index)
+			continue
+		}
+		ie := &itemExpiry{item: it, expiry: expiry}
+		heap.Push(&le.itemExpiries, ie)
+		le.itemExpiryMap[it] = ie
+	}
+}
+
+// unsafeClearItemExpiry unschedules the expiries of the items. The caller
+// must hold mu exclusively.
+func (le *lessor) unsafeClearItemExpiry(items []LeaseItem) {
+	if len(le.itemExpiryMap) == 0 {
+		return
+	}
+	for _, it := range items {
+		if ie := le.itemExpiryMap[it]; ie != nil {
+			heap.Remove(&le.itemExpiries, ie.index)
+			delete(le.itemExpiryMap, it)
+		}
+	}
+}
+
+// unsafeResetItemExpiries unschedules all item expiries. The caller must hold
+// mu exclusively.
+func (le *lessor) unsafeResetItemExpiries() {
+	le.itemExpiries = nil
+	le.itemExpiryMap = make(map[LeaseItem]*itemExpiry)
+}
+
+// expireItems detaches the items past their expiry from their leases and
+// deletes them, while the leases live on.
+func (le *lessor) expireItems() {
+	le.mu.RLock()
+	rd := le.rd
+	due := le.isPrimary() && !le.frozen && rd != nil && len(le.itemExpiries) != 0 &&
+		le.itemExpiries[0].expiry <= int64(le.clock.Elapsed())
+	le.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	// delete the keys in the same backend transaction as detaching them. The
+	// transaction is taken before mu, in the lock order of mu, and the keys
+	// are deleted after releasing mu, as the store looks up their leases.
+	txn := rd()
+	le.mu.Lock()
+	if !le.isPrimary() || le.frozen || le.closed {
+		txn.End()
+		le.mu.Unlock()
+		return
+	}
+	now := int64(le.clock.Elapsed())
+	limit := leaseRevokeRate / 2
+	var (
+		n    int
+		keys []string
+	)
+	for len(le.itemExpiries) != 0 && le.itemExpiries[0].expiry <= now && n < limit {
+		ie := heap.Pop(&le.itemExpiries).(*itemExpiry)
+		delete(le.itemExpiryMap, ie.item)
+		l := le.leaseMap[le.itemMap[ie.item]]
+		if l == nil {
+			continue
+		}
+		le.unsafeDetach(l, []LeaseItem{ie.item})
+		if !l.retainKeys {
+			keys = append(keys, ie.item.Key)
+		}
+		n++
+		if le.lg != nil {
+			le.lg.Debug(
+				"expired lease item",
+				zap.Int64("lease-id", int64(l.ID)),
+				zap.String("key", ie.item.Key),
+			)
+		}
+	}
+	le.mu.Unlock()
+	for _, key := range keys {
+		txn.DeleteRange([]byte(key), nil)
+	}
+	txn.End()
+	leaseItemExpired.Add(float64(n))
+}
@@ -19,7 +19,7 @@ package lease
 // For the lessor's lease checkpoint heap, the time identifies the next lease checkpoint time.
 type LeaseWithTime struct {
 	id LeaseID
-	// Unix nanos timestamp.
+	// Nanoseconds on the monotonic reading of the lessor clock.
 	time  int64
 	index int
 }
@@ -24,14 +24,15 @@ func TestLeaseQueue(t *testing.T) {
 	le := &lessor{
 		leaseHeap: make(LeaseQueue, 0),
 		leaseMap:  make(map[LeaseID]*Lease),
+		clock:     newSystemClock(),
 	}
 	heap.Init(&le.leaseHeap)
 
 	// insert in reverse order of expiration time
 	for i := 50; i >= 1; i-- {
-		exp := time.Now().Add(time.Hour).UnixNano()
+		exp := int64(le.clock.Elapsed() + time.Hour)
 		if i == 1 {
-			exp = time.Now().UnixNano()
+			exp = int64(le.clock.Elapsed())
 		}
 		le.leaseMap[LeaseID(i)] = &Lease{ID: LeaseID(i)}
 		heap.Push(&le.leaseHeap, &LeaseWithTime{id: LeaseID(i), time: exp})
@@ -113,7 +113,7 @@ func (h *leaseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			LeaseTimeToLiveResponse: &pb.LeaseTimeToLiveResponse{
 				Header:     &pb.ResponseHeader{},
 				ID:         lreq.LeaseTimeToLiveRequest.ID,
-				TTL:        int64(l.Remaining().Seconds()),
+				TTL:        l.TimeToLive(),
 				GrantedTTL: l.TTL(),
 			},
 		}
@@ -43,6 +43,20 @@ type Lease struct {
 	ID           int64 `protobuf:"varint,1,opt,name=ID,proto3" json:"ID,omitempty"`
 	TTL          int64 `protobuf:"varint,2,opt,name=TTL,proto3" json:"TTL,omitempty"`
 	RemainingTTL int64 `protobuf:"varint,3,opt,name=RemainingTTL,proto3" json:"RemainingTTL,omitempty"`
+	// GrantedAt is the local time, in Unix nanoseconds, the lease was granted at.
+	// It is only set in lease dumps, as it differs among members.
+	GrantedAt int64 `protobuf:"varint,4,opt,name=GrantedAt,proto3" json:"GrantedAt,omitempty"`
+	// RetainKeys is set if the keys attached to the lease are kept when it is revoked.
+	RetainKeys bool `protobuf:"varint,5,opt,name=RetainKeys,proto3" json:"RetainKeys,omitempty"`
+	// TTLNanos is the TTL in nanoseconds of leases granted with sub-second precision.
+	TTLNanos int64 `protobuf:"varint,6,opt,name=TTLNanos,proto3" json:"TTLNanos,omitempty"`
+	// Permanent is set if the lease never expires.
+	Permanent bool `protobuf:"varint,7,opt,name=Permanent,proto3" json:"Permanent,omitempty"`
+	// Revoking is set once the revocation of the lease has started.
+	Revoking bool `protobuf:"varint,8,opt,name=Revoking,proto3" json:"Revoking,omitempty"`
+	// Version is the layout version of the record. Zero is the layout before
+	// records were versioned.
+	Version uint32 `protobuf:"varint,9,opt,name=Version,proto3" json:"Version,omitempty"`
 }
 
 func (m *Lease) Reset()                    { *m = Lease{} }
@@ -103,6 +117,51 @@ func (m *Lease) MarshalTo(dAtA []byte) (int, error) {
 		i++
 		i = encodeVarintLease(dAtA, i, uint64(m.RemainingTTL))
 	}
+	if m.GrantedAt != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintLease(dAtA, i, uint64(m.GrantedAt))
+	}
+	if m.RetainKeys {
+		dAtA[i] = 0x28
+		i++
+		if m.RetainKeys {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if m.TTLNanos != 0 {
+		dAtA[i] = 0x30
+		i++
+		i = encodeVarintLease(dAtA, i, uint64(m.TTLNanos))
+	}
+	if m.Permanent {
+		dAtA[i] = 0x38
+		i++
+		if m.Permanent {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if m.Revoking {
+		dAtA[i] = 0x40
+		i++
+		if m.Revoking {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	if m.Version != 0 {
+		dAtA[i] = 0x48
+		i++
+		i = encodeVarintLease(dAtA, i, uint64(m.Version))
+	}
 	return i, nil
 }
 
@@ -183,6 +242,24 @@ func (m *Lease) Size() (n int) {
 	if m.RemainingTTL != 0 {
 		n += 1 + sovLease(uint64(m.RemainingTTL))
 	}
+	if m.GrantedAt != 0 {
+		n += 1 + sovLease(uint64(m.GrantedAt))
+	}
+	if m.RetainKeys {
+		n += 2
+	}
+	if m.TTLNanos != 0 {
+		n += 1 + sovLease(uint64(m.TTLNanos))
+	}
+	if m.Permanent {
+		n += 2
+	}
+	if m.Revoking {
+		n += 2
+	}
+	if m.Version != 0 {
+		n += 1 + sovLease(uint64(m.Version))
+	}
 	return n
 }
 
@@ -305,6 +382,123 @@ func (m *Lease) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field GrantedAt", wireType)
+			}
+			m.GrantedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowLease
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.GrantedAt |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RetainKeys", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowLease
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.RetainKeys = bool(v != 0)
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TTLNanos", wireType)
+			}
+			m.TTLNanos = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowLease
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TTLNanos |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Permanent", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowLease
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Permanent = bool(v != 0)
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Revoking", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowLease
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Revoking = bool(v != 0)
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			m.Version = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowLease
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Version |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipLease(dAtA[iNdEx:])
@@ -600,21 +794,27 @@ var (
 func init() { proto.RegisterFile("lease.proto", fileDescriptorLease) }
 
 var fileDescriptorLease = []byte{
-	// 253 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xce, 0x49, 0x4d, 0x2c,
-	0x4e, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x07, 0x73, 0x0a, 0x92, 0xa4, 0x44, 0xd2,
-	0xf3, 0xd3, 0xf3, 0xc1, 0x62, 0xfa, 0x20, 0x16, 0x44, 0x5a, 0x4a, 0x2d, 0xb5, 0x24, 0x39, 0x45,
-	0x1f, 0x44, 0x14, 0xa7, 0x16, 0x95, 0xa5, 0x16, 0x21, 0x31, 0x0b, 0x92, 0xf4, 0x8b, 0x0a, 0x92,
-	0x21, 0xea, 0x94, 0x7c, 0xb9, 0x58, 0x7d, 0x40, 0x06, 0x09, 0xf1, 0x71, 0x31, 0x79, 0xba, 0x48,
-	0x30, 0x2a, 0x30, 0x6a, 0x30, 0x07, 0x31, 0x79, 0xba, 0x08, 0x09, 0x70, 0x31, 0x87, 0x84, 0xf8,
-	0x48, 0x30, 0x81, 0x05, 0x40, 0x4c, 0x21, 0x25, 0x2e, 0x9e, 0xa0, 0xd4, 0xdc, 0xc4, 0xcc, 0xbc,
-	0xcc, 0xbc, 0x74, 0x90, 0x14, 0x33, 0x58, 0x0a, 0x45, 0x4c, 0xa9, 0x84, 0x4b, 0x04, 0x6c, 0x9c,
-	0x67, 0x5e, 0x49, 0x6a, 0x51, 0x5e, 0x62, 0x4e, 0x50, 0x6a, 0x61, 0x69, 0x6a, 0x71, 0x89, 0x50,
-	0x0c, 0x97, 0x18, 0x58, 0x3c, 0x24, 0x33, 0x37, 0x35, 0x24, 0xdf, 0x27, 0xb3, 0x2c, 0x15, 0x2a,
-	0x03, 0xb6, 0x91, 0xdb, 0x48, 0x45, 0x0f, 0xd9, 0x7d, 0x7a, 0xd8, 0xd5, 0x06, 0xe1, 0x30, 0x43,
-	0xa9, 0x82, 0x4b, 0x14, 0xcd, 0xd6, 0xe2, 0x82, 0xfc, 0xbc, 0xe2, 0x54, 0xa1, 0x78, 0x2e, 0x71,
-	0x0c, 0x2d, 0x10, 0x29, 0xa8, 0xbd, 0xaa, 0x04, 0xec, 0x85, 0x28, 0x0e, 0xc2, 0x65, 0x8a, 0x93,
-	0xc4, 0x89, 0x87, 0x72, 0x0c, 0x17, 0x1e, 0xca, 0x31, 0x9c, 0x78, 0x24, 0xc7, 0x78, 0xe1, 0x91,
-	0x1c, 0xe3, 0x83, 0x47, 0x72, 0x8c, 0x33, 0x1e, 0xcb, 0x31, 0x24, 0xb1, 0x81, 0xc3, 0xd7, 0x18,
-	0x10, 0x00, 0x00, 0xff, 0xff, 0xa9, 0x9f, 0x8b, 0x6c, 0xb5, 0x01, 0x00, 0x00,
+	// 349 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x52, 0xdf, 0x4a, 0x2a, 0x41,
+	0x18, 0x77, 0xf4, 0xf8, 0xef, 0xf3, 0x9c, 0xc3, 0x61, 0xf0, 0xd4, 0x20, 0xb1, 0xc8, 0x52, 0xe1,
+	0x95, 0x42, 0x3d, 0x41, 0x21, 0x84, 0xb4, 0x44, 0x0c, 0x4b, 0x57, 0x41, 0xac, 0xfa, 0xb1, 0x2c,
+	0xe9, 0xcc, 0x36, 0x33, 0x49, 0xbd, 0x49, 0x8f, 0xe4, 0xa5, 0x8f, 0x90, 0xf6, 0x18, 0xdd, 0xc4,
+	0xcc, 0x9a, 0xda, 0x1f, 0xe9, 0x66, 0xf9, 0x7e, 0x7f, 0x3f, 0xf6, 0x63, 0xa0, 0x36, 0xc2, 0x48,
+	0x63, 0x3b, 0x55, 0xd2, 0x48, 0x5a, 0x76, 0x20, 0xed, 0x37, 0xea, 0xb1, 0x8c, 0xa5, 0xe3, 0x3a,
+	0x76, 0xca, 0xe4, 0xc6, 0x21, 0x9a, 0xc1, 0xb0, 0x63, 0x3f, 0x1a, 0xd5, 0x04, 0xd5, 0xc6, 0x98,
+	0xf6, 0x3b, 0x2a, 0x1d, 0x64, 0x3e, 0xff, 0x95, 0x40, 0x31, 0xb0, 0x4d, 0xf4, 0x2f, 0xe4, 0x7b,
+	0x5d, 0x46, 0x9a, 0xa4, 0x55, 0xe0, 0xf9, 0x5e, 0x97, 0xfe, 0x83, 0x42, 0x18, 0x06, 0x2c, 0xef,
+	0x08, 0x3b, 0x52, 0x1f, 0x7e, 0x73, 0x1c, 0x47, 0x89, 0x48, 0x44, 0x6c, 0xa5, 0x82, 0x93, 0x3e,
+	0x70, 0x74, 0x0f, 0xaa, 0x67, 0x2a, 0x12, 0x06, 0x87, 0x27, 0x86, 0xfd, 0x72, 0x86, 0x35, 0x41,
+	0x3d, 0x00, 0x8e, 0x26, 0x4a, 0xc4, 0x39, 0x3e, 0x6a, 0x56, 0x6c, 0x92, 0x56, 0x85, 0x6f, 0x30,
+	0xb4, 0x01, 0x95, 0x30, 0x0c, 0x2e, 0x22, 0x21, 0x35, 0x2b, 0xb9, 0xf0, 0x0a, 0xdb, 0xe6, 0x4b,
+	0x54, 0xe3, 0x48, 0xa0, 0x30, 0xac, 0xec, 0xa2, 0x6b, 0xc2, 0x26, 0x39, 0x4e, 0xe4, 0x6d, 0x22,
+	0x62, 0x56, 0x71, 0xe2, 0x0a, 0x53, 0x06, 0xe5, 0x2b, 0x54, 0x3a, 0x91, 0x82, 0x55, 0x9b, 0xa4,
+	0xf5, 0x87, 0xbf, 0x43, 0xdf, 0x40, 0xdd, 0xfd, 0x7c, 0x4f, 0x18, 0x54, 0x22, 0x1a, 0x71, 0xbc,
+	0xbb, 0x47, 0x6d, 0xe8, 0x35, 0xec, 0x38, 0x3e, 0x4c, 0xc6, 0x18, 0xca, 0x20, 0x99, 0xe0, 0x52,
+	0x71, 0xf7, 0xa9, 0x1d, 0xed, 0xb7, 0x37, 0xcf, 0xd9, 0xfe, 0xde, 0xcb, 0xb7, 0x74, 0xf8, 0x0f,
+	0xf0, 0xff, 0xd3, 0x56, 0x9d, 0x4a, 0xa1, 0x91, 0xde, 0xc0, 0xee, 0x97, 0x48, 0x26, 0x2d, 0xf7,
+	0x1e, 0xfc, 0xb0, 0x37, 0x33, 0xf3, 0x6d, 0x2d, 0xa7, 0x6c, 0x3a, 0xf7, 0x72, 0xb3, 0xb9, 0x97,
+	0x9b, 0x2e, 0x3c, 0x32, 0x5b, 0x78, 0xe4, 0x79, 0xe1, 0x91, 0xa7, 0x17, 0x2f, 0xd7, 0x2f, 0xb9,
+	0xe7, 0x70, 0xfc, 0x36, 0x00, 0xfc, 0x13, 0x48, 0x3a, 0x64, 0x02, 0x00, 0x00,
 }
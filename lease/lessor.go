@@ -19,9 +19,13 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"math"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "go.etcd.io/etcd/v3/etcdserver/etcdserverpb"
@@ -36,10 +40,24 @@ const NoLease = LeaseID(0)
 // MaxLeaseTTL is the maximum lease TTL value
 const MaxLeaseTTL = 9000000000
 
+// leaseLockShards is the number of striped locks serializing renewals of leases.
+const leaseLockShards = 64
+
+// leaseRecordVersion is the layout version of the persisted lease records.
+// Records of a later version are written by a newer release and not read.
+const leaseRecordVersion = uint32(1)
+
 var (
-	forever = time.Time{}
+	forever = time.Duration(math.MaxInt64)
 
 	leaseBucketName = []byte("lease")
+	// leaseSchemaKey holds the record version all records of a lease bucket
+	// have been migrated to. It sorts after the keys of leases, which are
+	// their positive IDs in big endian.
+	leaseSchemaKey = []byte("\xffschema")
+	// leaseMaxIDKey holds the highest ID of the leases granted from a lease
+	// bucket, which outlives their records.
+	leaseMaxIDKey = []byte("\xffmaxID")
 
 	// maximum number of leases to revoke per second; configurable for tests
 	leaseRevokeRate = 1000
@@ -50,12 +68,155 @@ var (
 	// maximum number of lease checkpoints to batch into a single consensus log entry
 	maxLeaseCheckpointBatchSize = 1000
 
+	// interval of looking for expired leases and due lease checkpoints
+	leaseScanInterval = 500 * time.Millisecond
+
+	// default size of the expired lease channel buffer
+	defaultExpiredLeaseBufferSize = 16
+
+	// default maximum number of expired lease batches queued for a slow consumer
+	defaultMaxPendingExpiredBatches = 64
+
+	// default time after which nacked expired leases are delivered again
+	defaultExpiredRetryBackoff = 3 * time.Second
+
+	// default upper bounds, in seconds, of the lease TTL histogram reported by Stats.
+	// An implicit +Inf bucket follows the last bound.
+	defaultLeaseStatsBuckets = []int64{1, 10, 60, 600}
+
 	ErrNotPrimary       = errors.New("not a primary lessor")
 	ErrLeaseNotFound    = errors.New("lease not found")
 	ErrLeaseExists      = errors.New("lease already exists")
 	ErrLeaseTTLTooLarge = errors.New("too large lease TTL")
+	ErrLeaseTTLTooSmall = errors.New("too small lease TTL")
+
+	ErrLeaseLifetimeExceeded = errors.New("lease exceeded its maximum lifetime")
+
+	ErrLeaseDumpVersion = errors.New("unsupported lease dump version")
+
+	ErrLeaseRenewed = errors.New("lease renewed since expired")
+
+	ErrLeasePermanent = errors.New("lease is permanent")
+
+	ErrLeaseItemInvalid = errors.New("invalid lease item")
+
+	ErrTooManyLeases = errors.New("too many leases")
+
+	ErrLeaseTooManyItems = errors.New("too many items attached to lease")
+
+	ErrNoRangeDeleter = errors.New("no range deleter to revoke leases")
+
+	ErrLeaseRecordVersion = errors.New("unsupported lease record version")
+
+	ErrKeyNotLeased = errors.New("key not attached to a lease")
+
+	ErrInvalidConfig = errors.New("invalid lessor config")
+
+	ErrGrantRateExceeded = errors.New("lease grant rate exceeded")
+
+	ErrLessorStopped = errors.New("lessor has stopped")
+
+	ErrInvalidItemTTL = errors.New("invalid lease item TTL")
 )
 
+// NotPrimaryError is returned by the operations that require a primary
+// lessor. It carries the identity of the current primary, if known.
+// errors.Is(err, ErrNotPrimary) reports true for it.
+type NotPrimaryError struct {
+	// Primary identifies the current primary as registered by SetPrimaryHint
+	// or SetPrimaryLeader. It is empty if unknown.
+	Primary string
+	// Leader is the member ID of the current primary as registered by
+	// SetPrimaryLeader, so that callers can redirect to it. It is zero if
+	// unknown.
+	Leader uint64
+}
+
+func (e *NotPrimaryError) Error() string {
+	if e.Primary == "" {
+		return ErrNotPrimary.Error()
+	}
+	return ErrNotPrimary.Error() + " (primary " + e.Primary + ")"
+}
+
+func (e *NotPrimaryError) Unwrap() error { return ErrNotPrimary }
+
+// TTLTooSmallError is returned by Grant of a lessor with StrictMinTTL set when
+// the requested TTL is below the minimum TTL.
+// errors.Is(err, ErrLeaseTTLTooSmall) reports true for it.
+type TTLTooSmallError struct {
+	// MinTTL is the minimum lease TTL in seconds.
+	MinTTL int64
+}
+
+func (e *TTLTooSmallError) Error() string {
+	return fmt.Sprintf("%v (minimum %ds)", ErrLeaseTTLTooSmall, e.MinTTL)
+}
+
+func (e *TTLTooSmallError) Unwrap() error { return ErrLeaseTTLTooSmall }
+
+// TooManyItemsError is returned when attaching items to a lease would exceed
+// the maximum number of items per lease.
+// errors.Is(err, ErrLeaseTooManyItems) reports true for it.
+type TooManyItemsError struct {
+	ID LeaseID
+	// MaxItems is the maximum number of items per lease.
+	MaxItems int
+}
+
+func (e *TooManyItemsError) Error() string {
+	return fmt.Sprintf("%v (lease %016x, maximum %d)", ErrLeaseTooManyItems, e.ID, e.MaxItems)
+}
+
+func (e *TooManyItemsError) Unwrap() error { return ErrLeaseTooManyItems }
+
+// GrantRateError is returned by Grant when the grant limiter or the grant
+// rate of the lessor denies the grant.
+// errors.Is(err, ErrGrantRateExceeded) reports true for it.
+type GrantRateError struct {
+	// Token is the token of the denied caller.
+	Token string
+}
+
+func (e *GrantRateError) Error() string {
+	return fmt.Sprintf("%v (token %q)", ErrGrantRateExceeded, e.Token)
+}
+
+func (e *GrantRateError) Unwrap() error { return ErrGrantRateExceeded }
+
+// RecordVersionError is returned when reading a lease record, or a lease
+// bucket if ID is NoLease, of a version later than supported, e.g. written by
+// a newer release before a downgrade.
+// errors.Is(err, ErrLeaseRecordVersion) reports true for it.
+type RecordVersionError struct {
+	ID      LeaseID
+	Version uint32
+}
+
+func (e *RecordVersionError) Error() string {
+	if e.ID == NoLease {
+		// the schema version of the lease bucket
+		return fmt.Sprintf("%v %d (supported up to %d)", ErrLeaseRecordVersion, e.Version, leaseRecordVersion)
+	}
+	return fmt.Sprintf("%v %d (lease %016x, supported up to %d)", ErrLeaseRecordVersion, e.Version, e.ID, leaseRecordVersion)
+}
+
+func (e *RecordVersionError) Unwrap() error { return ErrLeaseRecordVersion }
+
+// ConfigError is returned by NewLessorWithConfig for an invalid LessorConfig.
+// errors.Is(err, ErrInvalidConfig) reports true for it.
+type ConfigError struct {
+	// Field is the name of the invalid LessorConfig field.
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrInvalidConfig, e.Field, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error { return ErrInvalidConfig }
+
 // TxnDelete is a TxnWrite that only permits deletes. Defined here
 // to avoid circular dependency with mvcc.
 type TxnDelete interface {
@@ -63,9 +224,17 @@ type TxnDelete interface {
 	End()
 }
 
-// RangeDeleter is a TxnDelete constructor.
+// RangeDeleter is a TxnDelete constructor. The TxnDelete holds the lock of the
+// backend batch tx until End; the lessor may take its own lock within it, but
+// never calls a RangeDeleter while holding that lock.
 type RangeDeleter func() TxnDelete
 
+// RevokeFunc carries out the side effect of revoking a lease in place of
+// deleting its keys, e.g. releasing the entries a lease guards in a lock
+// table. If it fails, the lease is kept so that revoking it can be retried;
+// it may thus be called more than once for the same lease.
+type RevokeFunc func(l *Lease) error
+
 // Checkpointer permits checkpointing of lease remaining TTLs to the consensus log. Defined here to
 // avoid circular dependency with mvcc.
 type Checkpointer func(ctx context.Context, lc *pb.LeaseCheckpointRequest)
@@ -73,29 +242,137 @@ type Checkpointer func(ctx context.Context, lc *pb.LeaseCheckpointRequest)
 type LeaseID int64
 
 // Lessor owns leases. It can grant, revoke, renew and modify leases for lessee.
+//
+// A lessor is either the primary, which tracks expiries and renews leases, or
+// not. By default every lessor grants, revokes, attaches and detaches, since
+// etcd applies these mutations on all members as they are committed through
+// raft; only Renew and RevokeExpired fail with ErrNotPrimary on a lessor that
+// is not the primary. With LessorConfig.RequirePrimary, the mutations fail
+// likewise, so that the primary is the only writer.
 type Lessor interface {
 	// SetRangeDeleter lets the lessor create TxnDeletes to the store.
 	// Lessor deletes the items in the revoked or expired lease by creating
-	// new TxnDeletes.
+	// new TxnDeletes. Until it is set, revoking fails with ErrNoRangeDeleter.
+	// Recover replaces it.
 	SetRangeDeleter(rd RangeDeleter)
 
 	SetCheckpointer(cp Checkpointer)
 
-	// Grant grants a lease that expires at least after TTL seconds.
+	// SetPrimaryHint registers the identity of the current primary, such as
+	// its member ID or URL. It is returned within the NotPrimaryError of the
+	// operations rejected by a non-primary lessor.
+	SetPrimaryHint(primary string)
+
+	// SetPrimaryLeader registers the member ID of the current primary, such
+	// as the raft leader, or zero if unknown. It is returned within the
+	// NotPrimaryError like SetPrimaryHint, which it replaces.
+	SetPrimaryLeader(memberID uint64)
+
+	// Grant grants a lease that expires at least after TTL seconds. A TTL
+	// below the minimum TTL is raised to the minimum, which the TTL of the
+	// returned lease reflects, unless the lessor is configured to reject it.
+	// A TTL above MaxLeaseTTL, about 285 years, fails with
+	// ErrLeaseTTLTooLarge, so that expiries never overflow.
 	Grant(id LeaseID, ttl int64) (*Lease, error)
+
+	// GrantWithOptions grants a lease like Grant with the given options.
+	GrantWithOptions(id LeaseID, ttl int64, opts GrantOptions) (*Lease, error)
+
+	// GrantDuration grants a lease like Grant with a TTL of sub-second
+	// precision, raised to the minimum TTL duration if below it. The TTL in
+	// seconds of the lease is rounded up.
+	GrantDuration(id LeaseID, ttl time.Duration) (*Lease, error)
+
+	// GrantPermanent grants a lease that never expires. It is only removed
+	// by revoking it, and renewing it fails with ErrLeasePermanent.
+	GrantPermanent(id LeaseID) (*Lease, error)
+
 	// Revoke revokes a lease with given ID. The item attached to the
 	// given lease will be removed. If the ID does not exist, an error
 	// will be returned.
 	Revoke(id LeaseID) error
 
+	// RevokeExpired revokes a lease with given ID like Revoke, but only if it
+	// is still expired. If the lease has been renewed since found expired,
+	// ErrLeaseRenewed will be returned. As only the primary tracks expiries,
+	// it fails on other lessors.
+	RevokeExpired(id LeaseID) error
+
+	// RevokeWithDeleted revokes a lease with given ID like Revoke and
+	// returns the sorted keys it deleted, e.g. to emit delete events.
+	RevokeWithDeleted(id LeaseID) ([]string, error)
+
+	// RevokeSync revokes a lease with given ID like Revoke, then commits the
+	// backend, so that the revocation survives a crash once it returns.
+	// Revoke leaves the commit to the batching of the backend instead.
+	RevokeSync(id LeaseID) error
+
+	// RevokeIdempotent revokes a lease with given ID like Revoke, but treats
+	// a lease that does not exist as already revoked and returns nil. It
+	// suits callers that may apply the same revocation more than once.
+	RevokeIdempotent(id LeaseID) error
+
+	// RevokeByPrefix revokes all leases whose ID has the given high byte, such
+	// as the leases issued by the ID generator of one owner. It returns the
+	// number of revoked leases.
+	RevokeByPrefix(prefix uint8) (int, error)
+
+	// RevokeByKey revokes the lease the given key is attached to, e.g. to
+	// force-release a stuck lock, and returns its ID. If the key is not
+	// attached to a lease, NoLease and ErrKeyNotLeased will be returned.
+	RevokeByKey(key []byte) (LeaseID, error)
+
+	// RevokePreview returns the sorted keys that revoking the lease with
+	// given ID would delete, without revoking it. If the ID does not exist,
+	// an error will be returned. Leases retaining their keys delete none.
+	RevokePreview(id LeaseID) ([]string, error)
+
+	// ItemCount returns the number of items attached to the lease with
+	// given ID, without copying them. If the ID does not exist, an error will
+	// be returned.
+	ItemCount(id LeaseID) (int, error)
+
+	// ResumeRevokes finishes the revocations interrupted by a crash, whose
+	// leases are recovered marked revoking. The KV store must have reattached
+	// the keys of the leases before. It returns the number of revocations
+	// finished.
+	ResumeRevokes() int
+
+	// RefreshFromBackend reloads the TTL of the lease with given ID from the
+	// backend, e.g. after an admin tool changed it, and recomputes its
+	// expiry. If the lease is missing from the lessor or the backend, an
+	// error will be returned.
+	RefreshFromBackend(id LeaseID) error
+
+	// MaxLeaseID returns the highest ID of the leases ever granted. It is
+	// persisted, so that a generator of lease IDs, reseeded from the clock
+	// on restart, can keep issuing IDs above it.
+	MaxLeaseID() LeaseID
+
 	// Checkpoint applies the remainingTTL of a lease. The remainingTTL is used in Promote to set
 	// the expiry of leases to less than the full TTL when possible.
 	Checkpoint(id LeaseID, remainingTTL int64) error
 
 	// Attach attaches given leaseItem to the lease with given LeaseID.
-	// If the lease does not exist, an error will be returned.
+	// If the lease does not exist, an error will be returned. If the items
+	// would exceed the maximum items per lease, a TooManyItemsError will be
+	// returned and nothing is attached.
 	Attach(id LeaseID, items []LeaseItem) error
 
+	// AttachWithOptions attaches items to the lease like Attach, with the
+	// given options.
+	AttachWithOptions(id LeaseID, items []LeaseItem, opts AttachOptions) error
+
+	// AttachBatch attaches items to multiple leases at once. If any of the
+	// leases does not exist, an error will be returned and nothing is attached.
+	AttachBatch(items map[LeaseID][]LeaseItem) error
+
+	// Reattach restores the items attached to leases, which are not
+	// persisted by the lessor, after the KV store recovers its keys. Unlike
+	// AttachBatch, it attaches the items of the leases that exist and
+	// returns the IDs of those that do not.
+	Reattach(items map[LeaseID][]LeaseItem) []LeaseID
+
 	// GetLease returns LeaseID for given item.
 	// If no lease found, NoLease value will be returned.
 	GetLease(item LeaseItem) LeaseID
@@ -104,52 +381,311 @@ type Lessor interface {
 	// If the lease does not exist, an error will be returned.
 	Detach(id LeaseID, items []LeaseItem) error
 
+	// DetachKey detaches the given key from the lease it is attached to,
+	// leaving the other keys of the lease alone, and returns the lease ID.
+	// If the key is not attached to a lease, NoLease and ErrKeyNotLeased will
+	// be returned. Like Detach, it only updates the lessor; the store must
+	// drop the lease from the key as well, or recovery attaches it again.
+	DetachKey(key []byte) (LeaseID, error)
+
+	// DetachAll detaches all items from the lease with given ID, keeping the
+	// lease, and returns the number of detached items. Revoking the lease
+	// afterwards deletes no keys. If the given lease does not exist, an
+	// error will be returned. Like Detach, it only updates the lessor.
+	DetachAll(id LeaseID) (int, error)
+
+	// DetachBatch detaches items from multiple leases at once. If any of the
+	// leases does not exist, an error will be returned and nothing is detached.
+	DetachBatch(items map[LeaseID][]LeaseItem) error
+
+	// TransferItems moves items from the lease with ID from to the lease with
+	// ID to at once. If either lease does not exist, or any item is not
+	// attached to the lease with ID from, an error will be returned and the
+	// items stay where they are.
+	TransferItems(from, to LeaseID, items []LeaseItem) error
+
+	// Transfer moves all items of the lease with ID from to the lease with
+	// ID to at once, e.g. to rotate a session without a window where the
+	// items have no lease or two. If either lease does not exist, an error
+	// will be returned. Transferring to the same lease does nothing.
+	Transfer(from, to LeaseID) error
+
 	// Promote promotes the lessor to be the primary lessor. Primary lessor manages
 	// the expiration and renew of leases.
 	// Newly promoted lessor renew the TTL of all lease to extend + previous TTL.
-	Promote(extend time.Duration)
-
-	// Demote demotes the lessor from being the primary lessor.
-	Demote()
+	Promote(extend time.Duration) error
+
+	// PromoteWithHandoff promotes the lessor like Promote, but leases found in
+	// state expire after their handed off remaining time plus extend instead of
+	// their full TTL. Leases missing from state fall back to the full TTL.
+	PromoteWithHandoff(extend time.Duration, state []LeaseHandoff) error
+
+	// HandoffState snapshots the remaining time of each lease for a planned
+	// primary transfer. It returns nil if the lessor is not the primary.
+	HandoffState() []LeaseHandoff
+
+	// Demote demotes the lessor from being the primary lessor. Expired lease
+	// batches not yet received from ExpiredLeaseBatchC are discarded.
+	Demote() error
+
+	// OnPrimaryChange registers f to be called with true after each Promote
+	// and with false after a Demote of the primary lessor. Callbacks run in
+	// registration order, outside the lessor locks, so they may call back
+	// into the lessor. Notifications are delivered in order, possibly on the
+	// goroutine of another Promote or Demote.
+	OnPrimaryChange(f func(primary bool))
+
+	// Freeze stops the lessor from reporting expired leases, for instance
+	// during backend maintenance, without touching lease expiries. Unlike
+	// Demote, the lessor stays primary and renewals keep working. Leases
+	// expiring while frozen are reported after Unfreeze, so long freezes
+	// break the expectations of clients relying on timely expiration.
+	Freeze()
+
+	// Unfreeze resumes the reporting of expired leases stopped by Freeze.
+	Unfreeze()
+
+	// Hold stops the lease with given ID from expiring until Release, e.g.
+	// while a migration holds its resources. Renewing a held lease leaves it
+	// held. The hold is local to the lessor and does not survive restarts.
+	Hold(id LeaseID) error
+
+	// Release lets a lease stopped by Hold expire again after its full TTL.
+	Release(id LeaseID) error
+
+	// LoopHealthy returns true if the lessor has recently looked for expired
+	// leases. It turns false once the lessor is stopped or its loop is stuck.
+	LoopHealthy() bool
+
+	// ScanExpired looks for expired leases and due checkpoints once. It is
+	// called by the ExpiryScheduler of the lessor.
+	ScanExpired()
+
+	// Health reports the state of the expiration machinery of the lessor.
+	Health() LessorHealth
+
+	// ExpiryDropCount returns the number of expired lease batches dropped
+	// because the expired lease channels were full. Only the notifications
+	// of a lessor with AutoRevoke set are dropped; other batches are queued.
+	ExpiryDropCount() uint64
+
+	// LastScanDuration returns how long the last scan for expired leases and
+	// due checkpoints took, to spot scans growing with the number of leases.
+	LastScanDuration() time.Duration
+
+	// Snapshot captures the state of the lessor and its leases at once, e.g.
+	// for a debugging endpoint.
+	Snapshot() LessorSnapshot
+
+	// Generation returns the generation of the current primary term, or 0 if
+	// the lessor is not the primary. It increases on every Promote, so a consumer
+	// of ExpiredLeaseBatchC can compare it with the generation of a batch to
+	// discard batches produced under an earlier primary term.
+	Generation() uint64
+
+	// IsPrimary returns true if the lessor is the primary lessor.
+	IsPrimary() bool
+
+	// PrimaryGeneration returns the generation of the latest primary term.
+	// Unlike Generation, it is kept after Demote, so callers reading it
+	// around IsPrimary can tell whether the lessor was demoted and promoted
+	// again in between.
+	PrimaryGeneration() uint64
 
 	// Renew renews a lease with given ID. It returns the renewed TTL. If the ID does not exist,
-	// an error will be returned.
+	// an error will be returned, or a TTL of zero if the lessor tolerates renewals of missing
+	// leases. The renewed expiry is measured on the monotonic clock, so
+	// steps of the wall clock do not change it.
 	Renew(id LeaseID) (int64, error)
 
+	// RenewIfBelow renews a lease like Renew, but only if the time remaining
+	// until its expiry is below threshold. It reports whether the lease was
+	// renewed and returns the renewed TTL, or the remaining TTL otherwise.
+	RenewIfBelow(id LeaseID, threshold time.Duration) (renewed bool, ttl int64, err error)
+
+	// RenewBatch renews the leases with given IDs like Renew, taking the
+	// lessor lock once for all of them. It returns the TTL and the error of
+	// each renewal in the order of ids.
+	RenewBatch(ids []LeaseID) ([]int64, []error)
+
 	// Lookup gives the lease at a given lease id, if any
 	Lookup(id LeaseID) *Lease
 
+	// LeaseInfo describes the lease with given ID for inspection, including
+	// at most keyLimit of its attached keys. If the ID does not exist, an
+	// error will be returned.
+	LeaseInfo(id LeaseID, keyLimit int) (LeaseInfo, error)
+
+	// ExpiryTime returns the local wall clock time the lease with given ID
+	// expires at on this member. It is the zero time if the lease has no
+	// deadline, which is the case when the lessor is not the primary. If the
+	// ID does not exist, an error will be returned.
+	ExpiryTime(id LeaseID) (time.Time, error)
+
 	// Leases lists all leases.
 	Leases() []*Lease
 
+	// ForEachLease calls fn with a read-only copy of each lease, in no
+	// particular order, until fn returns false. Unlike Leases, it does not
+	// hold all leases in memory at once. The lessor is read-locked for the
+	// whole iteration, so fn must be fast and must not modify the lessor.
+	ForEachLease(fn func(*Lease) bool)
+
+	// TopLeasesByItems lists the n leases with the most attached items,
+	// largest first.
+	TopLeasesByItems(n int) []*Lease
+
+	// ExpiringWithin lists copies of the leases expiring within d, including
+	// the already expired ones, sorted by expiry. Leases without deadline are
+	// never included.
+	ExpiringWithin(d time.Duration) []*Lease
+
+	// StaleLeases lists the IDs of the leases not renewed within olderThan,
+	// sorted. Promotion counts as a renewal of all leases. It returns nil if
+	// the lessor is not the primary.
+	StaleLeases(olderThan time.Duration) []LeaseID
+
+	// Stats returns aggregate statistics of all outstanding leases, such as
+	// their TTL distribution.
+	Stats() LeaseStats
+
+	// CountByTTLRange returns the number of leases whose TTL, in seconds,
+	// is within [minTTL, maxTTL], e.g. to cap the number of short leases,
+	// which drive the renewal load. Permanent leases have no TTL and are
+	// not counted.
+	CountByTTLRange(minTTL, maxTTL int64) int
+
 	// ExpiredLeasesC returns a chan that is used to receive expired leases.
+	// It drops the generation of the batches; prefer ExpiredLeaseBatchC.
+	// Only one of ExpiredLeasesC and ExpiredLeaseBatchC should be consumed.
+	// The chan is closed once the lessor is stopped.
 	ExpiredLeasesC() <-chan []*Lease
 
-	// Recover recovers the lessor state from the given backend and RangeDeleter.
-	Recover(b backend.Backend, rd RangeDeleter)
+	// ExpiredLeaseBatchC returns a chan that is used to receive batches of
+	// expired leases along with the generation they were found under. The
+	// chan is closed once the lessor is stopped.
+	ExpiredLeaseBatchC() <-chan ExpiredLeaseBatch
+
+	// ExpiredAck acknowledges expired leases received from
+	// ExpiredLeaseBatchC or ExpiredLeasesC. The lessor stops tracking the
+	// expiry of leases once delivered; the consumer owns them from then on,
+	// even if it never revokes them, and acking them with ok only confirms
+	// that. Leases nacked without ok, e.g. as proposing their revocation
+	// failed, are delivered again after the retry backoff if still expired
+	// then, ordered by expiry along with leases expiring meanwhile. Nacks of
+	// a lessor no longer the primary are ignored.
+	ExpiredAck(ids []LeaseID, ok bool)
+
+	// WaitExpired blocks until the primary lessor finds the lease with given
+	// ID expired, or ctx is done. It does not consume the expired lease
+	// channels. If the ID does not exist or the lease is revoked before
+	// expiring, ErrLeaseNotFound will be returned. It is meant for tests.
+	WaitExpired(ctx context.Context, id LeaseID) error
+
+	// Compact removes the records of leases no longer held by the lessor from
+	// the lease bucket and defragments the backend to reclaim their space.
+	// Defragmentation rewrites the whole backend database, so its I/O cost
+	// grows with the database size rather than with the lease bucket size.
+	Compact() error
+
+	// Reset revokes all leases without deleting their attached items and
+	// clears the lease bucket, including the highest granted lease ID. It is
+	// destructive: the leases are lost for good, and lease IDs may be reused
+	// from then on.
+	Reset() error
+
+	// WriteTo writes a dump of the leases, including their checkpoints and
+	// attached items, taken from a consistent view of the lessor.
+	WriteTo(w io.Writer) (int64, error)
+
+	// ReadFrom restores the leases of a dump written by WriteTo and persists
+	// them. If any of the leases already exists, an error will be returned
+	// and nothing is restored.
+	ReadFrom(r io.Reader) (int64, error)
 
-	// Stop stops the lessor for managing leases. The behavior of calling Stop multiple
-	// times is undefined.
+	// Recover recovers the lessor state from the given backend and RangeDeleter.
+	// It is safe to call while the lessor is running. A primary lessor is
+	// demoted first, so expired leases found before the recovery are
+	// discarded; the caller must Promote it again if needed. If the leases
+	// cannot be recovered, e.g. for a RecordVersionError, the error is
+	// returned and the lessor must not be used further.
+	Recover(b backend.Backend, rd RangeDeleter) error
+
+	// Stop stops the lessor for managing leases. It returns once the lessor
+	// has stopped issuing backend operations in the background, so the
+	// backend can be closed right after. Calling Stop multiple times is safe.
+	// Once Stop returns, the lessor holds no leases, and the operations that
+	// change leases or the primary state return ErrLessorStopped.
 	Stop()
 }
 
 // lessor implements Lessor interface.
 // TODO: use clockwork for testability.
 type lessor struct {
+	// lastScan is the time on clock runLoop last finished looking for
+	// expired leases at, and lastScanDuration how long it took.
+	// pendingExpiredCount is len(pendingExpired) for Health.
+	// expiryDropCount counts the expired lease batches dropped by
+	// notifyExpired. maxSeenNow is the latest wall clock reading in Unix
+	// nanoseconds, if wallClockFloor is set. They are accessed atomically
+	// and kept first for 64-bit alignment.
+	lastScan            int64
+	lastScanDuration    int64
+	pendingExpiredCount int64
+	expiryDropCount     uint64
+	maxSeenNow          int64
+
+	// mu protects the lease maps and the primary state. Renew only read-locks mu
+	// so that renewals of different leases proceed in parallel.
+	//
+	// Lock order: the lock of the backend batch tx is taken before mu, as the
+	// store calls into the lessor within its transactions. The lessor thus
+	// never waits for the batch tx while holding mu; see lockTx.
 	mu sync.RWMutex
+	// heapMu protects leaseHeap and wheel when mu is only read-locked.
+	heapMu sync.Mutex
+	// leaseLocks serializes renewals of the same lease, keyed by the lease ID.
+	leaseLocks [leaseLockShards]sync.Mutex
 
 	// demotec is set when the lessor is the primary.
 	// demotec will be closed if the lessor is demoted.
 	demotec chan struct{}
+	// generation is incremented on every promotion.
+	generation uint64
+	// primaryHint identifies the current primary when this lessor is not.
+	primaryHint string
+	// primaryLeader is the member ID of the current primary, if known.
+	primaryLeader uint64
+	// frozen is set if expired leases must not be reported.
+	frozen bool
 
 	leaseMap            map[LeaseID]*Lease
 	leaseHeap           LeaseQueue
 	leaseCheckpointHeap LeaseQueue
 	itemMap             map[LeaseItem]LeaseID
+	// itemExpiries schedules the items attached with a TTL, which are
+	// indexed by item in itemExpiryMap.
+	itemExpiries  itemExpiryQueue
+	itemExpiryMap map[LeaseItem]*itemExpiry
+	// wheel schedules expiries in place of leaseHeap if set.
+	wheel *expiryWheel
+
+	// revoking holds the recovered leases whose revocation was interrupted,
+	// until ResumeRevokes finishes it.
+	revoking map[LeaseID]*Lease
+
+	// maxID is the highest ID of the leases ever granted, including the
+	// recovered and revoked ones.
+	maxID LeaseID
 
 	// When a lease expires, the lessor will delete the
 	// leased range (or key) by the RangeDeleter.
 	rd RangeDeleter
+	// revokeFunc replaces deleting the keys of revoked leases, if set.
+	revokeFunc RevokeFunc
+	// grantLimiter limits grants by the token of their caller and by the
+	// grant rate, if set.
+	grantLimiter GrantLimiter
 
 	// When a lease's deadline should be persisted to preserve the remaining TTL across leader
 	// elections and restarts, the lessor will checkpoint the lease by the Checkpointer.
@@ -160,54 +696,452 @@ type lessor struct {
 	b backend.Backend
 
 	// minLeaseTTL is the minimum lease TTL that can be granted for a lease. Any
-	// requests for shorter TTLs are extended to the minimum TTL.
-	minLeaseTTL int64
-
-	expiredC chan []*Lease
+	// requests for shorter TTLs are extended to the minimum TTL, or rejected
+	// if strictMinTTL is set.
+	minLeaseTTL  int64
+	strictMinTTL bool
+	// minLeaseTTLDuration is the minimum TTL of leases granted by GrantDuration.
+	minLeaseTTLDuration time.Duration
+
+	// tolerateMissingRenew is set if Renew of a missing lease is not an error.
+	tolerateMissingRenew bool
+	// requirePrimary is set if only the primary may grant, revoke, attach
+	// and detach.
+	requirePrimary bool
+
+	// maxLeases bounds the number of leases, if set.
+	maxLeases int
+	// maxItemsPerLease bounds the number of items attached to a lease, if set.
+	maxItemsPerLease int
+	// revokeChunkSize is the number of keys deleted per transaction when
+	// revoking a lease, if set.
+	revokeChunkSize int
+
+	expiredC chan ExpiredLeaseBatch
+	// compatExpiredC relays the leases of expiredC for ExpiredLeasesC.
+	compatExpiredC    chan []*Lease
+	compatExpiredOnce sync.Once
 	// stopC is a channel whose closure indicates that the lessor should be stopped.
-	stopC chan struct{}
+	stopC    chan struct{}
+	stopOnce sync.Once
 	// doneC is a channel whose closure indicates that the lessor is stopped.
 	doneC chan struct{}
+	// closed is set under mu once Stop has completed.
+	closed bool
 
 	lg *zap.Logger
 
 	// Wait duration between lease checkpoints.
 	checkpointInterval time.Duration
+
+	// statsBuckets are the upper bounds, in seconds, of the TTL histogram buckets.
+	statsBuckets []int64
+	// statsExpiryWindow is how far ahead Stats counts expiring leases.
+	statsExpiryWindow time.Duration
+
+	// bucketName is the backend bucket the lessor persists its leases to.
+	bucketName []byte
+
+	// autoRevoke is set if the lessor revokes expired leases by itself.
+	// expiredC then only notifies about the revoked leases.
+	autoRevoke bool
+
+	// maxLifetime bounds the lifetime of leases since their grant, if set.
+	maxLifetime time.Duration
+	// wallClockFloor ignores wall clock readings earlier than maxSeenNow.
+	wallClockFloor bool
+
+	// expiryGrace is how long a lease must have been expired to be reported.
+	expiryGrace time.Duration
+
+	// renewCoalesceWindow is how long after a renewal further renewals of
+	// the lease are not refreshing its expiry.
+	renewCoalesceWindow time.Duration
+	// expiryGranularity is the grid lease expiries are rounded up to, if set.
+	expiryGranularity time.Duration
+
+	// clock tracks lease expiries on its monotonic reading.
+	clock clock
+
+	// scheduler calls ScanExpired, which scanMu serializes.
+	scheduler ExpiryScheduler
+	scanMu    sync.Mutex
+	// expiredBuf is reused by the scans of ScanExpired to collect expired
+	// leases in.
+	expiredBuf []*Lease
+
+	// pendingExpired queues the expired lease batches that did not fit
+	// into expiredC. It is only accessed by ScanExpired and Demote.
+	pendingExpired           []ExpiredLeaseBatch
+	maxPendingExpiredBatches int
+
+	// expiredBatchSize caps expired lease batches, if set.
+	expiredBatchSize int
+	// expiryEpsilon is how far apart the expiries of leases in the same
+	// expired lease batch may lie, if set.
+	expiryEpsilon time.Duration
+	// expiredRetryBackoff is the time after which nacked expired leases are
+	// delivered again.
+	expiredRetryBackoff time.Duration
+
+	// expiryWaiters are closed when their lease is found expired.
+	waitMu        sync.Mutex
+	expiryWaiters map[LeaseID][]chan struct{}
+
+	// primaryCbs are notified of the primary changes queued in
+	// primaryEvents; notifying is set while one goroutine delivers them.
+	cbMu          sync.Mutex
+	primaryCbs    []func(primary bool)
+	primaryEvents []bool
+	notifying     bool
 }
 
 type LessorConfig struct {
 	MinLeaseTTL        int64
 	CheckpointInterval time.Duration
+	// StatsBuckets are the ascending upper bounds, in seconds, of the TTL
+	// histogram reported by Stats. Defaults to 1s, 10s, 60s and 600s.
+	StatsBuckets []int64
+	// StatsExpiryWindow is how far ahead Stats counts expiring leases.
+	// Defaults to a minute.
+	StatsExpiryWindow time.Duration
+	// BucketName is the backend bucket leases are persisted to. Lessors sharing
+	// a backend must use distinct buckets. Defaults to "lease".
+	BucketName string
+	// AutoRevoke makes the primary lessor revoke expired leases by itself
+	// instead of leaving it to the consumer of the expired lease channels,
+	// which then only receive the leases already revoked. It suits users
+	// without a consensus layer to propose revocations through.
+	AutoRevoke bool
+	// MaxLifetime bounds how long a lease lives after being granted,
+	// regardless of renewals. Zero means no bound. Grant times are not
+	// persisted, so the lifetime of recovered leases counts from recovery.
+	MaxLifetime time.Duration
+	// WallClockFloor makes the lessor never read the wall clock earlier than
+	// the latest reading seen. Lease expiries run on the monotonic clock, but
+	// grant times are wall clock readings, which lease dumps carry across
+	// restarts, so leases granted while the wall clock is stepped back lose
+	// the size of the step from their maximum lifetime once it is corrected. With the floor, they may live up to the size of
+	// the step longer instead.
+	WallClockFloor bool
+	// MaxPendingExpiredBatches bounds the number of expired lease batches
+	// queued while the consumer of the expired lease channels is slow. Once
+	// the bound is hit, the lessor stops looking for expired leases until the
+	// queue drains; expired leases are delayed but never dropped. Defaults to 64.
+	MaxPendingExpiredBatches int
+	// ExpiredRetryBackoff is the time after which expired leases nacked
+	// through ExpiredAck are delivered again. Defaults to 3s.
+	ExpiredRetryBackoff time.Duration
+	// ExpiredLeasesBufferSize is the number of expired lease batches the
+	// expired lease channels buffer. Defaults to 16.
+	ExpiredLeasesBufferSize int
+	// RenewCoalesceWindow makes Renew of a lease renewed less than the window
+	// ago succeed without refreshing its expiry. It protects the lessor from
+	// excessive keep-alive rates at the cost of leases expiring up to the
+	// window earlier than a TTL after their last renewal.
+	RenewCoalesceWindow time.Duration
+	// ExpiryGrace delays reporting leases as expired until they have been
+	// expired for the grace, and lets them be renewed meanwhile. It makes up
+	// for the latency of committing a revocation, during which a renewal
+	// would otherwise be rejected for a lease already being revoked.
+	ExpiryGrace time.Duration
+	// MinLeaseTTLDuration is the minimum TTL of leases granted by
+	// GrantDuration. Defaults to MinLeaseTTL.
+	MinLeaseTTLDuration time.Duration
+	// StrictMinTTL makes Grant reject TTLs below MinLeaseTTL with a
+	// TTLTooSmallError instead of raising them to the minimum.
+	StrictMinTTL bool
+	// TolerateMissingRenew makes Renew of a lease that does not exist log
+	// and return a TTL of zero instead of an error, for replaying logs that
+	// may renew a lease before granting it. Renew is strict by default.
+	TolerateMissingRenew bool
+	// MaxLeases bounds the number of leases. Once reached, granting fails
+	// with ErrTooManyLeases until leases are revoked. Zero means no bound.
+	MaxLeases int
+	// MaxItemsPerLease bounds the number of items attached to a lease.
+	// Attaching beyond it fails with a TooManyItemsError. Zero means no
+	// bound.
+	MaxItemsPerLease int
+	// RevokeChunkSize splits the deletion of the keys of a revoked lease into
+	// transactions of at most that many keys, so that revoking a huge lease
+	// does not hold the backend for long. The lease is removed with the last
+	// chunk, so an interrupted revocation is resumed by revoking again. Zero
+	// deletes all keys in one transaction.
+	RevokeChunkSize int
+	// ExpiredBatchSize caps the number of leases per expired lease batch,
+	// so that many leases expiring at once reach the consumer in several
+	// batches. Zero means no cap.
+	ExpiredBatchSize int
+	// ExpiryEpsilon groups expired leases into batches by expiry: a batch
+	// only holds leases expiring within the epsilon after its first lease.
+	// Combined with ExpiredBatchSize, leases expiring together are sent in
+	// batches of their own instead of mixed with unrelated ones. Zero does
+	// not group.
+	ExpiryEpsilon time.Duration
+	// RequirePrimary makes Grant, Revoke, Attach, Detach and their variants
+	// fail with a NotPrimaryError on a lessor that is not the primary.
+	//
+	// By default, only Renew and the expiry of leases are up to the primary,
+	// while every lessor applies the other mutations, as etcd members do
+	// with the requests committed through raft. With RequirePrimary, the
+	// primary is the only lessor mutating leases, which suits users without
+	// a consensus layer replicating the mutations.
+	RequirePrimary bool
+	// RevokeFunc, if set, is called to revoke a lease instead of deleting
+	// the keys attached to it through the range deleter, which is then not
+	// needed. The lease is only removed once it succeeds; otherwise revoking
+	// fails with its error. Revoking returns no deleted keys.
+	RevokeFunc RevokeFunc
+	// GrantLimiter decides whether grants proceed by the token of their
+	// caller, see GrantOptions. Denied grants fail with a GrantRateError
+	// before touching the leases or the backend. As every member applies
+	// grants, the limiter must decide alike on all members, or limit
+	// grants before they are proposed instead. Nil does not limit.
+	GrantLimiter GrantLimiter
+	// GrantRate limits grants of the lessor to the rate per second, in
+	// bursts of up to GrantBurst grants, which defaults to 1. Grants beyond
+	// it fail with a GrantRateError. The same as for GrantLimiter applies.
+	// Zero does not limit.
+	GrantRate  float64
+	GrantBurst int
+	// ExpiryGranularity rounds lease expiries up to a multiple of the
+	// granularity on the monotonic clock of the lessor, so that leases share
+	// expiry times. Leases then live up to the granularity longer than
+	// their TTL, which clients observe as a time to live above the TTL;
+	// they never expire earlier. Zero does not round.
+	ExpiryGranularity time.Duration
+	// ExpiryWheel schedules expiries in slots of ExpiryGranularity instead of
+	// one heap item per lease, so that granting and renewing leases take
+	// constant time however many leases there are. It requires
+	// ExpiryGranularity.
+	ExpiryWheel bool
+	// ExpiryScheduler decides when the lessor looks for expired leases and
+	// due checkpoints. Defaults to polling every 500ms. LoopHealthy expects
+	// scans at least that often.
+	ExpiryScheduler ExpiryScheduler
+
+	// clock is the time source of the lessor; replaced by tests.
+	clock clock
+}
+
+// Validate returns a ConfigError for the first field of cfg NewLessor would
+// misuse: negative durations and sizes, minimum TTLs above MaxLeaseTTL or
+// the maximum lifetime, and stats buckets not ascending.
+func (cfg LessorConfig) Validate() error {
+	durations := []struct {
+		field string
+		d     time.Duration
+	}{
+		{"CheckpointInterval", cfg.CheckpointInterval},
+		{"StatsExpiryWindow", cfg.StatsExpiryWindow},
+		{"MaxLifetime", cfg.MaxLifetime},
+		{"RenewCoalesceWindow", cfg.RenewCoalesceWindow},
+		{"ExpiryGrace", cfg.ExpiryGrace},
+		{"MinLeaseTTLDuration", cfg.MinLeaseTTLDuration},
+		{"ExpiryEpsilon", cfg.ExpiryEpsilon},
+		{"ExpiryGranularity", cfg.ExpiryGranularity},
+		{"ExpiredRetryBackoff", cfg.ExpiredRetryBackoff},
+	}
+	for _, f := range durations {
+		if f.d < 0 {
+			return &ConfigError{Field: f.field, Reason: "is negative"}
+		}
+	}
+	sizes := []struct {
+		field string
+		n     int64
+	}{
+		{"MinLeaseTTL", cfg.MinLeaseTTL},
+		{"MaxPendingExpiredBatches", int64(cfg.MaxPendingExpiredBatches)},
+		{"ExpiredLeasesBufferSize", int64(cfg.ExpiredLeasesBufferSize)},
+		{"MaxLeases", int64(cfg.MaxLeases)},
+		{"MaxItemsPerLease", int64(cfg.MaxItemsPerLease)},
+		{"RevokeChunkSize", int64(cfg.RevokeChunkSize)},
+		{"ExpiredBatchSize", int64(cfg.ExpiredBatchSize)},
+		{"GrantBurst", int64(cfg.GrantBurst)},
+	}
+	for _, f := range sizes {
+		if f.n < 0 {
+			return &ConfigError{Field: f.field, Reason: "is negative"}
+		}
+	}
+
+	if cfg.MinLeaseTTL > MaxLeaseTTL {
+		return &ConfigError{Field: "MinLeaseTTL", Reason: "exceeds MaxLeaseTTL"}
+	}
+	minTTL := secondsToDuration(cfg.MinLeaseTTL)
+	if cfg.MinLeaseTTLDuration > 0 {
+		if cfg.MinLeaseTTLDuration > MaxLeaseTTL*time.Second {
+			return &ConfigError{Field: "MinLeaseTTLDuration", Reason: "exceeds MaxLeaseTTL"}
+		}
+		minTTL = cfg.MinLeaseTTLDuration
+	}
+	if cfg.MaxLifetime > 0 && cfg.MaxLifetime < minTTL {
+		return &ConfigError{Field: "MaxLifetime", Reason: "is below the minimum TTL"}
+	}
+	if cfg.GrantRate < 0 {
+		return &ConfigError{Field: "GrantRate", Reason: "is negative"}
+	}
+	if cfg.ExpiryWheel && cfg.ExpiryGranularity == 0 {
+		return &ConfigError{Field: "ExpiryWheel", Reason: "requires ExpiryGranularity"}
+	}
+	for i, b := range cfg.StatsBuckets {
+		if b <= 0 || (i > 0 && b <= cfg.StatsBuckets[i-1]) {
+			return &ConfigError{Field: "StatsBuckets", Reason: "are not positive and ascending"}
+		}
+	}
+	return nil
 }
 
+// NewLessor creates a lessor recovering its leases from b. As the store the
+// leased items live in itself attaches keys to the lessor, a lessor is
+// initialized in two phases: it is created first, then the store is created
+// with it and sets the range deleter through SetRangeDeleter, before any
+// lease is revoked. Invalid values of cfg fall back to the defaults or are
+// used as is; NewLessorWithConfig rejects them instead. It panics if the
+// leases cannot be recovered.
 func NewLessor(lg *zap.Logger, b backend.Backend, cfg LessorConfig) Lessor {
 	return newLessor(lg, b, cfg)
 }
 
+// NewLessorWithConfig creates a lessor like NewLessor, but returns the error
+// of cfg.Validate instead if cfg is invalid, and the error of recovering the
+// leases, e.g. a RecordVersionError, instead of panicking.
+func NewLessorWithConfig(lg *zap.Logger, b backend.Backend, cfg LessorConfig) (Lessor, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	le, err := recoverLessor(lg, b, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return le, nil
+}
+
 func newLessor(lg *zap.Logger, b backend.Backend, cfg LessorConfig) *lessor {
+	le, err := recoverLessor(lg, b, cfg)
+	if err != nil {
+		// refuse to start rather than lose leases
+		if lg != nil {
+			lg.Panic("failed to recover leases", zap.Error(err))
+		}
+		panic("failed to recover leases: " + err.Error())
+	}
+	return le
+}
+
+// recoverLessor creates a lessor recovering its leases from b, and starts it
+// once they are recovered.
+func recoverLessor(lg *zap.Logger, b backend.Backend, cfg LessorConfig) (*lessor, error) {
 	checkpointInterval := cfg.CheckpointInterval
 	if checkpointInterval == 0 {
 		checkpointInterval = 5 * time.Minute
 	}
+	statsBuckets := cfg.StatsBuckets
+	if len(statsBuckets) == 0 {
+		statsBuckets = defaultLeaseStatsBuckets
+	}
+	statsExpiryWindow := cfg.StatsExpiryWindow
+	if statsExpiryWindow <= 0 {
+		statsExpiryWindow = time.Minute
+	}
+	expiredLeaseBufferSize := cfg.ExpiredLeasesBufferSize
+	if expiredLeaseBufferSize <= 0 {
+		expiredLeaseBufferSize = defaultExpiredLeaseBufferSize
+	}
+	maxPendingExpiredBatches := cfg.MaxPendingExpiredBatches
+	if maxPendingExpiredBatches <= 0 {
+		maxPendingExpiredBatches = defaultMaxPendingExpiredBatches
+	}
+	expiredRetryBackoff := cfg.ExpiredRetryBackoff
+	if expiredRetryBackoff <= 0 {
+		expiredRetryBackoff = defaultExpiredRetryBackoff
+	}
+	bucketName := leaseBucketName
+	if cfg.BucketName != "" {
+		bucketName = []byte(cfg.BucketName)
+	}
+	minLeaseTTLDuration := cfg.MinLeaseTTLDuration
+	if minLeaseTTLDuration <= 0 {
+		minLeaseTTLDuration = secondsToDuration(cfg.MinLeaseTTL)
+	}
+	var scheduler ExpiryScheduler = pollingScheduler{interval: leaseScanInterval}
+	if cfg.ExpiryScheduler != nil {
+		scheduler = cfg.ExpiryScheduler
+	}
+	var clk clock = newSystemClock()
+	if cfg.clock != nil {
+		clk = cfg.clock
+	}
 	l := &lessor{
 		leaseMap:            make(map[LeaseID]*Lease),
+		revoking:            make(map[LeaseID]*Lease),
 		itemMap:             make(map[LeaseItem]LeaseID),
+		itemExpiryMap:       make(map[LeaseItem]*itemExpiry),
 		leaseHeap:           make(LeaseQueue, 0),
 		leaseCheckpointHeap: make(LeaseQueue, 0),
+		expiryWaiters:       make(map[LeaseID][]chan struct{}),
 		b:                   b,
 		minLeaseTTL:         cfg.MinLeaseTTL,
+		strictMinTTL:        cfg.StrictMinTTL,
+		minLeaseTTLDuration: minLeaseTTLDuration,
 		checkpointInterval:  checkpointInterval,
+		statsBuckets:        statsBuckets,
+		statsExpiryWindow:   statsExpiryWindow,
+		bucketName:          bucketName,
+		autoRevoke:          cfg.AutoRevoke,
+		maxLifetime:         cfg.MaxLifetime,
+		wallClockFloor:      cfg.WallClockFloor,
+		expiryGrace:         cfg.ExpiryGrace,
+		renewCoalesceWindow: cfg.RenewCoalesceWindow,
+		expiryGranularity:   cfg.ExpiryGranularity,
+		scheduler:           scheduler,
+		clock:               clk,
+
+		tolerateMissingRenew:     cfg.TolerateMissingRenew,
+		requirePrimary:           cfg.RequirePrimary,
+		revokeFunc:               cfg.RevokeFunc,
+		grantLimiter:             cfg.GrantLimiter,
+		maxLeases:                cfg.MaxLeases,
+		maxItemsPerLease:         cfg.MaxItemsPerLease,
+		revokeChunkSize:          cfg.RevokeChunkSize,
+		maxPendingExpiredBatches: maxPendingExpiredBatches,
+		expiredBatchSize:         cfg.ExpiredBatchSize,
+		expiryEpsilon:            cfg.ExpiryEpsilon,
+		expiredRetryBackoff:      expiredRetryBackoff,
 		// expiredC is a small buffered chan to avoid unnecessary blocking.
-		expiredC: make(chan []*Lease, 16),
+		expiredC: make(chan ExpiredLeaseBatch, expiredLeaseBufferSize),
 		stopC:    make(chan struct{}),
 		doneC:    make(chan struct{}),
 		lg:       lg,
 	}
-	l.initAndRecover()
+	if cfg.ExpiryWheel && cfg.ExpiryGranularity > 0 {
+		l.wheel = newExpiryWheel(cfg.ExpiryGranularity)
+	}
+	if cfg.GrantRate > 0 {
+		burst := cfg.GrantBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		rate := sharedLimiter{newTokenBucketLimiter(cfg.GrantRate, burst, clk)}
+		if l.grantLimiter == nil {
+			l.grantLimiter = rate
+		} else {
+			l.grantLimiter = allLimiters{l.grantLimiter, rate}
+		}
+	}
+	tx := b.BatchTx()
+	tx.Lock()
+	err := l.unsafeRecover(tx)
+	tx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	b.ForceCommit()
 
 	go l.runLoop()
 
-	return l
+	return l, nil
 }
 
 // isPrimary indicates if this lessor is the primary lessor. The primary
@@ -241,45 +1175,161 @@ func (le *lessor) SetCheckpointer(cp Checkpointer) {
 	le.cp = cp
 }
 
-func (le *lessor) Grant(id LeaseID, ttl int64) (*Lease, error) {
-	if id == NoLease {
-		return nil, ErrLeaseNotFound
+func (le *lessor) SetPrimaryHint(primary string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	le.primaryHint = primary
+	le.primaryLeader = 0
+}
+
+func (le *lessor) SetPrimaryLeader(memberID uint64) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	le.primaryLeader = memberID
+	le.primaryHint = ""
+	if memberID != 0 {
+		// formatted like the member IDs of etcd
+		le.primaryHint = strconv.FormatUint(memberID, 16)
+	}
+}
+
+// notPrimaryError returns the error for operations rejected by a non-primary
+// lessor. The caller must hold mu.
+func (le *lessor) notPrimaryError() error {
+	return &NotPrimaryError{Primary: le.primaryHint, Leader: le.primaryLeader}
+}
+
+// unsafeCheckPrimary returns ErrLessorStopped once the lessor is stopped, or a
+// NotPrimaryError if the lessor only mutates leases as the primary and is
+// not. The caller must hold mu.
+func (le *lessor) unsafeCheckPrimary() error {
+	if le.closed {
+		return ErrLessorStopped
 	}
+	if le.requirePrimary && !le.isPrimary() {
+		return le.notPrimaryError()
+	}
+	return nil
+}
+
+// GrantOptions are the options of a lease set at grant time.
+type GrantOptions struct {
+	// RetainKeys makes revocation and expiration of the lease keep the keys
+	// attached to it, which are only detached. The lease then serves as a
+	// liveness signal whose expiration is still reported.
+	RetainKeys bool
+	// Items are attached to the lease as it is granted. The lease is not
+	// granted if any of them is invalid.
+	Items []LeaseItem
+	// Token identifies the caller to the grant limiter of the lessor.
+	Token string
+}
+
+func (le *lessor) Grant(id LeaseID, ttl int64) (*Lease, error) {
+	return le.GrantWithOptions(id, ttl, GrantOptions{})
+}
 
+func (le *lessor) GrantWithOptions(id LeaseID, ttl int64, opts GrantOptions) (*Lease, error) {
 	if ttl > MaxLeaseTTL {
 		return nil, ErrLeaseTTLTooLarge
 	}
+	return le.grant(id, ttl, 0, false, opts)
+}
+
+func (le *lessor) GrantDuration(id LeaseID, ttl time.Duration) (*Lease, error) {
+	if ttl > MaxLeaseTTL*time.Second {
+		return nil, ErrLeaseTTLTooLarge
+	}
+	if ttl <= 0 {
+		// zero marks leases granted in seconds; floor to the minimum below
+		ttl = 1
+	}
+	return le.grant(id, 0, ttl, false, GrantOptions{})
+}
+
+func (le *lessor) GrantPermanent(id LeaseID) (*Lease, error) {
+	return le.grant(id, 0, 0, true, GrantOptions{})
+}
+
+// floorTTLDuration raises a TTL granted with sub-second precision to the
+// minimum. It returns the TTL and the TTL rounded up to whole seconds.
+func (le *lessor) floorTTLDuration(ttl time.Duration) (time.Duration, int64) {
+	if ttl < le.minLeaseTTLDuration {
+		ttl = le.minLeaseTTLDuration
+	}
+	return ttl, int64(math.Ceil(ttl.Seconds()))
+}
+
+// grant grants a lease with a TTL of either ttl seconds or, if set,
+// ttlDuration. A permanent lease has no TTL.
+func (le *lessor) grant(id LeaseID, ttl int64, ttlDuration time.Duration, permanent bool, opts GrantOptions) (*Lease, error) {
+	if id == NoLease {
+		return nil, ErrLeaseNotFound
+	}
+	for _, it := range opts.Items {
+		if it.Key == "" {
+			return nil, ErrLeaseItemInvalid
+		}
+	}
+	if le.grantLimiter != nil && !le.grantLimiter.Allow(opts.Token) {
+		return nil, &GrantRateError{Token: opts.Token}
+	}
 
 	// TODO: when lessor is under high load, it should give out lease
 	// with longer TTL to reduce renew load.
 	l := &Lease{
-		ID:      id,
-		ttl:     ttl,
-		itemSet: make(map[LeaseItem]struct{}),
-		revokec: make(chan struct{}),
+		ID:         id,
+		ttl:        ttl,
+		grantedAt:  le.now(),
+		retainKeys: opts.RetainKeys,
+		permanent:  permanent,
+		itemSet:    make(map[LeaseItem]struct{}),
+		revokec:    make(chan struct{}),
+		clock:      le.clock,
+		grid:       le.expiryGranularity,
 	}
 
-	le.mu.Lock()
-	defer le.mu.Unlock()
+	tx := le.lockTx()
+	defer le.unlockTx(tx)
 
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return nil, err
+	}
 	if _, ok := le.leaseMap[id]; ok {
 		return nil, ErrLeaseExists
 	}
+	if le.maxLeases > 0 && len(le.leaseMap) >= le.maxLeases {
+		return nil, ErrTooManyLeases
+	}
+	if err := le.unsafeCheckItems(l, opts.Items); err != nil {
+		return nil, err
+	}
 
-	if l.ttl < le.minLeaseTTL {
+	if permanent {
+		// no TTL to floor
+	} else if ttlDuration != 0 {
+		l.ttlDuration, l.ttl = le.floorTTLDuration(ttlDuration)
+	} else if l.ttl < le.minLeaseTTL {
+		if le.strictMinTTL {
+			return nil, &TTLTooSmallError{MinTTL: le.minLeaseTTL}
+		}
 		l.ttl = le.minLeaseTTL
 	}
 
-	if le.isPrimary() {
+	if le.isPrimary() && !l.permanent {
 		l.refresh(0)
+		le.capLifetime(l)
+		le.unsafePushExpiry(l)
 	} else {
-		l.forever()
+		l.untrack()
 	}
 
 	le.leaseMap[id] = l
-	item := &LeaseWithTime{id: l.ID, time: l.expiry.UnixNano()}
-	heap.Push(&le.leaseHeap, item)
-	l.persistTo(le.b)
+	le.unsafeAttach(l, opts.Items)
+	l.unsafePersistTo(tx, le.bucketName)
+	le.unsafeRaiseMaxID(tx, id)
 
 	leaseTotalTTLs.Observe(float64(l.ttl))
 	leaseGranted.Inc()
@@ -288,98 +1338,404 @@ func (le *lessor) Grant(id LeaseID, ttl int64) (*Lease, error) {
 		le.scheduleCheckpointIfNeeded(l)
 	}
 
+	if le.lg != nil {
+		le.lg.Debug(
+			"granted lease",
+			zap.Int64("lease-id", int64(l.ID)),
+			zap.Int64("ttl", l.ttl),
+		)
+	}
 	return l, nil
 }
 
 func (le *lessor) Revoke(id LeaseID) error {
-	le.mu.Lock()
+	_, err := le.revoke(id, false)
+	return err
+}
+
+func (le *lessor) RevokeExpired(id LeaseID) error {
+	_, err := le.revoke(id, true)
+	return err
+}
+
+func (le *lessor) RevokeWithDeleted(id LeaseID) ([]string, error) {
+	return le.revoke(id, false)
+}
 
+// revoke revokes the lease with given ID and returns the sorted keys it
+// deleted. If expiredOnly is set, it revokes the lease only if it is still
+// expired.
+func (le *lessor) revoke(id LeaseID, expiredOnly bool) ([]string, error) {
+	tx := le.lockTx()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		le.unlockTx(tx)
+		return nil, err
+	}
 	l := le.leaseMap[id]
 	if l == nil {
-		le.mu.Unlock()
-		return ErrLeaseNotFound
+		le.unlockTx(tx)
+		return nil, ErrLeaseNotFound
 	}
-	defer close(l.revokec)
+	if expiredOnly {
+		if !le.isPrimary() {
+			err := le.notPrimaryError()
+			le.unlockTx(tx)
+			return nil, err
+		}
+		if !le.expired(l) {
+			le.unlockTx(tx)
+			return nil, ErrLeaseRenewed
+		}
+	}
+	if le.revokeFunc != nil {
+		le.unlockTx(tx)
+		return nil, le.finishRevokeFunc(l)
+	}
+	rd := le.rd
+	if rd == nil {
+		le.unlockTx(tx)
+		return nil, ErrNoRangeDeleter
+	}
+	// remove the lease first so that renewals fail fast, and mark it
+	// revoking so that a revocation interrupted by a crash is resumed.
+	delete(le.leaseMap, l.ID)
+	le.unsafeDetachAll(l)
+	l.revoking = true
+	l.unsafePersistTo(tx, le.bucketName)
 	// unlock before doing external work
-	le.mu.Unlock()
+	le.unlockTx(tx)
 
-	if le.rd == nil {
-		return nil
-	}
+	return le.finishRevoke(l, rd), nil
+}
 
-	txn := le.rd()
+// finishRevoke deletes the keys of a lease removed from leaseMap and marked
+// revoking, then the lease itself. It returns the sorted deleted keys.
+func (le *lessor) finishRevoke(l *Lease, rd RangeDeleter) []string {
+	defer close(l.revokec)
 
 	// sort keys so deletes are in same order among all members,
 	// otherwise the backened hashes will be different
-	keys := l.Keys()
-	sort.StringSlice(keys).Sort()
+	var deleted []string
+	if !l.retainKeys {
+		deleted = l.Keys()
+		sort.StringSlice(deleted).Sort()
+	}
+	le.mu.RLock()
+	b := le.b
+	le.mu.RUnlock()
+
+	// the txns lock the batch tx; mu is not taken within them, as the store
+	// looks up the leases of the keys it deletes.
+	keys := deleted
+	for le.revokeChunkSize > 0 && len(keys) > le.revokeChunkSize {
+		ctxn := rd()
+		for _, key := range keys[:le.revokeChunkSize] {
+			ctxn.DeleteRange([]byte(key), nil)
+		}
+		ctxn.End()
+		keys = keys[le.revokeChunkSize:]
+	}
+
+	txn := rd()
 	for _, key := range keys {
 		txn.DeleteRange([]byte(key), nil)
 	}
 
-	le.mu.Lock()
-	defer le.mu.Unlock()
-	delete(le.leaseMap, l.ID)
 	// lease deletion needs to be in the same backend transaction with the
 	// kv deletion. Or we might end up with not executing the revoke or not
 	// deleting the keys if etcdserver fails in between.
-	le.b.BatchTx().UnsafeDelete(leaseBucketName, int64ToBytes(int64(l.ID)))
-
+	l.removeFrom(b.BatchTx(), le.bucketName)
 	txn.End()
 
 	leaseRevoked.Inc()
+	if le.lg != nil {
+		le.lg.Debug(
+			"revoked lease",
+			zap.Int64("lease-id", int64(l.ID)),
+			zap.Int("keys", len(deleted)),
+		)
+	}
+	return deleted
+}
+
+// finishRevokeFunc revokes a lease through the revoke func. Unlike
+// finishRevoke, the lease is kept until the revoke func succeeds, so that a
+// failed revocation can be retried.
+func (le *lessor) finishRevokeFunc(l *Lease) error {
+	if err := le.revokeFunc(l); err != nil {
+		return err
+	}
+
+	tx := le.lockTx()
+	if le.leaseMap[l.ID] != l && le.revoking[l.ID] != l {
+		// revoked concurrently
+		le.unlockTx(tx)
+		return ErrLeaseNotFound
+	}
+	delete(le.leaseMap, l.ID)
+	delete(le.revoking, l.ID)
+	le.unsafeDetachAll(l)
+	l.removeFrom(tx, le.bucketName)
+	le.unlockTx(tx)
+	close(l.revokec)
+
+	leaseRevoked.Inc()
+	if le.lg != nil {
+		le.lg.Debug("revoked lease", zap.Int64("lease-id", int64(l.ID)))
+	}
 	return nil
 }
 
-func (le *lessor) Checkpoint(id LeaseID, remainingTTL int64) error {
+func (le *lessor) ResumeRevokes() int {
+	if le.revokeFunc != nil {
+		return le.resumeRevokesFunc()
+	}
+
 	le.mu.Lock()
-	defer le.mu.Unlock()
+	rd := le.rd
+	if rd == nil {
+		le.mu.Unlock()
+		return 0
+	}
+	ls := make([]*Lease, 0, len(le.revoking))
+	for _, l := range le.revoking {
+		ls = append(ls, l)
+	}
+	le.revoking = make(map[LeaseID]*Lease)
+	le.mu.Unlock()
 
-	if l, ok := le.leaseMap[id]; ok {
-		// when checkpointing, we only update the remainingTTL, Promote is responsible for applying this to lease expiry
-		l.remainingTTL = remainingTTL
-		if le.isPrimary() {
-			// schedule the next checkpoint as needed
-			le.scheduleCheckpointIfNeeded(l)
+	// resume in the same order among all members
+	sort.Slice(ls, func(i, j int) bool { return ls[i].ID < ls[j].ID })
+	for _, l := range ls {
+		if le.lg != nil {
+			le.lg.Info("resuming interrupted lease revocation", zap.Int64("lease-id", int64(l.ID)))
 		}
+		le.finishRevoke(l, rd)
 	}
-	return nil
+	return len(ls)
 }
 
-// Renew renews an existing lease. If the given lease does not exist or
-// has expired, an error will be returned.
-func (le *lessor) Renew(id LeaseID) (int64, error) {
+// resumeRevokesFunc resumes the interrupted revocations through the revoke
+// func. The leases it fails for are left to a later ResumeRevokes.
+func (le *lessor) resumeRevokesFunc() int {
 	le.mu.RLock()
-	if !le.isPrimary() {
-		// forward renew request to primary instead of returning error.
-		le.mu.RUnlock()
-		return -1, ErrNotPrimary
+	ls := make([]*Lease, 0, len(le.revoking))
+	for _, l := range le.revoking {
+		ls = append(ls, l)
 	}
+	le.mu.RUnlock()
 
-	demotec := le.demotec
+	sort.Slice(ls, func(i, j int) bool { return ls[i].ID < ls[j].ID })
+	n := 0
+	for _, l := range ls {
+		if err := le.finishRevokeFunc(l); err != nil {
+			if le.lg != nil {
+				le.lg.Warn("failed to resume lease revocation", zap.Int64("lease-id", int64(l.ID)), zap.Error(err))
+			}
+			continue
+		}
+		n++
+	}
+	return n
+}
 
-	l := le.leaseMap[id]
-	if l == nil {
-		le.mu.RUnlock()
-		return -1, ErrLeaseNotFound
+func (le *lessor) RevokeSync(id LeaseID) error {
+	if _, err := le.revoke(id, false); err != nil {
+		return err
+	}
+	le.mu.RLock()
+	b := le.b
+	le.mu.RUnlock()
+	b.ForceCommit()
+	return nil
+}
+
+func (le *lessor) RevokeIdempotent(id LeaseID) error {
+	if err := le.Revoke(id); err != ErrLeaseNotFound {
+		return err
+	}
+	return nil
+}
+
+func (le *lessor) RevokeByKey(key []byte) (LeaseID, error) {
+	id := le.GetLease(LeaseItem{Key: string(key)})
+	if id == NoLease {
+		return NoLease, ErrKeyNotLeased
+	}
+	if err := le.Revoke(id); err != nil {
+		return NoLease, err
+	}
+	return id, nil
+}
+
+func (le *lessor) RevokeByPrefix(prefix uint8) (int, error) {
+	le.mu.RLock()
+	var ids []LeaseID
+	for id := range le.leaseMap {
+		if uint8(uint64(id)>>56) == prefix {
+			ids = append(ids, id)
+		}
+	}
+	le.mu.RUnlock()
+
+	// revoke in the same order among all members
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	n := 0
+	for _, id := range ids {
+		switch err := le.Revoke(id); err {
+		case nil:
+			n++
+		case ErrLeaseNotFound:
+			// revoked concurrently
+		default:
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (le *lessor) RevokePreview(id LeaseID) ([]string, error) {
+	le.mu.RLock()
+	l := le.leaseMap[id]
+	le.mu.RUnlock()
+	if l == nil {
+		return nil, ErrLeaseNotFound
+	}
+	if l.retainKeys {
+		return nil, nil
+	}
+
+	keys := l.Keys()
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (le *lessor) ItemCount(id LeaseID) (int, error) {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	l := le.leaseMap[id]
+	if l == nil {
+		return 0, ErrLeaseNotFound
+	}
+	return l.ItemCount(), nil
+}
+
+func (le *lessor) RefreshFromBackend(id LeaseID) error {
+	tx := le.lockTx()
+	defer le.unlockTx(tx)
+
+	if le.closed {
+		return ErrLessorStopped
+	}
+
+	l := le.leaseMap[id]
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+	_, vs := tx.UnsafeRange(le.bucketName, int64ToBytes(int64(id)), nil, 0)
+	if len(vs) == 0 {
+		return ErrLeaseNotFound
+	}
+	var lpb leasepb.Lease
+	if err := unmarshalLease(vs[0], &lpb); err != nil {
+		return err
+	}
+
+	ttl, ttlDuration := le.persistedTTL(&lpb)
+	l.expiryMu.Lock()
+	l.ttl, l.ttlDuration = ttl, ttlDuration
+	l.remainingTTL = lpb.RemainingTTL
+	l.expiryMu.Unlock()
+	if le.isPrimary() && !l.pinned() {
+		l.refresh(0)
+		le.capLifetime(l)
+		le.unsafePushExpiry(l)
+		le.scheduleCheckpointIfNeeded(l)
+	}
+	return nil
+}
+
+func (le *lessor) Checkpoint(id LeaseID, remainingTTL int64) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if le.closed {
+		return ErrLessorStopped
+	}
+
+	if l, ok := le.leaseMap[id]; ok {
+		// when checkpointing, we only update the remainingTTL, Promote is responsible for applying this to lease expiry
+		l.expiryMu.Lock()
+		l.remainingTTL = remainingTTL
+		l.expiryMu.Unlock()
+		if le.isPrimary() {
+			// schedule the next checkpoint as needed
+			le.scheduleCheckpointIfNeeded(l)
+		}
+	}
+	return nil
+}
+
+// Renew renews an existing lease. If the given lease does not exist or
+// has expired, an error will be returned.
+func (le *lessor) Renew(id LeaseID) (int64, error) {
+	_, ttl, err := le.renew(id, forever)
+	return ttl, err
+}
+
+func (le *lessor) RenewIfBelow(id LeaseID, threshold time.Duration) (bool, int64, error) {
+	return le.renew(id, threshold)
+}
+
+// renew renews the lease if its remaining time is below threshold.
+func (le *lessor) renew(id LeaseID, threshold time.Duration) (bool, int64, error) {
+	le.mu.RLock()
+	if le.closed {
+		le.mu.RUnlock()
+		return false, -1, ErrLessorStopped
+	}
+	if !le.isPrimary() {
+		// forward renew request to primary instead of returning error.
+		err := le.notPrimaryError()
+		le.mu.RUnlock()
+		return false, -1, err
+	}
+
+	demotec := le.demotec
+
+	l, ttl, err := le.unsafeCheckRenew(id, threshold)
+	if l == nil {
+		le.mu.RUnlock()
+		return false, ttl, err
 	}
 	// Clear remaining TTL when we renew if it is set
 	clearRemainingTTL := le.cp != nil && l.remainingTTL > 0
 
+	if !clearRemainingTTL && le.coalesced(l) {
+		le.mu.RUnlock()
+		leaseRenewed.Inc()
+		leaseRenewCoalesced.Inc()
+		return false, l.TTL(), nil
+	}
+
 	le.mu.RUnlock()
-	if l.expired() {
+	if le.expired(l) {
 		select {
 		// A expired lease might be pending for revoking or going through
 		// quorum to be revoked. To be accurate, renew request must wait for the
 		// deletion to complete.
 		case <-l.revokec:
-			return -1, ErrLeaseNotFound
+			return false, -1, ErrLeaseNotFound
 		// The expired lease might fail to be revoked if the primary changes.
 		// The caller will retry on ErrNotPrimary.
 		case <-demotec:
-			return -1, ErrNotPrimary
+			le.mu.RLock()
+			err := le.notPrimaryError()
+			le.mu.RUnlock()
+			return false, -1, err
 		case <-le.stopC:
-			return -1, ErrNotPrimary
+			return false, -1, ErrLessorStopped
 		}
 	}
 
@@ -390,222 +1746,1727 @@ func (le *lessor) Renew(id LeaseID) (int64, error) {
 		le.cp(context.Background(), &pb.LeaseCheckpointRequest{Checkpoints: []*pb.LeaseCheckpoint{{ID: int64(l.ID), Remaining_TTL: 0}}})
 	}
 
-	le.mu.Lock()
-	l.refresh(0)
-	item := &LeaseWithTime{id: l.ID, time: l.expiry.UnixNano()}
-	heap.Push(&le.leaseHeap, item)
-	le.mu.Unlock()
-
-	leaseRenewed.Inc()
-	return l.ttl, nil
-}
-
-func (le *lessor) Lookup(id LeaseID) *Lease {
 	le.mu.RLock()
-	defer le.mu.RUnlock()
-	return le.leaseMap[id]
+	if le.closed {
+		le.mu.RUnlock()
+		return false, -1, ErrLessorStopped
+	}
+	if !le.isPrimary() {
+		err := le.notPrimaryError()
+		le.mu.RUnlock()
+		return false, -1, err
+	}
+	if l.held {
+		// held since checked above
+		le.mu.RUnlock()
+		return false, l.TTL(), nil
+	}
+	// refresh and update the heap under the lease lock so that concurrent
+	// renewals of the lease leave its heap item at the latest expiry.
+	ll := le.leaseLock(l.ID)
+	ll.Lock()
+	renewed, ttl := le.unsafeRefresh(l, threshold)
+	if renewed {
+		le.heapMu.Lock()
+		le.unsafePushExpiry(l)
+		le.heapMu.Unlock()
+	}
+	ll.Unlock()
+	le.mu.RUnlock()
+	if renewed {
+		leaseRenewed.Inc()
+		le.logRenewed(l, ttl)
+	}
+	return renewed, ttl, nil
 }
 
-func (le *lessor) unsafeLeases() []*Lease {
-	leases := make([]*Lease, 0, len(le.leaseMap))
-	for _, l := range le.leaseMap {
-		leases = append(leases, l)
+// unsafeCheckRenew looks up the lease to renew. It returns a nil lease with
+// the result of the renewal if the lease needs no refresh. The caller must
+// hold mu.
+func (le *lessor) unsafeCheckRenew(id LeaseID, threshold time.Duration) (*Lease, int64, error) {
+	l := le.leaseMap[id]
+	if l == nil {
+		if le.tolerateMissingRenew {
+			if le.lg != nil {
+				le.lg.Warn("skipped renewing missing lease", zap.Int64("lease-id", int64(id)))
+			}
+			return nil, 0, nil
+		}
+		return nil, -1, ErrLeaseNotFound
 	}
-	return leases
+	if l.permanent {
+		return nil, -1, ErrLeasePermanent
+	}
+	if l.held {
+		leaseRenewed.Inc()
+		return nil, l.TTL(), nil
+	}
+	if le.lifetimeExceeded(l) {
+		return nil, -1, ErrLeaseLifetimeExceeded
+	}
+	if remaining := l.Remaining(); remaining >= threshold {
+		return nil, remainingSeconds(remaining), nil
+	}
+	return l, 0, nil
 }
 
-func (le *lessor) Leases() []*Lease {
-	le.mu.RLock()
-	ls := le.unsafeLeases()
-	le.mu.RUnlock()
-	sort.Sort(leasesByExpiry(ls))
-	return ls
+// coalesced reports whether the lease was renewed within the renew coalesce
+// window, so that renewing it again can be skipped.
+func (le *lessor) coalesced(l *Lease) bool {
+	if le.renewCoalesceWindow <= 0 {
+		return false
+	}
+	since, ok := l.sinceRenewed()
+	return ok && since < le.renewCoalesceWindow && !le.expired(l)
 }
 
-func (le *lessor) Promote(extend time.Duration) {
-	le.mu.Lock()
-	defer le.mu.Unlock()
-
-	le.demotec = make(chan struct{})
-
-	// refresh the expiries of all leases.
-	for _, l := range le.leaseMap {
-		l.refresh(extend)
-		item := &LeaseWithTime{id: l.ID, time: l.expiry.UnixNano()}
-		heap.Push(&le.leaseHeap, item)
+// unsafeRefresh refreshes the lease if its remaining time is still below
+// threshold, and returns the renewed TTL or the remaining one. The caller
+// must hold mu exclusively, or hold it shared with the lease lock, and push
+// the renewed expiry.
+func (le *lessor) unsafeRefresh(l *Lease, threshold time.Duration) (bool, int64) {
+	// check again, a concurrent renewal may have extended the lease since.
+	if remaining := l.Remaining(); remaining >= threshold {
+		return false, remainingSeconds(remaining)
+	}
+	l.refresh(0)
+	ttl := l.ttl
+	if le.capLifetime(l) {
+		ttl = remainingSeconds(l.Remaining())
 	}
+	return true, ttl
+}
 
-	if len(le.leaseMap) < leaseRevokeRate {
-		// no possibility of lease pile-up
-		return
+func (le *lessor) logRenewed(l *Lease, ttl int64) {
+	if le.lg != nil {
+		// check the level first; the fields escape to the heap otherwise.
+		if ce := le.lg.Check(zap.DebugLevel, "renewed lease"); ce != nil {
+			ce.Write(
+				zap.Int64("lease-id", int64(l.ID)),
+				zap.Int64("ttl", ttl),
+			)
+		}
 	}
+}
 
-	// adjust expiries in case of overlap
-	leases := le.unsafeLeases()
-	sort.Sort(leasesByExpiry(leases))
+func (le *lessor) RenewBatch(ids []LeaseID) ([]int64, []error) {
+	ttls := make([]int64, len(ids))
+	errs := make([]error, len(ids))
 
-	baseWindow := leases[0].Remaining()
-	nextWindow := baseWindow + time.Second
-	expires := 0
-	// have fewer expires than the total revoke rate so piled up leases
-	// don't consume the entire revoke limit
-	targetExpiresPerSecond := (3 * leaseRevokeRate) / 4
-	for _, l := range leases {
-		remaining := l.Remaining()
-		if remaining > nextWindow {
-			baseWindow = remaining
-			nextWindow = baseWindow + time.Second
-			expires = 1
+	// the renewals that wait for a revocation or go through a checkpoint
+	// fall back to renewing one by one.
+	var slow []int
+	le.mu.RLock()
+	var err error
+	if le.closed {
+		err = ErrLessorStopped
+	} else if !le.isPrimary() {
+		err = le.notPrimaryError()
+	}
+	if err != nil {
+		le.mu.RUnlock()
+		for i := range ids {
+			ttls[i], errs[i] = -1, err
+		}
+		return ttls, errs
+	}
+	for i, id := range ids {
+		l, ttl, err := le.unsafeCheckRenew(id, forever)
+		if l == nil {
+			ttls[i], errs[i] = ttl, err
 			continue
 		}
-		expires++
-		if expires <= targetExpiresPerSecond {
+		if le.expired(l) || (le.cp != nil && l.remainingTTL > 0) {
+			slow = append(slow, i)
 			continue
 		}
-		rateDelay := float64(time.Second) * (float64(expires) / float64(targetExpiresPerSecond))
-		// If leases are extended by n seconds, leases n seconds ahead of the
-		// base window should be extended by only one second.
-		rateDelay -= float64(remaining - baseWindow)
-		delay := time.Duration(rateDelay)
-		nextWindow = baseWindow + delay
-		l.refresh(delay + extend)
-		item := &LeaseWithTime{id: l.ID, time: l.expiry.UnixNano()}
-		heap.Push(&le.leaseHeap, item)
-		le.scheduleCheckpointIfNeeded(l)
+		if le.coalesced(l) {
+			leaseRenewed.Inc()
+			leaseRenewCoalesced.Inc()
+			ttls[i] = l.TTL()
+			continue
+		}
+		// refresh and update the heap under the lease lock, as renew does.
+		ll := le.leaseLock(l.ID)
+		ll.Lock()
+		renewed, ttl := le.unsafeRefresh(l, forever)
+		if renewed {
+			le.heapMu.Lock()
+			le.unsafePushExpiry(l)
+			le.heapMu.Unlock()
+		}
+		ll.Unlock()
+		ttls[i] = ttl
+		if renewed {
+			leaseRenewed.Inc()
+			le.logRenewed(l, ttl)
+		}
 	}
-}
-
-type leasesByExpiry []*Lease
+	le.mu.RUnlock()
 
-func (le leasesByExpiry) Len() int           { return len(le) }
-func (le leasesByExpiry) Less(i, j int) bool { return le[i].Remaining() < le[j].Remaining() }
-func (le leasesByExpiry) Swap(i, j int)      { le[i], le[j] = le[j], le[i] }
+	for _, i := range slow {
+		ttls[i], errs[i] = le.Renew(ids[i])
+	}
+	return ttls, errs
+}
 
-func (le *lessor) Demote() {
-	le.mu.Lock()
-	defer le.mu.Unlock()
+// remainingSeconds rounds a remaining time up to whole seconds.
+func remainingSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
 
-	// set the expiries of all leases to forever
-	for _, l := range le.leaseMap {
-		l.forever()
+// now returns the wall clock time, floored at the latest reading seen if
+// wallClockFloor is set.
+func (le *lessor) now() time.Time {
+	t := le.clock.Now()
+	if !le.wallClockFloor {
+		return t
 	}
+	for {
+		seen := atomic.LoadInt64(&le.maxSeenNow)
+		if t.UnixNano() <= seen {
+			return time.Unix(0, seen)
+		}
+		if atomic.CompareAndSwapInt64(&le.maxSeenNow, seen, t.UnixNano()) {
+			return t
+		}
+	}
+}
 
-	le.clearScheduledLeasesCheckpoints()
-
-	if le.demotec != nil {
-		close(le.demotec)
-		le.demotec = nil
+// lifetimeDeadline returns the time on the lessor clock the lease reaches its
+// maximum lifetime. ok is false if the lifetime of the lease is not bounded.
+func (le *lessor) lifetimeDeadline(l *Lease) (deadline time.Duration, ok bool) {
+	if le.maxLifetime <= 0 || l.grantedAt.IsZero() {
+		return 0, false
 	}
+	// grant times restored from a lease dump are wall clock readings; grant
+	// times taken in this process still carry a monotonic reading.
+	left := l.grantedAt.Add(le.maxLifetime).Sub(le.now())
+	return le.clock.Elapsed() + left, true
 }
 
-// Attach attaches items to the lease with given ID. When the lease
-// expires, the attached items will be automatically removed.
-// If the given lease does not exist, an error will be returned.
-func (le *lessor) Attach(id LeaseID, items []LeaseItem) error {
-	le.mu.Lock()
-	defer le.mu.Unlock()
+// lifetimeExceeded returns true if the lease has reached its maximum lifetime.
+func (le *lessor) lifetimeExceeded(l *Lease) bool {
+	deadline, ok := le.lifetimeDeadline(l)
+	return ok && le.clock.Elapsed() >= deadline
+}
 
-	l := le.leaseMap[id]
-	if l == nil {
-		return ErrLeaseNotFound
+// capLifetime moves the expiry of the lease back to the end of its maximum
+// lifetime if it is later. It returns true if the expiry was moved.
+func (le *lessor) capLifetime(l *Lease) bool {
+	deadline, ok := le.lifetimeDeadline(l)
+	if !ok {
+		return false
 	}
-
-	l.mu.Lock()
-	for _, it := range items {
-		l.itemSet[it] = struct{}{}
-		le.itemMap[it] = id
+	l.expiryMu.Lock()
+	defer l.expiryMu.Unlock()
+	if !l.tracked || l.expiry < deadline {
+		return false
 	}
-	l.mu.Unlock()
-	return nil
+	l.expiry = deadline
+	return true
 }
 
-func (le *lessor) GetLease(item LeaseItem) LeaseID {
+// leaseLock returns the striped lock serializing renewals of the lease with given ID.
+func (le *lessor) leaseLock(id LeaseID) *sync.Mutex {
+	return &le.leaseLocks[uint64(id)%leaseLockShards]
+}
+
+func (le *lessor) Lookup(id LeaseID) *Lease {
 	le.mu.RLock()
-	id := le.itemMap[item]
-	le.mu.RUnlock()
-	return id
+	defer le.mu.RUnlock()
+	return le.leaseMap[id]
 }
 
-// Detach detaches items from the lease with given ID.
-// If the given lease does not exist, an error will be returned.
-func (le *lessor) Detach(id LeaseID, items []LeaseItem) error {
-	le.mu.Lock()
-	defer le.mu.Unlock()
+// LeaseInfo describes a lease for inspection.
+type LeaseInfo struct {
+	ID LeaseID
+	// TTL is the granted TTL in seconds.
+	TTL int64
+	// TimeToLive is the remaining TTL in seconds, or -1 if the expiry is not
+	// tracked.
+	TimeToLive int64
+	// ExpiryTracked is false if the lease has no deadline, because the
+	// lessor is not the primary or the lease is held or permanent.
+	ExpiryTracked bool
+	// GrantedAt is the local time the lease was granted at, or recovered at
+	// if recovered from the backend.
+	GrantedAt time.Time
+	// LastRenewed is the local time the lease was last renewed at, or the
+	// lessor promoted if later. It is zero if the lessor is not the primary.
+	LastRenewed time.Time
+	// KeyCount is the number of keys attached to the lease.
+	KeyCount int
+	// Keys holds up to the requested limit of the attached keys, sorted.
+	Keys []string
+}
 
+func (le *lessor) LeaseInfo(id LeaseID, keyLimit int) (LeaseInfo, error) {
+	le.mu.RLock()
 	l := le.leaseMap[id]
+	le.mu.RUnlock()
 	if l == nil {
-		return ErrLeaseNotFound
+		return LeaseInfo{}, ErrLeaseNotFound
 	}
 
-	l.mu.Lock()
-	for _, it := range items {
-		delete(l.itemSet, it)
-		delete(le.itemMap, it)
+	info := LeaseInfo{
+		ID:        l.ID,
+		TTL:       l.TTL(),
+		GrantedAt: l.grantedAt,
+		KeyCount:  l.ItemCount(),
 	}
-	l.mu.Unlock()
-	return nil
-}
-
-func (le *lessor) Recover(b backend.Backend, rd RangeDeleter) {
-	le.mu.Lock()
+	if remaining, ok := l.remaining(); ok {
+		info.TimeToLive = remainingSeconds(remaining)
+		info.ExpiryTracked = true
+	} else {
+		info.TimeToLive = -1
+	}
+	if since, ok := l.sinceRenewed(); ok {
+		info.LastRenewed = le.now().Add(-since)
+	}
+	if keyLimit > 0 {
+		keys := l.Keys()
+		info.KeyCount = len(keys)
+		sort.Strings(keys)
+		if len(keys) > keyLimit {
+			keys = keys[:keyLimit]
+		}
+		info.Keys = keys
+	}
+	return info, nil
+}
+
+func (le *lessor) ExpiryTime(id LeaseID) (time.Time, error) {
+	le.mu.RLock()
+	l := le.leaseMap[id]
+	le.mu.RUnlock()
+	if l == nil {
+		return time.Time{}, ErrLeaseNotFound
+	}
+	// the expiry is tracked on the monotonic clock
+	remaining, ok := l.remaining()
+	if !ok {
+		return time.Time{}, nil
+	}
+	return le.now().Add(remaining), nil
+}
+
+func (le *lessor) unsafeLeases() []*Lease {
+	leases := make([]*Lease, 0, len(le.leaseMap))
+	for _, l := range le.leaseMap {
+		leases = append(leases, l)
+	}
+	return leases
+}
+
+func (le *lessor) Leases() []*Lease {
+	le.mu.RLock()
+	ls := le.unsafeLeases()
+	le.mu.RUnlock()
+	sort.Sort(leasesByExpiry(ls))
+	return ls
+}
+
+func (le *lessor) ForEachLease(fn func(*Lease) bool) {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	for _, l := range le.leaseMap {
+		if !fn(l.copy()) {
+			return
+		}
+	}
+}
+
+func (le *lessor) TopLeasesByItems(n int) []*Lease {
+	if n <= 0 {
+		return nil
+	}
+	le.mu.RLock()
+	ls := le.unsafeLeases()
+	le.mu.RUnlock()
+
+	counts := make(map[LeaseID]int, len(ls))
+	for _, l := range ls {
+		counts[l.ID] = l.ItemCount()
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		ci, cj := counts[ls[i].ID], counts[ls[j].ID]
+		if ci != cj {
+			return ci > cj
+		}
+		return ls[i].ID < ls[j].ID
+	})
+	if len(ls) > n {
+		ls = ls[:n]
+	}
+	return ls
+}
+
+func (le *lessor) ExpiringWithin(d time.Duration) []*Lease {
+	le.mu.RLock()
+	var ls []*Lease
+	for _, l := range le.leaseMap {
+		if rem, ok := l.remaining(); ok && rem <= d {
+			ls = append(ls, l.copy())
+		}
+	}
+	le.mu.RUnlock()
+	sort.Sort(leasesByExpiry(ls))
+	return ls
+}
+
+func (le *lessor) StaleLeases(olderThan time.Duration) []LeaseID {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+
+	if !le.isPrimary() {
+		return nil
+	}
+	var ids []LeaseID
+	for id, l := range le.leaseMap {
+		if since, ok := l.sinceRenewed(); ok && since > olderThan {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// LeaseStats summarizes the leases outstanding in a lessor.
+type LeaseStats struct {
+	// Count is the number of outstanding leases.
+	Count int `json:"count"`
+	// ItemCount is the number of items attached to the leases.
+	ItemCount int `json:"itemCount"`
+	// Permanent is the number of permanent leases, which have no TTL and are
+	// left out of the TTL stats and Buckets, as they are by CountByTTLRange.
+	Permanent int `json:"permanent"`
+	// MinTTL, MaxTTL, MeanTTL and the median and 99th percentile P50TTL and
+	// P99TTL are in seconds. They are zero when there are no leases with a
+	// TTL.
+	MinTTL  int64   `json:"minTTL"`
+	MaxTTL  int64   `json:"maxTTL"`
+	MeanTTL float64 `json:"meanTTL"`
+	P50TTL  int64   `json:"p50TTL"`
+	P99TTL  int64   `json:"p99TTL"`
+	// Expiring is the number of leases expiring within StatsExpiryWindow.
+	// As only the primary tracks expiries, it is zero on other lessors.
+	Expiring int `json:"expiring"`
+	// OldestAge is the time since the oldest lease was granted, or recovered
+	// if recovered from the backend.
+	OldestAge time.Duration `json:"oldestAge"`
+	// Buckets is the histogram of lease TTLs, ordered by upper bound.
+	Buckets []LeaseStatsBucket `json:"buckets"`
+}
+
+// LeaseStatsBucket counts the leases whose TTL is at most UpperBound seconds
+// and greater than the upper bound of the previous bucket. The last bucket has
+// an UpperBound of math.MaxInt64.
+type LeaseStatsBucket struct {
+	UpperBound int64 `json:"upperBound"`
+	Count      int   `json:"count"`
+}
+
+func (le *lessor) Stats() LeaseStats {
+	le.mu.RLock()
+	st, ttls := le.unsafeStats()
+	le.mu.RUnlock()
+
+	st.setPercentiles(ttls)
+	return st
+}
+
+func (le *lessor) CountByTTLRange(minTTL, maxTTL int64) int {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+
+	n := 0
+	for _, l := range le.leaseMap {
+		if !l.permanent && l.ttl >= minTTL && l.ttl <= maxTTL {
+			n++
+		}
+	}
+	return n
+}
+
+// unsafeStats computes the stats of the leases but their TTL percentiles,
+// which are left to setPercentiles on the returned TTLs so that sorting
+// them does not hold mu. The caller must hold mu.
+func (le *lessor) unsafeStats() (LeaseStats, []int64) {
+	st := LeaseStats{Buckets: make([]LeaseStatsBucket, len(le.statsBuckets)+1)}
+	for i, ub := range le.statsBuckets {
+		st.Buckets[i].UpperBound = ub
+	}
+	st.Buckets[len(le.statsBuckets)].UpperBound = math.MaxInt64
+
+	var (
+		sum    float64
+		oldest time.Time
+	)
+	ttls := make([]int64, 0, len(le.leaseMap))
+	for _, l := range le.leaseMap {
+		st.Count++
+		st.ItemCount += l.ItemCount()
+		if rem, ok := l.remaining(); ok && rem <= le.statsExpiryWindow {
+			st.Expiring++
+		}
+		if !l.grantedAt.IsZero() && (oldest.IsZero() || l.grantedAt.Before(oldest)) {
+			oldest = l.grantedAt
+		}
+		if l.permanent {
+			st.Permanent++
+			continue
+		}
+
+		ttl := l.ttl
+		if len(ttls) == 0 || ttl < st.MinTTL {
+			st.MinTTL = ttl
+		}
+		if ttl > st.MaxTTL {
+			st.MaxTTL = ttl
+		}
+		sum += float64(ttl)
+		ttls = append(ttls, ttl)
+
+		i := sort.Search(len(st.Buckets), func(i int) bool { return ttl <= st.Buckets[i].UpperBound })
+		st.Buckets[i].Count++
+	}
+	if len(ttls) > 0 {
+		st.MeanTTL = sum / float64(len(ttls))
+	}
+	if !oldest.IsZero() {
+		st.OldestAge = le.now().Sub(oldest)
+	}
+	return st, ttls
+}
+
+// setPercentiles sets the TTL percentiles from the TTLs of the leases, by
+// nearest rank.
+func (st *LeaseStats) setPercentiles(ttls []int64) {
+	if len(ttls) == 0 {
+		return
+	}
+	sort.Slice(ttls, func(i, j int) bool { return ttls[i] < ttls[j] })
+	rank := func(p float64) int64 {
+		return ttls[int(math.Ceil(p*float64(len(ttls))))-1]
+	}
+	st.P50TTL = rank(0.5)
+	st.P99TTL = rank(0.99)
+}
+
+// LeaseHandoff is the remaining time of a lease as seen by the old primary.
+type LeaseHandoff struct {
+	ID        LeaseID
+	Remaining time.Duration
+}
+
+func (le *lessor) HandoffState() []LeaseHandoff {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+
+	if !le.isPrimary() {
+		return nil
+	}
+	state := make([]LeaseHandoff, 0, len(le.leaseMap))
+	for _, l := range le.leaseMap {
+		remaining, ok := l.remaining()
+		if !ok {
+			// held or permanent; the next primary decides on its own
+			continue
+		}
+		if remaining < 0 {
+			remaining = 0
+		}
+		state = append(state, LeaseHandoff{ID: l.ID, Remaining: remaining})
+	}
+	return state
+}
+
+func (le *lessor) Promote(extend time.Duration) error {
+	return le.PromoteWithHandoff(extend, nil)
+}
+
+func (le *lessor) PromoteWithHandoff(extend time.Duration, state []LeaseHandoff) error {
+	le.mu.Lock()
+	if le.closed {
+		le.mu.Unlock()
+		return ErrLessorStopped
+	}
+	le.unsafePromote(extend, state)
+	le.queuePrimaryChange(true)
+	le.mu.Unlock()
+
+	le.notifyPrimaryChange()
+	return nil
+}
+
+// unsafePromote promotes the lessor. The caller must hold mu.
+func (le *lessor) unsafePromote(extend time.Duration, state []LeaseHandoff) {
+	le.demotec = make(chan struct{})
+	le.generation++
+
+	if le.lg != nil {
+		le.lg.Info(
+			"promoted lessor",
+			zap.Uint64("generation", le.generation),
+			zap.Duration("extend", extend),
+			zap.Int("leases", len(le.leaseMap)),
+			zap.Int("handoff-leases", len(state)),
+		)
+	}
+
+	handoff := make(map[LeaseID]time.Duration, len(state))
+	for _, h := range state {
+		handoff[h.ID] = h.Remaining
+	}
+
+	// refresh the expiries of all leases but the permanent and held ones.
+	for _, l := range le.leaseMap {
+		if l.pinned() {
+			continue
+		}
+		if remaining, ok := handoff[l.ID]; ok {
+			l.refreshRemaining(addDuration(extend, remaining))
+		} else {
+			l.refresh(extend)
+		}
+		le.capLifetime(l)
+		le.unsafePushExpiry(l)
+	}
+
+	if len(le.leaseMap) < leaseRevokeRate {
+		// no possibility of lease pile-up
+		return
+	}
+
+	// adjust expiries in case of overlap
+	leases := le.unsafeLeases()
+	sort.Sort(leasesByExpiry(leases))
+
+	baseWindow := leases[0].Remaining()
+	nextWindow := baseWindow + time.Second
+	expires := 0
+	// have fewer expires than the total revoke rate so piled up leases
+	// don't consume the entire revoke limit
+	targetExpiresPerSecond := (3 * leaseRevokeRate) / 4
+	for _, l := range leases {
+		if l.pinned() {
+			// sorted last as they never expire
+			break
+		}
+		remaining := l.Remaining()
+		if remaining > nextWindow {
+			baseWindow = remaining
+			nextWindow = baseWindow + time.Second
+			expires = 1
+			continue
+		}
+		expires++
+		if expires <= targetExpiresPerSecond {
+			continue
+		}
+		rateDelay := float64(time.Second) * (float64(expires) / float64(targetExpiresPerSecond))
+		// If leases are extended by n seconds, leases n seconds ahead of the
+		// base window should be extended by only one second.
+		rateDelay -= float64(remaining - baseWindow)
+		delay := time.Duration(rateDelay)
+		nextWindow = baseWindow + delay
+		l.refreshRemaining(remaining + delay)
+		le.capLifetime(l)
+		le.unsafePushExpiry(l)
+		le.scheduleCheckpointIfNeeded(l)
+	}
+}
+
+type leasesByExpiry []*Lease
+
+func (le leasesByExpiry) Len() int           { return len(le) }
+func (le leasesByExpiry) Less(i, j int) bool { return le[i].Remaining() < le[j].Remaining() }
+func (le leasesByExpiry) Swap(i, j int)      { le[i], le[j] = le[j], le[i] }
+
+func (le *lessor) Demote() error {
+	le.mu.Lock()
+	if le.closed {
+		le.mu.Unlock()
+		return ErrLessorStopped
+	}
+	wasPrimary := le.isPrimary()
+	le.unsafeDemote()
+	if le.lg != nil {
+		le.lg.Info(
+			"demoted lessor",
+			zap.Uint64("generation", le.generation),
+			zap.Int("leases", len(le.leaseMap)),
+		)
+	}
+	if wasPrimary {
+		le.queuePrimaryChange(false)
+	}
+	le.mu.Unlock()
+
+	le.notifyPrimaryChange()
+	return nil
+}
+
+func (le *lessor) OnPrimaryChange(f func(primary bool)) {
+	le.cbMu.Lock()
+	defer le.cbMu.Unlock()
+	le.primaryCbs = append(le.primaryCbs, f)
+}
+
+// queuePrimaryChange queues a primary change for notifyPrimaryChange. The
+// caller must hold mu so that changes are queued in the order they happen.
+func (le *lessor) queuePrimaryChange(primary bool) {
+	le.cbMu.Lock()
+	le.primaryEvents = append(le.primaryEvents, primary)
+	le.cbMu.Unlock()
+}
+
+// notifyPrimaryChange calls the primary change callbacks for the queued
+// changes. It must be called without holding mu. If another goroutine, or a
+// callback up the stack, is already delivering, it delivers the queued
+// changes as well, so callbacks may promote or demote without deadlocking.
+func (le *lessor) notifyPrimaryChange() {
+	le.cbMu.Lock()
+	if le.notifying {
+		le.cbMu.Unlock()
+		return
+	}
+	le.notifying = true
+	for len(le.primaryEvents) > 0 {
+		primary := le.primaryEvents[0]
+		le.primaryEvents = le.primaryEvents[1:]
+		cbs := le.primaryCbs
+		le.cbMu.Unlock()
+
+		for _, f := range cbs {
+			f(primary)
+		}
+
+		le.cbMu.Lock()
+	}
+	le.notifying = false
+	le.cbMu.Unlock()
+}
+
+// unsafeDemote demotes the lessor. The caller must hold mu.
+func (le *lessor) unsafeDemote() {
+	// stop tracking the expiries of all leases
+	for _, l := range le.leaseMap {
+		l.untrack()
+	}
+
+	le.clearScheduledLeasesCheckpoints()
+
+	// drop the expired leases found while being the primary; the new
+	// primary is responsible for their expiration.
+	le.pendingExpired = nil
+	atomic.StoreInt64(&le.pendingExpiredCount, 0)
+	for len(le.expiredC) > 0 {
+		select {
+		case <-le.expiredC:
+		default:
+		}
+	}
+
+	if le.demotec != nil {
+		close(le.demotec)
+		le.demotec = nil
+	}
+}
+
+func (le *lessor) Freeze() {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	le.frozen = true
+}
+
+func (le *lessor) Unfreeze() {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	le.frozen = false
+}
+
+func (le *lessor) Hold(id LeaseID) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if le.closed {
+		return ErrLessorStopped
+	}
+
+	l := le.leaseMap[id]
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+	l.held = true
+	l.untrack()
+	return nil
+}
+
+func (le *lessor) Release(id LeaseID) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if le.closed {
+		return ErrLessorStopped
+	}
+
+	l := le.leaseMap[id]
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+	if !l.held {
+		return nil
+	}
+	l.held = false
+	if le.isPrimary() && !l.permanent {
+		l.refresh(0)
+		le.capLifetime(l)
+		le.unsafePushExpiry(l)
+		le.scheduleCheckpointIfNeeded(l)
+	}
+	return nil
+}
+
+func (le *lessor) Generation() uint64 {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	if !le.isPrimary() {
+		return 0
+	}
+	return le.generation
+}
+
+func (le *lessor) IsPrimary() bool {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	return le.isPrimary()
+}
+
+func (le *lessor) PrimaryGeneration() uint64 {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	return le.generation
+}
+
+// AttachOptions are the options of attaching items to a lease.
+type AttachOptions struct {
+	// TTL, if positive, makes the items expire after it even though the
+	// lease lives on: the primary lessor detaches them and deletes them
+	// through the range deleter. Renewals of the lease do not extend it, and
+	// attaching the items again without a TTL cancels it. Item TTLs are not
+	// persisted, and as with AutoRevoke the deletions do not go through a
+	// consensus layer.
+	TTL time.Duration
+}
+
+// Attach attaches items to the lease with given ID. When the lease
+// expires, the attached items will be automatically removed.
+// If the given lease does not exist, an error will be returned.
+func (le *lessor) Attach(id LeaseID, items []LeaseItem) error {
+	return le.AttachWithOptions(id, items, AttachOptions{})
+}
+
+func (le *lessor) AttachWithOptions(id LeaseID, items []LeaseItem, opts AttachOptions) error {
+	if opts.TTL < 0 {
+		return ErrInvalidItemTTL
+	}
+
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return err
+	}
+	l := le.leaseMap[id]
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+	if err := le.unsafeCheckItems(l, items); err != nil {
+		return err
+	}
+
+	le.unsafeAttach(l, items)
+	le.unsafeSetItemExpiry(items, opts.TTL)
+	return nil
+}
+
+func (le *lessor) AttachBatch(batch map[LeaseID][]LeaseItem) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return err
+	}
+	if !le.unsafeLeasesExist(batch) {
+		return ErrLeaseNotFound
+	}
+	for id, items := range batch {
+		if err := le.unsafeCheckItems(le.leaseMap[id], items); err != nil {
+			return err
+		}
+	}
+	for id, items := range batch {
+		le.unsafeAttach(le.leaseMap[id], items)
+		le.unsafeClearItemExpiry(items)
+	}
+	return nil
+}
+
+func (le *lessor) Reattach(batch map[LeaseID][]LeaseItem) []LeaseID {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	var missing []LeaseID
+	for id, items := range batch {
+		if l := le.revoking[id]; l != nil {
+			// the keys are only needed to finish the revocation, they must
+			// not be detached from it by the KV store.
+			l.mu.Lock()
+			for _, it := range items {
+				l.itemSet[it] = struct{}{}
+			}
+			l.mu.Unlock()
+			continue
+		}
+		l := le.leaseMap[id]
+		if l == nil {
+			missing = append(missing, id)
+			continue
+		}
+		le.unsafeAttach(l, items)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return missing
+}
+
+// unsafeAttach attaches items to the lease. The caller must hold mu.
+func (le *lessor) unsafeAttach(l *Lease, items []LeaseItem) {
+	l.mu.Lock()
+	for _, it := range items {
+		l.itemSet[it] = struct{}{}
+		le.itemMap[it] = l.ID
+	}
+	l.mu.Unlock()
+}
+
+// unsafeDetachAll removes the items of the lease from itemMap, leaving its
+// itemSet intact. The caller must hold mu.
+func (le *lessor) unsafeDetachAll(l *Lease) {
+	l.mu.RLock()
+	for it := range l.itemSet {
+		if le.itemMap[it] == l.ID {
+			delete(le.itemMap, it)
+			le.unsafeClearItemExpiry([]LeaseItem{it})
+		}
+	}
+	l.mu.RUnlock()
+}
+
+// unsafeCheckItems returns a TooManyItemsError if attaching items to the lease
+// would exceed the maximum number of items per lease. The caller must hold mu.
+func (le *lessor) unsafeCheckItems(l *Lease, items []LeaseItem) error {
+	if le.maxItemsPerLease <= 0 {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	added := make(map[LeaseItem]struct{})
+	for _, it := range items {
+		if _, ok := l.itemSet[it]; !ok {
+			added[it] = struct{}{}
+		}
+	}
+	if len(l.itemSet)+len(added) > le.maxItemsPerLease {
+		return &TooManyItemsError{ID: l.ID, MaxItems: le.maxItemsPerLease}
+	}
+	return nil
+}
+
+// unsafeLeasesExist returns true if all leases of the batch exist. The caller
+// must hold mu.
+func (le *lessor) unsafeLeasesExist(batch map[LeaseID][]LeaseItem) bool {
+	for id := range batch {
+		if le.leaseMap[id] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (le *lessor) GetLease(item LeaseItem) LeaseID {
+	le.mu.RLock()
+	id := le.itemMap[item]
+	le.mu.RUnlock()
+	return id
+}
+
+// Detach detaches items from the lease with given ID.
+// If the given lease does not exist, an error will be returned.
+func (le *lessor) Detach(id LeaseID, items []LeaseItem) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return err
+	}
+	l := le.leaseMap[id]
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+
+	le.unsafeDetach(l, items)
+	return nil
+}
+
+func (le *lessor) DetachKey(key []byte) (LeaseID, error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return NoLease, err
+	}
+	item := LeaseItem{Key: string(key)}
+	id, ok := le.itemMap[item]
+	if !ok {
+		return NoLease, ErrKeyNotLeased
+	}
+	le.unsafeDetach(le.leaseMap[id], []LeaseItem{item})
+	return id, nil
+}
+
+func (le *lessor) DetachAll(id LeaseID) (int, error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return 0, err
+	}
+	l := le.leaseMap[id]
+	if l == nil {
+		return 0, ErrLeaseNotFound
+	}
+
+	le.unsafeDetachAll(l)
+	l.mu.Lock()
+	n := len(l.itemSet)
+	l.itemSet = make(map[LeaseItem]struct{})
+	l.mu.Unlock()
+	return n, nil
+}
+
+func (le *lessor) DetachBatch(batch map[LeaseID][]LeaseItem) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return err
+	}
+	if !le.unsafeLeasesExist(batch) {
+		return ErrLeaseNotFound
+	}
+	for id, items := range batch {
+		le.unsafeDetach(le.leaseMap[id], items)
+	}
+	return nil
+}
+
+func (le *lessor) TransferItems(from, to LeaseID, items []LeaseItem) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return err
+	}
+	fl, tl := le.leaseMap[from], le.leaseMap[to]
+	if fl == nil || tl == nil {
+		return ErrLeaseNotFound
+	}
+	for _, it := range items {
+		if id, ok := le.itemMap[it]; !ok || id != from {
+			return ErrKeyNotLeased
+		}
+	}
+	if err := le.unsafeCheckItems(tl, items); err != nil {
+		return err
+	}
+	le.unsafeDetach(fl, items)
+	le.unsafeAttach(tl, items)
+	return nil
+}
+
+func (le *lessor) Transfer(from, to LeaseID) error {
+	le.mu.Lock()
 	defer le.mu.Unlock()
 
+	if err := le.unsafeCheckPrimary(); err != nil {
+		return err
+	}
+	fl, tl := le.leaseMap[from], le.leaseMap[to]
+	if fl == nil || tl == nil {
+		return ErrLeaseNotFound
+	}
+	if from == to {
+		return nil
+	}
+
+	fl.mu.RLock()
+	items := make([]LeaseItem, 0, len(fl.itemSet))
+	for it := range fl.itemSet {
+		items = append(items, it)
+	}
+	fl.mu.RUnlock()
+	if err := le.unsafeCheckItems(tl, items); err != nil {
+		return err
+	}
+	le.unsafeDetach(fl, items)
+	le.unsafeAttach(tl, items)
+	return nil
+}
+
+// unsafeDetach detaches items from the lease. The caller must hold mu.
+func (le *lessor) unsafeDetach(l *Lease, items []LeaseItem) {
+	l.mu.Lock()
+	for _, it := range items {
+		delete(l.itemSet, it)
+		delete(le.itemMap, it)
+	}
+	l.mu.Unlock()
+	le.unsafeClearItemExpiry(items)
+}
+
+func (le *lessor) Recover(b backend.Backend, rd RangeDeleter) error {
+	// holding mu pauses the expiration loop until the state is rebuilt. The
+	// batch tx of the new backend is locked first, in the lock order of mu.
+	tx := b.BatchTx()
+	tx.Lock()
+	le.mu.Lock()
+	if le.closed {
+		le.unlockTx(tx)
+		return ErrLessorStopped
+	}
+
+	// end the primary term so that expired leases found from the old state,
+	// queued or already received, are recognized as stale.
+	le.unsafeDemote()
+
 	le.b = b
 	le.rd = rd
 	le.leaseMap = make(map[LeaseID]*Lease)
+	le.revoking = make(map[LeaseID]*Lease)
+	le.itemMap = make(map[LeaseItem]LeaseID)
+	le.unsafeResetItemExpiries()
+	le.heapMu.Lock()
+	le.leaseHeap = make(LeaseQueue, 0)
+	if le.wheel != nil {
+		le.wheel.reset()
+	}
+	le.heapMu.Unlock()
+	err := le.unsafeRecover(tx)
+	le.unlockTx(tx)
+	if err != nil {
+		return err
+	}
+	b.ForceCommit()
+	return nil
+}
+
+func (le *lessor) Compact() error {
+	tx := le.lockTx()
+	if le.closed {
+		le.unlockTx(tx)
+		return ErrLessorStopped
+	}
+	ks, vs := tx.UnsafeRange(le.bucketName, int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	for i, k := range ks {
+		id := LeaseID(binary.BigEndian.Uint64(k))
+		if _, ok := le.leaseMap[id]; ok {
+			continue
+		}
+		if _, ok := le.revoking[id]; ok {
+			continue
+		}
+		// keep the revoking markers of revocations in flight, so that they
+		// are still resumed after a crash.
+		var lpb leasepb.Lease
+		if err := unmarshalLease(vs[i], &lpb); err != nil || lpb.Revoking {
+			continue
+		}
+		tx.UnsafeDelete(le.bucketName, k)
+	}
+	le.unlockTx(tx)
+
+	le.b.ForceCommit()
+	return le.b.Defrag()
+}
+
+func (le *lessor) Reset() error {
+	// holding mu keeps the expiration loop out until the state is cleared.
+	tx := le.lockTx()
+	if le.closed {
+		le.unlockTx(tx)
+		return ErrLessorStopped
+	}
+	ks, _ := tx.UnsafeRange(le.bucketName, int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	for _, k := range ks {
+		tx.UnsafeDelete(le.bucketName, k)
+	}
+	tx.UnsafeDelete(le.bucketName, leaseMaxIDKey)
+
+	var removed []*Lease
+	for _, l := range le.leaseMap {
+		removed = append(removed, l)
+	}
+	for id, l := range le.revoking {
+		if le.leaseMap[id] != l {
+			removed = append(removed, l)
+		}
+	}
+	le.leaseMap = make(map[LeaseID]*Lease)
+	le.revoking = make(map[LeaseID]*Lease)
 	le.itemMap = make(map[LeaseItem]LeaseID)
-	le.initAndRecover()
+	le.unsafeResetItemExpiries()
+	le.heapMu.Lock()
+	le.leaseHeap = make(LeaseQueue, 0)
+	if le.wheel != nil {
+		le.wheel.reset()
+	}
+	le.heapMu.Unlock()
+	le.clearScheduledLeasesCheckpoints()
+	le.pendingExpired = nil
+	atomic.StoreInt64(&le.pendingExpiredCount, 0)
+	le.maxID = NoLease
+	le.unlockTx(tx)
+
+	// the concurrent revokes of the removed leases find them gone and leave
+	// their channels to be closed here.
+	for _, l := range removed {
+		close(l.revokec)
+	}
+	le.b.ForceCommit()
+	return nil
 }
 
-func (le *lessor) ExpiredLeasesC() <-chan []*Lease {
+// ExpiredLeaseBatch is a batch of expired leases found by the primary lessor.
+type ExpiredLeaseBatch struct {
+	Leases []*Lease
+	// Generation is the primary generation the leases were found under.
+	Generation uint64
+}
+
+func (le *lessor) ExpiredLeaseBatchC() <-chan ExpiredLeaseBatch {
 	return le.expiredC
 }
 
+func (le *lessor) ExpiredAck(ids []LeaseID, ok bool) {
+	if ok {
+		// delivered leases are no longer tracked
+		return
+	}
+	// hold mu exclusively so that no lease is renewed meanwhile; the retry
+	// must not replace the heap item of a renewed lease.
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if !le.isPrimary() {
+		return
+	}
+	retryAt := int64(le.clock.Elapsed() + le.expiredRetryBackoff)
+	for _, id := range ids {
+		if l := le.leaseMap[id]; l != nil && le.expired(l) {
+			le.unsafePushExpiryAt(l, retryAt)
+		}
+	}
+}
+
+func (le *lessor) ExpiredLeasesC() <-chan []*Lease {
+	le.compatExpiredOnce.Do(func() {
+		le.compatExpiredC = make(chan []*Lease)
+		go func() {
+			defer close(le.compatExpiredC)
+			for {
+				select {
+				case b, ok := <-le.expiredC:
+					if !ok {
+						return
+					}
+					select {
+					case le.compatExpiredC <- b.Leases:
+					case <-le.stopC:
+						return
+					}
+				case <-le.stopC:
+					return
+				}
+			}
+		}()
+	})
+	return le.compatExpiredC
+}
+
 func (le *lessor) Stop() {
-	close(le.stopC)
+	le.stopOnce.Do(func() { close(le.stopC) })
 	<-le.doneC
+	// wait for a scan of a custom scheduler running outside its Run; scans
+	// are the only senders on expiredC, and later ones return at once.
+	le.scanMu.Lock()
+	defer le.scanMu.Unlock()
+
+	le.mu.Lock()
+	if !le.closed {
+		close(le.expiredC)
+	}
+	le.closed = true
+	le.leaseMap = make(map[LeaseID]*Lease)
+	le.revoking = make(map[LeaseID]*Lease)
+	le.itemMap = make(map[LeaseItem]LeaseID)
+	le.unsafeResetItemExpiries()
+	le.mu.Unlock()
+}
+
+func (le *lessor) LoopHealthy() bool {
+	if le.stopped() {
+		return false
+	}
+	since := le.clock.Elapsed() - time.Duration(atomic.LoadInt64(&le.lastScan))
+	return since <= 3*leaseScanInterval
+}
+
+// LessorHealth describes the state of the expiration machinery of a lessor.
+type LessorHealth struct {
+	// Healthy is false if the lessor is stopped or has not looked for
+	// expired leases for several scan intervals, as reported by LoopHealthy.
+	Healthy bool
+	// LastScan is the local time the lessor last finished looking for
+	// expired leases at, and ScanDuration how long that took.
+	LastScan     time.Time
+	ScanDuration time.Duration
+	// PendingExpired is the number of expired lease batches waiting for the
+	// consumer of the expired lease channels.
+	PendingExpired int
+	Primary        bool
+	LeaseCount     int
+}
+
+func (le *lessor) LastScanDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&le.lastScanDuration))
+}
+
+func (le *lessor) ExpiryDropCount() uint64 {
+	return atomic.LoadUint64(&le.expiryDropCount)
+}
+
+func (le *lessor) Health() LessorHealth {
+	h := LessorHealth{
+		Healthy:        le.LoopHealthy(),
+		ScanDuration:   time.Duration(atomic.LoadInt64(&le.lastScanDuration)),
+		PendingExpired: int(atomic.LoadInt64(&le.pendingExpiredCount)) + len(le.expiredC),
+	}
+	if lastScan := atomic.LoadInt64(&le.lastScan); lastScan != 0 {
+		h.LastScan = le.now().Add(time.Duration(lastScan) - le.clock.Elapsed())
+	}
+
+	le.mu.RLock()
+	h.Primary = le.isPrimary()
+	h.LeaseCount = len(le.leaseMap)
+	le.mu.RUnlock()
+	return h
+}
+
+// LessorSnapshot is a point in time view of the lessor. It marshals to JSON.
+type LessorSnapshot struct {
+	Primary    bool            `json:"primary"`
+	LeaseCount int             `json:"leaseCount"`
+	Stats      LeaseStats      `json:"stats"`
+	Leases     []LeaseSnapshot `json:"leases"`
+}
+
+// LeaseSnapshot is a point in time view of a lease.
+type LeaseSnapshot struct {
+	ID LeaseID `json:"id"`
+	// TTL is the granted TTL in seconds.
+	TTL int64 `json:"ttl"`
+	// TimeToLive is the remaining TTL in seconds, or -1 if the expiry is not
+	// tracked.
+	TimeToLive    int64 `json:"timeToLive"`
+	ExpiryTracked bool  `json:"expiryTracked"`
+	ItemCount     int   `json:"itemCount"`
+}
+
+func (le *lessor) Snapshot() LessorSnapshot {
+	// hold mu exclusively so that no lease is renewed meanwhile
+	le.mu.Lock()
+	snap := LessorSnapshot{
+		Primary:    le.isPrimary(),
+		LeaseCount: len(le.leaseMap),
+		Leases:     make([]LeaseSnapshot, 0, len(le.leaseMap)),
+	}
+	for _, l := range le.leaseMap {
+		snap.Leases = append(snap.Leases, LeaseSnapshot{
+			ID:            l.ID,
+			TTL:           l.ttl,
+			TimeToLive:    l.TimeToLive(),
+			ExpiryTracked: l.ExpiryTracked(),
+			ItemCount:     l.ItemCount(),
+		})
+	}
+	stats, ttls := le.unsafeStats()
+	le.mu.Unlock()
+
+	stats.setPercentiles(ttls)
+	snap.Stats = stats
+
+	sort.Slice(snap.Leases, func(i, j int) bool { return snap.Leases[i].ID < snap.Leases[j].ID })
+	return snap
+}
+
+// stopped returns true if Stop has been called.
+func (le *lessor) stopped() bool {
+	select {
+	case <-le.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+func (le *lessor) runLoop() {
+	defer close(le.doneC)
+	le.scheduler.Run(le, le.stopC)
+}
+
+func (le *lessor) ScanExpired() {
+	le.scanMu.Lock()
+	defer le.scanMu.Unlock()
+	if le.stopped() {
+		return
+	}
+
+	start := le.clock.Elapsed()
+	le.revokeExpiredLeases()
+	le.expireItems()
+	le.checkpointScheduledLeases()
+
+	end := le.clock.Elapsed()
+	atomic.StoreInt64(&le.lastScanDuration, int64(end-start))
+	atomic.StoreInt64(&le.lastScan, int64(end))
+	leaseExpiryScanDuration.Observe((end - start).Seconds())
+}
+
+// revokeExpiredLeases finds all leases past their expiry and sends them to epxired channel for
+// to be revoked.
+func (le *lessor) revokeExpiredLeases() {
+	var (
+		ls  []*Lease
+		gen uint64
+	)
+
+	// rate limit
+	revokeLimit := leaseRevokeRate / 2
+
+	// only pop the expired leases under the lock, so that the time Grant
+	// waits for it does not grow with the work of assembling the batches.
+	le.mu.RLock()
+	if !le.autoRevoke && !le.frozen {
+		le.flushPendingExpired()
+	}
+	// stop looking for expired leases while the queue is full; they stay in
+	// the heap and are found again once the consumer catches up.
+	if le.isPrimary() && len(le.pendingExpired) < le.maxPendingExpiredBatches {
+		le.heapMu.Lock()
+		ls = le.appendExpiredLeases(le.expiredBuf, revokeLimit)
+		le.heapMu.Unlock()
+		gen = le.generation
+	}
+	le.mu.RUnlock()
+	if len(ls) == 0 {
+		return
+	}
+	defer le.releaseExpiredBuf(ls)
+
+	// stale heap items of renewed leases may pop before the items of leases
+	// that expired earlier, and renewed leases may pop twice.
+	sort.Stable(leasesByExpiry(ls))
+	ls = uniqueLeases(ls)
+	batches := [][]*Lease{ls}
+	if !le.autoRevoke {
+		batches = le.splitExpired(ls)
+	}
+
+	// hold the read lock while sending so that a concurrent Demote cannot
+	// miss the batch when draining expiredC. The send never blocks.
+	le.mu.RLock()
+	if !le.isPrimary() || le.generation != gen {
+		// demoted meanwhile; the leases are up to the next primary.
+		le.mu.RUnlock()
+		return
+	}
+	if le.frozen {
+		// frozen meanwhile; the leases are found again after Unfreeze.
+		le.unsafeRequeueExpired(ls)
+		le.mu.RUnlock()
+		return
+	}
+	ls = nil
+	for i := range batches {
+		batches[i] = le.unsafeStillExpired(batches[i])
+		ls = append(ls, batches[i]...)
+	}
+	le.notifyExpiryWaiters(ls)
+	if len(ls) != 0 && le.lg != nil {
+		le.lg.Debug(
+			"found expired leases",
+			zap.Int("leases", len(ls)),
+			zap.Uint64("generation", gen),
+		)
+	}
+	if !le.autoRevoke {
+		for _, batch := range batches {
+			if len(batch) != 0 {
+				le.pendingExpired = append(le.pendingExpired, ExpiredLeaseBatch{Leases: batch, Generation: gen})
+			}
+		}
+		le.flushPendingExpired()
+	}
+	le.mu.RUnlock()
+
+	if len(ls) == 0 || !le.autoRevoke {
+		return
+	}
+	var revoked []*Lease
+	for _, l := range ls {
+		if le.Generation() != gen || le.stopped() {
+			// demoted while revoking, leave the rest to the new primary; or
+			// stopped, and the backend may be closed once Stop returns.
+			break
+		}
+		err := le.RevokeExpired(l.ID)
+		if err == ErrLeaseRenewed {
+			continue
+		}
+		if err != nil && le.lg != nil {
+			le.lg.Warn(
+				"failed to revoke expired lease",
+				zap.Int64("lease-id", int64(l.ID)),
+				zap.Error(err),
+			)
+		}
+		revoked = append(revoked, l)
+	}
+	if len(revoked) != 0 {
+		le.notifyExpired(ExpiredLeaseBatch{Leases: revoked, Generation: gen})
+	}
+}
+
+// releaseExpiredBuf keeps ls for the next scan to find expired leases in. The
+// batches handed out are copied from it.
+func (le *lessor) releaseExpiredBuf(ls []*Lease) {
+	for i := range ls {
+		ls[i] = nil
+	}
+	le.expiredBuf = ls[:0]
+}
+
+// unsafeStillExpired returns the leases that are still in the lessor and
+// expired. Leases renewed or revoked since they were found expired are
+// dropped; renewed leases have been pushed to the heap again. The caller must
+// hold mu.
+func (le *lessor) unsafeStillExpired(ls []*Lease) []*Lease {
+	still := make([]*Lease, 0, len(ls))
+	for _, l := range ls {
+		if le.leaseMap[l.ID] == l && le.expired(l) {
+			still = append(still, l)
+		}
+	}
+	return still
+}
+
+// unsafeRequeueExpired pushes the heap items of leases found expired back, so
+// that they are found again. The caller must hold mu.
+func (le *lessor) unsafeRequeueExpired(ls []*Lease) {
+	le.heapMu.Lock()
+	defer le.heapMu.Unlock()
+	for _, l := range ls {
+		le.unsafePushExpiry(l)
+	}
+}
+
+// unsafePushExpiry schedules the expiry of the lease on the lease heap. The
+// heap item of the lease is updated in place if it is still queued, so that
+// renewals neither allocate nor leave stale items behind. The caller must hold
+// mu, and heapMu if mu is only read-locked.
+func (le *lessor) unsafePushExpiry(l *Lease) {
+	l.expiryMu.RLock()
+	expiry := int64(l.expiry)
+	l.expiryMu.RUnlock()
+	le.unsafePushExpiryAt(l, expiry)
+}
+
+// unsafePushExpiryAt is unsafePushExpiry scheduling the lease to be found
+// expired at the given time on clock instead of its expiry.
+func (le *lessor) unsafePushExpiryAt(l *Lease, expiry int64) {
+	if le.wheel != nil {
+		le.wheel.push(l, expiry)
+		return
+	}
+	if item := l.heapItem; item != nil && item.index >= 0 && item.index < len(le.leaseHeap) && le.leaseHeap[item.index] == item {
+		item.time = expiry
+		heap.Fix(&le.leaseHeap, item.index)
+		return
+	}
+	l.heapItem = &LeaseWithTime{id: l.ID, time: expiry}
+	heap.Push(&le.leaseHeap, l.heapItem)
+}
+
+// uniqueLeases drops all but the first occurrence of each lease.
+func uniqueLeases(ls []*Lease) []*Lease {
+	seen := make(map[LeaseID]struct{}, len(ls))
+	unique := ls[:0]
+	for _, l := range ls {
+		if _, ok := seen[l.ID]; ok {
+			continue
+		}
+		seen[l.ID] = struct{}{}
+		unique = append(unique, l)
+	}
+	return unique
 }
 
-func (le *lessor) runLoop() {
-	defer close(le.doneC)
+// splitExpired splits expired leases, the longest expired first, into batches
+// by expiredBatchSize and expiryEpsilon.
+func (le *lessor) splitExpired(ls []*Lease) [][]*Lease {
+	if le.expiredBatchSize <= 0 && le.expiryEpsilon <= 0 {
+		return [][]*Lease{ls}
+	}
+	var (
+		batches [][]*Lease
+		start   int
+		first   time.Duration
+	)
+	for i, l := range ls {
+		remaining := l.Remaining()
+		if i == start {
+			first = remaining
+			continue
+		}
+		full := le.expiredBatchSize > 0 && i-start >= le.expiredBatchSize
+		apart := le.expiryEpsilon > 0 && remaining-first > le.expiryEpsilon
+		if full || apart {
+			batches = append(batches, ls[start:i])
+			start, first = i, remaining
+		}
+	}
+	return append(batches, ls[start:])
+}
 
-	for {
-		le.revokeExpiredLeases()
-		le.checkpointScheduledLeases()
+func (le *lessor) WaitExpired(ctx context.Context, id LeaseID) error {
+	// register under the write lock so that the lease cannot be found
+	// expired between the lookup and the registration.
+	le.mu.Lock()
+	if le.closed {
+		le.mu.Unlock()
+		return ErrLessorStopped
+	}
+	l := le.leaseMap[id]
+	if l == nil {
+		le.mu.Unlock()
+		return ErrLeaseNotFound
+	}
+	ch := make(chan struct{})
+	le.waitMu.Lock()
+	le.expiryWaiters[id] = append(le.expiryWaiters[id], ch)
+	le.waitMu.Unlock()
+	le.mu.Unlock()
 
+	select {
+	case <-ch:
+		return nil
+	case <-l.revokec:
+		// the lease may be revoked right after being found expired
 		select {
-		case <-time.After(500 * time.Millisecond):
-		case <-le.stopC:
-			return
+		case <-ch:
+			return nil
+		default:
 		}
+		le.removeExpiryWaiter(id, ch)
+		return ErrLeaseNotFound
+	case <-ctx.Done():
+		le.removeExpiryWaiter(id, ch)
+		return ctx.Err()
+	case <-le.stopC:
+		le.removeExpiryWaiter(id, ch)
+		return ErrLessorStopped
 	}
 }
 
-// revokeExpiredLeases finds all leases past their expiry and sends them to epxired channel for
-// to be revoked.
-func (le *lessor) revokeExpiredLeases() {
-	var ls []*Lease
-
-	// rate limit
-	revokeLimit := leaseRevokeRate / 2
+// notifyExpiryWaiters wakes up the WaitExpired calls for the given leases.
+func (le *lessor) notifyExpiryWaiters(ls []*Lease) {
+	le.waitMu.Lock()
+	defer le.waitMu.Unlock()
+	if len(le.expiryWaiters) == 0 {
+		return
+	}
+	for _, l := range ls {
+		for _, ch := range le.expiryWaiters[l.ID] {
+			close(ch)
+		}
+		delete(le.expiryWaiters, l.ID)
+	}
+}
 
-	le.mu.RLock()
-	if le.isPrimary() {
-		ls = le.findExpiredLeases(revokeLimit)
+func (le *lessor) removeExpiryWaiter(id LeaseID, ch chan struct{}) {
+	le.waitMu.Lock()
+	defer le.waitMu.Unlock()
+	chs := le.expiryWaiters[id]
+	for i := range chs {
+		if chs[i] == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
 	}
-	le.mu.RUnlock()
+	if len(chs) == 0 {
+		delete(le.expiryWaiters, id)
+	} else {
+		le.expiryWaiters[id] = chs
+	}
+}
 
-	if len(ls) != 0 {
+// flushPendingExpired sends the queued expired lease batches to expiredC, in
+// order, until expiredC is full.
+func (le *lessor) flushPendingExpired() {
+	for len(le.pendingExpired) != 0 {
 		select {
-		case <-le.stopC:
-			return
-		case le.expiredC <- ls:
+		case le.expiredC <- le.pendingExpired[0]:
+			le.pendingExpired[0] = ExpiredLeaseBatch{}
+			le.pendingExpired = le.pendingExpired[1:]
 		default:
+			leaseExpiredBatchesBlocked.Inc()
+			atomic.StoreInt64(&le.pendingExpiredCount, int64(len(le.pendingExpired)))
 			// the receiver of expiredC is probably busy handling
 			// other stuff
 			// let's try this next time after 500ms
+			return
 		}
 	}
+	le.pendingExpired = nil
+	atomic.StoreInt64(&le.pendingExpiredCount, 0)
+}
+
+// notifyExpired sends the batch to expiredC without blocking. The batch is
+// dropped if expiredC is full, which is only used for notifications about
+// leases revoked by the lessor itself.
+func (le *lessor) notifyExpired(b ExpiredLeaseBatch) {
+	select {
+	case <-le.stopC:
+	case le.expiredC <- b:
+	default:
+		atomic.AddUint64(&le.expiryDropCount, 1)
+		leaseExpiredBatchesDropped.Inc()
+		// the receiver of expiredC is probably busy handling
+		// other stuff
+	}
 }
 
 // checkpointScheduledLeases finds all scheduled lease checkpoints that are due and
@@ -638,6 +3499,9 @@ func (le *lessor) clearScheduledLeasesCheckpoints() {
 // It pops only when expiry item exists.
 // "next" is true, to indicate that it may exist in next attempt.
 func (le *lessor) expireExists() (l *Lease, ok bool, next bool) {
+	if le.wheel != nil {
+		return le.expireExistsInWheel()
+	}
 	if le.leaseHeap.Len() == 0 {
 		return nil, false, false
 	}
@@ -651,7 +3515,7 @@ func (le *lessor) expireExists() (l *Lease, ok bool, next bool) {
 		return nil, false, true
 	}
 
-	if time.Now().UnixNano() < item.time /* expiration time */ {
+	if int64(le.clock.Elapsed()-le.expiryGrace) < item.time /* expiration time */ {
 		// Candidate expirations are caught up, reinsert this item
 		// and no need to revoke (nothing is expiry)
 		return l, false, false
@@ -662,10 +3526,44 @@ func (le *lessor) expireExists() (l *Lease, ok bool, next bool) {
 	return l, true, false
 }
 
+// expireExistsInWheel is expireExists for leases scheduled in the wheel.
+func (le *lessor) expireExistsInWheel() (l *Lease, ok bool, next bool) {
+	l, expiry, ok := le.wheel.peek()
+	if !ok {
+		return nil, false, false
+	}
+	if le.leaseMap[l.ID] != l {
+		// revoked since scheduled
+		le.wheel.pop()
+		return nil, false, true
+	}
+	if int64(le.clock.Elapsed()-le.expiryGrace) < expiry {
+		return l, false, false
+	}
+	le.wheel.pop()
+	return l, true, false
+}
+
+// expired returns true if the lease has been expired for longer than the
+// expiry grace.
+func (le *lessor) expired(l *Lease) bool {
+	return l.Remaining() <= -le.expiryGrace
+}
+
 // findExpiredLeases loops leases in the leaseMap until reaching expired limit
-// and returns the expired leases that needed to be revoked.
+// and returns the expired leases that needed to be revoked, in the order their
+// heap items pop.
 func (le *lessor) findExpiredLeases(limit int) []*Lease {
-	leases := make([]*Lease, 0, 16)
+	return le.appendExpiredLeases(nil, limit)
+}
+
+// appendExpiredLeases is findExpiredLeases appending to leases, so that
+// scans can reuse it.
+func (le *lessor) appendExpiredLeases(leases []*Lease, limit int) []*Lease {
+	if le.frozen {
+		return leases
+	}
+	limit += len(leases)
 
 	for {
 		l, ok, next := le.expireExists()
@@ -679,7 +3577,7 @@ func (le *lessor) findExpiredLeases(limit int) []*Lease {
 			continue
 		}
 
-		if l.expired() {
+		if le.expired(l) {
 			leases = append(leases, l)
 
 			// reach expired limit
@@ -688,7 +3586,6 @@ func (le *lessor) findExpiredLeases(limit int) []*Lease {
 			}
 		}
 	}
-
 	return leases
 }
 
@@ -706,7 +3603,7 @@ func (le *lessor) scheduleCheckpointIfNeeded(lease *Lease) {
 		}
 		heap.Push(&le.leaseCheckpointHeap, &LeaseWithTime{
 			id:   lease.ID,
-			time: time.Now().Add(le.checkpointInterval).UnixNano(),
+			time: int64(le.clock.Elapsed() + le.checkpointInterval),
 		})
 	}
 }
@@ -716,11 +3613,11 @@ func (le *lessor) findDueScheduledCheckpoints(checkpointLimit int) []*pb.LeaseCh
 		return nil
 	}
 
-	now := time.Now()
+	now := le.clock.Elapsed()
 	cps := []*pb.LeaseCheckpoint{}
 	for le.leaseCheckpointHeap.Len() > 0 && len(cps) < checkpointLimit {
 		lt := le.leaseCheckpointHeap[0]
-		if lt.time /* next checkpoint time */ > now.UnixNano() {
+		if lt.time /* next checkpoint time */ > int64(now) {
 			return cps
 		}
 		heap.Pop(&le.leaseCheckpointHeap)
@@ -729,10 +3626,14 @@ func (le *lessor) findDueScheduledCheckpoints(checkpointLimit int) []*pb.LeaseCh
 		if l, ok = le.leaseMap[lt.id]; !ok {
 			continue
 		}
-		if !now.Before(l.expiry) {
+		l.expiryMu.RLock()
+		expiry, tracked := l.expiry, l.tracked
+		l.expiryMu.RUnlock()
+		// a lease without deadline has no remaining TTL to checkpoint
+		if !tracked || now >= expiry {
 			continue
 		}
-		remainingTTL := int64(math.Ceil(l.expiry.Sub(now).Seconds()))
+		remainingTTL := remainingSeconds(expiry - now)
 		if remainingTTL >= l.ttl {
 			continue
 		}
@@ -747,49 +3648,231 @@ func (le *lessor) findDueScheduledCheckpoints(checkpointLimit int) []*pb.LeaseCh
 	return cps
 }
 
-func (le *lessor) initAndRecover() {
-	tx := le.b.BatchTx()
-	tx.Lock()
+// persistedTTL returns the TTL of a persisted lease raised to the minimum, in
+// seconds and, for leases granted with sub-second precision, as a duration.
+func (le *lessor) persistedTTL(lpb *leasepb.Lease) (int64, time.Duration) {
+	ttl, ttlDuration := lpb.TTL, time.Duration(lpb.TTLNanos)
+	if lpb.Permanent {
+		// no TTL to floor
+	} else if ttlDuration != 0 {
+		ttlDuration, ttl = le.floorTTLDuration(ttlDuration)
+	} else if ttl < le.minLeaseTTL {
+		ttl = le.minLeaseTTL
+	}
+	return ttl, ttlDuration
+}
 
-	tx.UnsafeCreateBucket(leaseBucketName)
-	_, vs := tx.UnsafeRange(leaseBucketName, int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
-	// TODO: copy vs and do decoding outside tx lock if lock contention becomes an issue.
+// unmarshalLease decodes a persisted lease record into lpb. It returns a
+// RecordVersionError for records of an unsupported version.
+func unmarshalLease(val []byte, lpb *leasepb.Lease) error {
+	if err := lpb.Unmarshal(val); err != nil {
+		return err
+	}
+	switch lpb.Version {
+	case 0, leaseRecordVersion:
+		// the first version only marks records written by releases that
+		// check the version; the layout is unchanged.
+		return nil
+	default:
+		return &RecordVersionError{ID: LeaseID(lpb.ID), Version: lpb.Version}
+	}
+}
+
+// unsafeMigrate rewrites the lease records of a version older than
+// leaseRecordVersion in the current layout, once per bucket as recorded by
+// leaseSchemaKey. The records and the key are written in the same batch
+// transaction, so an interrupted migration is run again from the start.
+// The caller must hold the lock of tx.
+func (le *lessor) unsafeMigrate(tx backend.BatchTx) error {
+	schema := uint32(0)
+	if _, vs := tx.UnsafeRange(le.bucketName, leaseSchemaKey, nil, 0); len(vs) != 0 {
+		schema = binary.BigEndian.Uint32(vs[0])
+	}
+	if schema > leaseRecordVersion {
+		return &RecordVersionError{Version: schema}
+	}
+	if schema == leaseRecordVersion {
+		return nil
+	}
+
+	ks, vs := tx.UnsafeRange(le.bucketName, int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	migrated := 0
 	for i := range vs {
 		var lpb leasepb.Lease
-		err := lpb.Unmarshal(vs[i])
+		if err := unmarshalLease(vs[i], &lpb); err != nil {
+			return err
+		}
+		if lpb.Version == leaseRecordVersion {
+			continue
+		}
+		// version 0 shares the layout of the current version
+		lpb.Version = leaseRecordVersion
+		val, err := lpb.Marshal()
 		if err != nil {
-			tx.Unlock()
-			panic("failed to unmarshal lease proto item")
+			return err
+		}
+		tx.UnsafePut(le.bucketName, ks[i], val)
+		migrated++
+	}
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], leaseRecordVersion)
+	tx.UnsafePut(le.bucketName, leaseSchemaKey, v[:])
+
+	if migrated != 0 && le.lg != nil {
+		le.lg.Info(
+			"migrated lease records",
+			zap.String("bucket", string(le.bucketName)),
+			zap.Uint32("from-version", schema),
+			zap.Uint32("to-version", leaseRecordVersion),
+			zap.Int("records", migrated),
+		)
+	}
+	return nil
+}
+
+func (le *lessor) MaxLeaseID() LeaseID {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	return le.maxID
+}
+
+// unsafeRaiseMaxID raises maxID to id, if higher, and persists it. The caller
+// must hold mu and the lock of tx.
+func (le *lessor) unsafeRaiseMaxID(tx backend.BatchTx, id LeaseID) {
+	if id <= le.maxID {
+		return
+	}
+	le.maxID = id
+	tx.UnsafePut(le.bucketName, leaseMaxIDKey, int64ToBytes(int64(id)))
+}
+
+// lockTx locks the batch tx of the backend and then mu, in the lock order of
+// mu, and returns the batch tx. unlockTx releases both.
+func (le *lessor) lockTx() backend.BatchTx {
+	for {
+		le.mu.RLock()
+		b := le.b
+		le.mu.RUnlock()
+
+		tx := b.BatchTx()
+		tx.Lock()
+		le.mu.Lock()
+		if le.b == b {
+			return tx
+		}
+		// recovered from another backend meanwhile
+		le.mu.Unlock()
+		tx.Unlock()
+	}
+}
+
+func (le *lessor) unlockTx(tx backend.BatchTx) {
+	le.mu.Unlock()
+	tx.Unlock()
+}
+
+// unsafeRecover recovers the leases from the backend. It returns an error,
+// and leaves the leases recovered so far, if a record cannot be decoded. The
+// caller must hold the lock of tx, the batch tx of the backend, and mu if the
+// lessor is running.
+func (le *lessor) unsafeRecover(tx backend.BatchTx) error {
+	tx.UnsafeCreateBucket(le.bucketName)
+	if err := le.unsafeMigrate(tx); err != nil {
+		return err
+	}
+	le.maxID = NoLease
+	if _, vs := tx.UnsafeRange(le.bucketName, leaseMaxIDKey, nil, 0); len(vs) != 0 {
+		le.maxID = LeaseID(binary.BigEndian.Uint64(vs[0]))
+	}
+	_, vs := tx.UnsafeRange(le.bucketName, int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	// TODO: copy vs and do decoding outside tx lock if lock contention becomes an issue.
+	recoveredAt := le.now()
+	for i := range vs {
+		var lpb leasepb.Lease
+		if err := unmarshalLease(vs[i], &lpb); err != nil {
+			return err
 		}
 		ID := LeaseID(lpb.ID)
-		if lpb.TTL < le.minLeaseTTL {
-			lpb.TTL = le.minLeaseTTL
-		}
-		le.leaseMap[ID] = &Lease{
-			ID:  ID,
-			ttl: lpb.TTL,
-			// itemSet will be filled in when recover key-value pairs
-			// set expiry to forever, refresh when promoted
+		ttl, ttlDuration := le.persistedTTL(&lpb)
+		l := &Lease{
+			ID:          ID,
+			ttl:         ttl,
+			ttlDuration: ttlDuration,
+			grantedAt:   recoveredAt,
+			retainKeys:  lpb.RetainKeys,
+			permanent:   lpb.Permanent,
+			revoking:    lpb.Revoking,
+			// itemSet will be filled in by Reattach when the KV store
+			// recovers its keys
+			// the expiry is tracked once promoted
 			itemSet: make(map[LeaseItem]struct{}),
-			expiry:  forever,
 			revokec: make(chan struct{}),
+			clock:   le.clock,
+			grid:    le.expiryGranularity,
 		}
+		if ID > le.maxID {
+			// granted before the max ID was persisted
+			le.maxID = ID
+		}
+		if l.revoking {
+			le.revoking[ID] = l
+			continue
+		}
+		le.leaseMap[ID] = l
 	}
 	heap.Init(&le.leaseHeap)
 	heap.Init(&le.leaseCheckpointHeap)
-	tx.Unlock()
-
-	le.b.ForceCommit()
+	return nil
 }
 
+// Lease is a lease of the lessor. The lessor keeps updating the leases it
+// hands out, e.g. in expired batches, so their fields must only be read
+// through the exported methods, which are safe for concurrent use.
 type Lease struct {
-	ID           LeaseID
-	ttl          int64 // time to live of the lease in seconds
-	remainingTTL int64 // remaining time to live in seconds, if zero valued it is considered unset and the full ttl should be used
-	// expiryMu protects concurrent accesses to expiry
+	ID  LeaseID
+	ttl int64 // time to live of the lease in seconds
+	// remainingTTL is the remaining time to live in seconds, if zero valued it
+	// is considered unset and the full ttl should be used.
+	remainingTTL int64
+	// ttlDuration is the time to live of leases granted with sub-second
+	// precision. It is zero for leases granted in seconds.
+	//
+	// ttl, remainingTTL and ttlDuration are written under both mu of the
+	// lessor and expiryMu.
+	ttlDuration time.Duration
+	// grantedAt is the local time the lease was granted at. Members apply the
+	// grant at slightly different times, so it may differ among them and is
+	// not persisted; recovered leases take the time of their recovery.
+	grantedAt time.Time
+	// retainKeys is set if the attached keys are kept when the lease is revoked.
+	retainKeys bool
+	// permanent is set if the lease never expires.
+	permanent bool
+	// revoking is set once the lease is being revoked.
+	revoking bool
+	// held is set while the lease is stopped from expiring by Hold. It is
+	// protected by mu of the lessor.
+	held bool
+	// expiryMu protects concurrent accesses to expiry and the TTLs
 	expiryMu sync.RWMutex
-	// expiry is time when lease should expire. no expiration when expiry.IsZero() is true
-	expiry time.Time
+	// expiry is the time on clock when lease should expire, if tracked.
+	expiry time.Duration
+	// tracked is set while the expiry of the lease is tracked, which only
+	// the primary does for leases neither held nor permanent.
+	tracked bool
+	// lastRenewed is the time on clock expiry was last refreshed at
+	lastRenewed time.Duration
+	// clock is the clock of the lessor the lease belongs to
+	clock clock
+	// grid is the granularity expiry is rounded up to, if set.
+	grid time.Duration
+	// heapItem is the latest item of the lease pushed to the lease heap. It
+	// is protected by the heap lock of the lessor.
+	heapItem *LeaseWithTime
+	// slot is the slot of the expiry wheel the lease is scheduled in, at
+	// slotIndex. Both are protected by the heap lock of the lessor.
+	slot      *expirySlot
+	slotIndex int
 
 	// mu protects concurrent accesses to itemSet
 	mu      sync.RWMutex
@@ -797,32 +3880,86 @@ type Lease struct {
 	revokec chan struct{}
 }
 
-func (l *Lease) expired() bool {
-	return l.Remaining() <= 0
+// pinned returns true if the lease does not expire, either permanently or
+// while held. The caller must hold mu of the lessor.
+func (l *Lease) pinned() bool {
+	return l.permanent || l.held
 }
 
-func (l *Lease) persistTo(b backend.Backend) {
+// unsafePersistTo writes the lease to bucket. The caller must hold the lock
+// of tx.
+func (l *Lease) unsafePersistTo(tx backend.BatchTx, bucket []byte) {
 	key := int64ToBytes(int64(l.ID))
 
-	lpb := leasepb.Lease{ID: int64(l.ID), TTL: l.ttl, RemainingTTL: l.remainingTTL}
+	lpb := l.proto()
 	val, err := lpb.Marshal()
 	if err != nil {
 		panic("failed to marshal lease proto item")
 	}
+	tx.UnsafePut(bucket, key, val)
+}
+
+// proto returns the persisted form of the lease.
+func (l *Lease) proto() leasepb.Lease {
+	lpb := leasepb.Lease{
+		ID:           int64(l.ID),
+		TTL:          l.ttl,
+		RemainingTTL: l.remainingTTL,
+		RetainKeys:   l.retainKeys,
+		TTLNanos:     int64(l.ttlDuration),
+		Permanent:    l.permanent,
+		Revoking:     l.revoking,
+		Version:      leaseRecordVersion,
+	}
+	return lpb
+}
 
-	b.BatchTx().Lock()
-	b.BatchTx().UnsafePut(leaseBucketName, key, val)
-	b.BatchTx().Unlock()
+// removeFrom deletes the lease from the given bucket. The caller must hold
+// the lock of tx.
+func (l *Lease) removeFrom(tx backend.BatchTx, bucket []byte) {
+	tx.UnsafeDelete(bucket, int64ToBytes(int64(l.ID)))
 }
 
 // TTL returns the TTL of the Lease.
 func (l *Lease) TTL() int64 {
+	l.expiryMu.RLock()
+	defer l.expiryMu.RUnlock()
 	return l.ttl
 }
 
+// TTLDuration returns the TTL of the lease with the precision it was granted
+// with.
+func (l *Lease) TTLDuration() time.Duration {
+	l.expiryMu.RLock()
+	defer l.expiryMu.RUnlock()
+	if l.ttlDuration != 0 {
+		return l.ttlDuration
+	}
+	return secondsToDuration(l.ttl)
+}
+
+// RetainKeys returns true if the keys attached to the lease are kept when it
+// is revoked.
+func (l *Lease) RetainKeys() bool {
+	return l.retainKeys
+}
+
+// Permanent returns true if the lease never expires.
+func (l *Lease) Permanent() bool {
+	return l.permanent
+}
+
+// GrantedAt returns the local time the lease was granted at, or recovered at
+// if recovered from the backend.
+func (l *Lease) GrantedAt() time.Time {
+	return l.grantedAt
+}
+
 // RemainingTTL returns the last checkpointed remaining TTL of the lease.
 // TODO(jpbetz): do not expose this utility method
 func (l *Lease) RemainingTTL() int64 {
+	l.expiryMu.RLock()
+	defer l.expiryMu.RUnlock()
 	if l.remainingTTL > 0 {
 		return l.remainingTTL
 	}
@@ -831,17 +3968,108 @@ func (l *Lease) RemainingTTL() int64 {
 
 // refresh refreshes the expiry of the lease.
 func (l *Lease) refresh(extend time.Duration) {
-	newExpiry := time.Now().Add(extend + time.Duration(l.RemainingTTL())*time.Second)
+	remaining := l.TTLDuration()
+	if l.remainingTTL > 0 {
+		remaining = secondsToDuration(l.remainingTTL)
+	}
+	now := l.clock.Elapsed()
+	newExpiry := l.roundExpiry(addDuration(addDuration(now, extend), remaining))
 	l.expiryMu.Lock()
 	defer l.expiryMu.Unlock()
 	l.expiry = newExpiry
+	l.tracked = true
+	l.lastRenewed = now
+}
+
+// refreshRemaining sets the expiry of the lease to the given remaining time from now.
+func (l *Lease) refreshRemaining(remaining time.Duration) {
+	now := l.clock.Elapsed()
+	l.expiryMu.Lock()
+	defer l.expiryMu.Unlock()
+	l.expiry = l.roundExpiry(addDuration(now, remaining))
+	l.tracked = true
+	l.lastRenewed = now
+}
+
+// secondsToDuration converts seconds to a duration, saturating at forever for
+// TTLs too large to be represented.
+func secondsToDuration(sec int64) time.Duration {
+	if sec > int64(forever/time.Second) {
+		return forever
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// addDuration adds d to t, saturating at forever instead of overflowing.
+func addDuration(t, d time.Duration) time.Duration {
+	if d > 0 && t > forever-d {
+		return forever
+	}
+	return t + d
+}
+
+// roundExpiry rounds expiry up to the grid of the lease.
+func (l *Lease) roundExpiry(expiry time.Duration) time.Duration {
+	if l.grid <= 0 {
+		return expiry
+	}
+	if r := expiry % l.grid; r > 0 {
+		expiry = addDuration(expiry, l.grid-r)
+	} else if r < 0 {
+		expiry -= r
+	}
+	return expiry
+}
+
+// sinceRenewed returns the time elapsed since the expiry of the lease was
+// last refreshed. ok is false if the lease has no deadline.
+func (l *Lease) sinceRenewed() (since time.Duration, ok bool) {
+	l.expiryMu.RLock()
+	defer l.expiryMu.RUnlock()
+	if !l.tracked {
+		return 0, false
+	}
+	return l.clock.Elapsed() - l.lastRenewed, true
 }
 
-// forever sets the expiry of lease to be forever.
-func (l *Lease) forever() {
+// untrack stops tracking the expiry of the lease.
+func (l *Lease) untrack() {
 	l.expiryMu.Lock()
 	defer l.expiryMu.Unlock()
-	l.expiry = forever
+	l.expiry = 0
+	l.tracked = false
+}
+
+// copy returns a copy of the lease for callers that must not modify the
+// lease itself.
+func (l *Lease) copy() *Lease {
+	l.expiryMu.RLock()
+	c := &Lease{
+		ID:           l.ID,
+		ttl:          l.ttl,
+		remainingTTL: l.remainingTTL,
+		ttlDuration:  l.ttlDuration,
+		grantedAt:    l.grantedAt,
+		retainKeys:   l.retainKeys,
+		permanent:    l.permanent,
+		revoking:     l.revoking,
+		held:         l.held,
+		expiry:       l.expiry,
+		tracked:      l.tracked,
+		lastRenewed:  l.lastRenewed,
+		clock:        l.clock,
+		grid:         l.grid,
+		revokec:      l.revokec,
+	}
+	l.expiryMu.RUnlock()
+
+	l.mu.RLock()
+	c.itemSet = make(map[LeaseItem]struct{}, len(l.itemSet))
+	for it := range l.itemSet {
+		c.itemSet[it] = struct{}{}
+	}
+	l.mu.RUnlock()
+	return c
 }
 
 // Keys returns all the keys attached to the lease.
@@ -855,14 +4083,72 @@ func (l *Lease) Keys() []string {
 	return keys
 }
 
-// Remaining returns the remaining time of the lease.
+// LeaseGrantResult describes a granted lease by value, so that it can be put
+// on the wire, e.g. in a raft entry or an RPC response.
+type LeaseGrantResult struct {
+	ID LeaseID `json:"id"`
+	// TTL is the granted TTL in seconds, raised to the minimum TTL if below.
+	TTL int64 `json:"ttl"`
+	// ExpirySeconds is the time in seconds the lease effectively expires
+	// after, which is below TTL if the lease reaches its maximum lifetime
+	// earlier. It is -1 if the lease has no deadline.
+	ExpirySeconds int64 `json:"expirySeconds"`
+}
+
+// GrantResult returns the lease as granted, for Grant callers.
+func (l *Lease) GrantResult() LeaseGrantResult {
+	r := LeaseGrantResult{ID: l.ID, TTL: l.TTL(), ExpirySeconds: -1}
+	if remaining, ok := l.remaining(); ok {
+		r.ExpirySeconds = remainingSeconds(remaining)
+	}
+	return r
+}
+
+// ItemCount returns the number of items attached to the lease.
+func (l *Lease) ItemCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.itemSet)
+}
+
+// TimeToLive returns the remaining time to live of the lease in seconds,
+// rounded up. It returns -1 if the lease has no deadline, which is the case
+// when the lessor is not the primary.
+func (l *Lease) TimeToLive() int64 {
+	remaining, ok := l.remaining()
+	if !ok {
+		return -1
+	}
+	return remainingSeconds(remaining)
+}
+
+// Remaining returns the remaining time of the lease, or the maximum duration
+// if its expiry is not tracked.
 func (l *Lease) Remaining() time.Duration {
+	remaining, ok := l.remaining()
+	if !ok {
+		return forever
+	}
+	return remaining
+}
+
+// ExpiryTracked returns true if the lessor tracks the expiry of the lease,
+// which is the case on the primary for leases neither held nor permanent.
+func (l *Lease) ExpiryTracked() bool {
+	l.expiryMu.RLock()
+	defer l.expiryMu.RUnlock()
+	return l.tracked
+}
+
+// remaining returns the remaining time of the lease. ok is false if its
+// expiry is not tracked.
+func (l *Lease) remaining() (remaining time.Duration, ok bool) {
 	l.expiryMu.RLock()
 	defer l.expiryMu.RUnlock()
-	if l.expiry.IsZero() {
-		return time.Duration(math.MaxInt64)
+	if !l.tracked {
+		return 0, false
 	}
-	return time.Until(l.expiry)
+	return l.expiry - l.clock.Elapsed(), true
 }
 
 type LeaseItem struct {
@@ -883,29 +4169,161 @@ func (fl *FakeLessor) SetRangeDeleter(dr RangeDeleter) {}
 
 func (fl *FakeLessor) SetCheckpointer(cp Checkpointer) {}
 
+func (fl *FakeLessor) SetPrimaryHint(primary string) {}
+
+func (fl *FakeLessor) SetPrimaryLeader(memberID uint64) {}
+
 func (fl *FakeLessor) Grant(id LeaseID, ttl int64) (*Lease, error) { return nil, nil }
 
+func (fl *FakeLessor) GrantDuration(id LeaseID, ttl time.Duration) (*Lease, error) {
+	return nil, nil
+}
+
+func (fl *FakeLessor) GrantWithOptions(id LeaseID, ttl int64, opts GrantOptions) (*Lease, error) {
+	return nil, nil
+}
+
+func (fl *FakeLessor) GrantPermanent(id LeaseID) (*Lease, error) { return nil, nil }
+
 func (fl *FakeLessor) Revoke(id LeaseID) error { return nil }
 
+func (fl *FakeLessor) RevokeExpired(id LeaseID) error { return nil }
+
+func (fl *FakeLessor) RevokeWithDeleted(id LeaseID) ([]string, error) { return nil, nil }
+
+func (fl *FakeLessor) RevokeSync(id LeaseID) error { return nil }
+
+func (fl *FakeLessor) RevokeByKey(key []byte) (LeaseID, error) { return NoLease, nil }
+
+func (fl *FakeLessor) RevokeIdempotent(id LeaseID) error { return nil }
+
+func (fl *FakeLessor) RevokeByPrefix(prefix uint8) (int, error) { return 0, nil }
+
+func (fl *FakeLessor) RevokePreview(id LeaseID) ([]string, error) { return nil, nil }
+
+func (fl *FakeLessor) ItemCount(id LeaseID) (int, error) { return 0, nil }
+
+func (fl *FakeLessor) ResumeRevokes() int { return 0 }
+
+func (fl *FakeLessor) RefreshFromBackend(id LeaseID) error { return nil }
+
 func (fl *FakeLessor) Checkpoint(id LeaseID, remainingTTL int64) error { return nil }
 
 func (fl *FakeLessor) Attach(id LeaseID, items []LeaseItem) error { return nil }
 
+func (fl *FakeLessor) AttachWithOptions(id LeaseID, items []LeaseItem, opts AttachOptions) error {
+	return nil
+}
+
+func (fl *FakeLessor) AttachBatch(items map[LeaseID][]LeaseItem) error { return nil }
+
+func (fl *FakeLessor) Reattach(items map[LeaseID][]LeaseItem) []LeaseID { return nil }
+
 func (fl *FakeLessor) GetLease(item LeaseItem) LeaseID            { return 0 }
 func (fl *FakeLessor) Detach(id LeaseID, items []LeaseItem) error { return nil }
 
-func (fl *FakeLessor) Promote(extend time.Duration) {}
+func (fl *FakeLessor) DetachKey(key []byte) (LeaseID, error) { return NoLease, nil }
+
+func (fl *FakeLessor) DetachAll(id LeaseID) (int, error) { return 0, nil }
+
+func (fl *FakeLessor) DetachBatch(items map[LeaseID][]LeaseItem) error { return nil }
+
+func (fl *FakeLessor) TransferItems(from, to LeaseID, items []LeaseItem) error { return nil }
+
+func (fl *FakeLessor) Transfer(from, to LeaseID) error { return nil }
+
+func (fl *FakeLessor) Promote(extend time.Duration) error { return nil }
+
+func (fl *FakeLessor) PromoteWithHandoff(extend time.Duration, state []LeaseHandoff) error {
+	return nil
+}
+
+func (fl *FakeLessor) HandoffState() []LeaseHandoff { return nil }
+
+func (fl *FakeLessor) Demote() error { return nil }
+
+func (fl *FakeLessor) OnPrimaryChange(f func(primary bool)) {}
+
+func (fl *FakeLessor) Freeze() {}
+
+func (fl *FakeLessor) LoopHealthy() bool { return true }
 
-func (fl *FakeLessor) Demote() {}
+func (fl *FakeLessor) Health() LessorHealth { return LessorHealth{Healthy: true} }
+
+func (fl *FakeLessor) ExpiryDropCount() uint64 { return 0 }
+
+func (fl *FakeLessor) LastScanDuration() time.Duration { return 0 }
+
+func (fl *FakeLessor) MaxLeaseID() LeaseID { return NoLease }
+
+func (fl *FakeLessor) ScanExpired() {}
+
+func (fl *FakeLessor) CountByTTLRange(minTTL, maxTTL int64) int { return 0 }
+
+func (fl *FakeLessor) Unfreeze() {}
+
+func (fl *FakeLessor) Hold(id LeaseID) error { return nil }
+
+func (fl *FakeLessor) Release(id LeaseID) error { return nil }
+
+func (fl *FakeLessor) Generation() uint64 { return 0 }
+
+func (fl *FakeLessor) IsPrimary() bool { return false }
+
+func (fl *FakeLessor) PrimaryGeneration() uint64 { return 0 }
 
 func (fl *FakeLessor) Renew(id LeaseID) (int64, error) { return 10, nil }
 
+func (fl *FakeLessor) RenewIfBelow(id LeaseID, threshold time.Duration) (bool, int64, error) {
+	return true, 10, nil
+}
+
+func (fl *FakeLessor) RenewBatch(ids []LeaseID) ([]int64, []error) {
+	ttls := make([]int64, len(ids))
+	for i := range ttls {
+		ttls[i] = 10
+	}
+	return ttls, make([]error, len(ids))
+}
+
 func (fl *FakeLessor) Lookup(id LeaseID) *Lease { return nil }
 
+func (fl *FakeLessor) LeaseInfo(id LeaseID, keyLimit int) (LeaseInfo, error) {
+	return LeaseInfo{}, nil
+}
+
+func (fl *FakeLessor) ExpiryTime(id LeaseID) (time.Time, error) { return time.Time{}, nil }
+
 func (fl *FakeLessor) Leases() []*Lease { return nil }
 
+func (fl *FakeLessor) ForEachLease(fn func(*Lease) bool) {}
+
+func (fl *FakeLessor) Snapshot() LessorSnapshot { return LessorSnapshot{} }
+
+func (fl *FakeLessor) TopLeasesByItems(n int) []*Lease { return nil }
+
+func (fl *FakeLessor) StaleLeases(olderThan time.Duration) []LeaseID { return nil }
+
+func (fl *FakeLessor) ExpiringWithin(d time.Duration) []*Lease { return nil }
+
+func (fl *FakeLessor) Stats() LeaseStats { return LeaseStats{} }
+
 func (fl *FakeLessor) ExpiredLeasesC() <-chan []*Lease { return nil }
 
-func (fl *FakeLessor) Recover(b backend.Backend, rd RangeDeleter) {}
+func (fl *FakeLessor) ExpiredLeaseBatchC() <-chan ExpiredLeaseBatch { return nil }
+
+func (fl *FakeLessor) ExpiredAck(ids []LeaseID, ok bool) {}
+
+func (fl *FakeLessor) WaitExpired(ctx context.Context, id LeaseID) error { return nil }
+
+func (fl *FakeLessor) Compact() error { return nil }
+
+func (fl *FakeLessor) Reset() error { return nil }
+
+func (fl *FakeLessor) WriteTo(w io.Writer) (int64, error) { return 0, nil }
+
+func (fl *FakeLessor) ReadFrom(r io.Reader) (int64, error) { return 0, nil }
+
+func (fl *FakeLessor) Recover(b backend.Backend, rd RangeDeleter) error { return nil }
 
 func (fl *FakeLessor) Stop() {}
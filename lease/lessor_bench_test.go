@@ -16,7 +16,9 @@ package lease
 
 import (
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"go.etcd.io/etcd/v3/mvcc/backend"
 	"go.uber.org/zap"
@@ -38,6 +40,17 @@ func BenchmarkLessorGrant10000(b *testing.B)   { benchmarkLessorGrant(10000, b)
 func BenchmarkLessorGrant100000(b *testing.B)  { benchmarkLessorGrant(100000, b) }
 func BenchmarkLessorGrant1000000(b *testing.B) { benchmarkLessorGrant(1000000, b) }
 
+func BenchmarkLessorGrantHeap100000(b *testing.B)  { benchmarkLessorGrantConfig(100000, granularCfg, b) }
+func BenchmarkLessorGrantWheel100000(b *testing.B) { benchmarkLessorGrantConfig(100000, wheelCfg, b) }
+
+func BenchmarkLessorScanExpired1000(b *testing.B)   { benchmarkLessorScanExpired(1000, b) }
+func BenchmarkLessorScanExpired100000(b *testing.B) { benchmarkLessorScanExpired(100000, b) }
+
+func BenchmarkLessorExpireHeap100000(b *testing.B)  { benchmarkLessorExpire(100000, granularCfg, b) }
+func BenchmarkLessorExpireWheel100000(b *testing.B) { benchmarkLessorExpire(100000, wheelCfg, b) }
+
+func BenchmarkLessorGrantDuringExpiry50000(b *testing.B) { benchmarkLessorGrantDuringExpiry(50000, b) }
+
 func BenchmarkLessorRenew1(b *testing.B)       { benchmarkLessorRenew(1, b) }
 func BenchmarkLessorRenew10(b *testing.B)      { benchmarkLessorRenew(10, b) }
 func BenchmarkLessorRenew100(b *testing.B)     { benchmarkLessorRenew(100, b) }
@@ -46,6 +59,17 @@ func BenchmarkLessorRenew10000(b *testing.B)   { benchmarkLessorRenew(10000, b)
 func BenchmarkLessorRenew100000(b *testing.B)  { benchmarkLessorRenew(100000, b) }
 func BenchmarkLessorRenew1000000(b *testing.B) { benchmarkLessorRenew(1000000, b) }
 
+func BenchmarkLessorRenewHeap100000(b *testing.B)  { benchmarkLessorRenewConfig(100000, granularCfg, b) }
+func BenchmarkLessorRenewWheel100000(b *testing.B) { benchmarkLessorRenewConfig(100000, wheelCfg, b) }
+
+func BenchmarkLessorRenewParallel1000(b *testing.B)  { benchmarkLessorRenewParallel(1000, b) }
+func BenchmarkLessorRenewParallel10000(b *testing.B) { benchmarkLessorRenewParallel(10000, b) }
+
+func BenchmarkLessorRenewBatch1(b *testing.B)    { benchmarkLessorRenewBatch(1, b) }
+func BenchmarkLessorRenewBatch10(b *testing.B)   { benchmarkLessorRenewBatch(10, b) }
+func BenchmarkLessorRenewBatch100(b *testing.B)  { benchmarkLessorRenewBatch(100, b) }
+func BenchmarkLessorRenewBatch1000(b *testing.B) { benchmarkLessorRenewBatch(1000, b) }
+
 func BenchmarkLessorRevoke1(b *testing.B)       { benchmarkLessorRevoke(1, b) }
 func BenchmarkLessorRevoke10(b *testing.B)      { benchmarkLessorRevoke(10, b) }
 func BenchmarkLessorRevoke100(b *testing.B)     { benchmarkLessorRevoke(100, b) }
@@ -54,6 +78,18 @@ func BenchmarkLessorRevoke10000(b *testing.B)   { benchmarkLessorRevoke(10000, b
 func BenchmarkLessorRevoke100000(b *testing.B)  { benchmarkLessorRevoke(100000, b) }
 func BenchmarkLessorRevoke1000000(b *testing.B) { benchmarkLessorRevoke(1000000, b) }
 
+func BenchmarkLessorAttach10(b *testing.B)       { benchmarkLessorAttach(10, b) }
+func BenchmarkLessorAttach100(b *testing.B)      { benchmarkLessorAttach(100, b) }
+func BenchmarkLessorAttachBatch10(b *testing.B)  { benchmarkLessorAttachBatch(10, b) }
+func BenchmarkLessorAttachBatch100(b *testing.B) { benchmarkLessorAttachBatch(100, b) }
+
+var (
+	// granularCfg schedules expiries on the lease heap at the
+	// granularity wheelCfg schedules them on the expiry wheel.
+	granularCfg = LessorConfig{MinLeaseTTL: minLeaseTTL, ExpiryGranularity: time.Second}
+	wheelCfg    = LessorConfig{MinLeaseTTL: minLeaseTTL, ExpiryGranularity: time.Second, ExpiryWheel: true}
+)
+
 func benchmarkLessorFindExpired(size int, b *testing.B) {
 	lg := zap.NewNop()
 	be, tmpPath := backend.NewDefaultTmpBackend()
@@ -73,11 +109,17 @@ func benchmarkLessorFindExpired(size int, b *testing.B) {
 }
 
 func benchmarkLessorGrant(size int, b *testing.B) {
+	benchmarkLessorGrantConfig(size, LessorConfig{MinLeaseTTL: minLeaseTTL}, b)
+}
+
+func benchmarkLessorGrantConfig(size int, cfg LessorConfig, b *testing.B) {
 	lg := zap.NewNop()
 	be, tmpPath := backend.NewDefaultTmpBackend()
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	le := newLessor(lg, be, cfg)
 	defer le.Stop()
 	defer cleanup(be, tmpPath)
+	// only the primary schedules expiries
+	le.Promote(0)
 	for i := 0; i < size; i++ {
 		le.Grant(LeaseID(i), int64(100+i))
 	}
@@ -87,6 +129,146 @@ func benchmarkLessorGrant(size int, b *testing.B) {
 	}
 }
 
+// benchmarkLessorScanExpired measures a scan of the primary lessor finding no
+// expired lease among size leases, the cost of most ticks.
+func benchmarkLessorScanExpired(size int, b *testing.B) {
+	lg := zap.NewNop()
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, ExpiryScheduler: ms})
+	defer le.Stop()
+	defer cleanup(be, tmpPath)
+	<-ms.runc
+	le.Promote(0)
+	for i := 0; i < size; i++ {
+		le.Grant(LeaseID(i+1), int64(100+i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		le.ScanExpired()
+	}
+}
+
+// benchmarkLessorExpire measures finding size leases expiring at once on the
+// primary lessor, after they were granted and renewed.
+func benchmarkLessorExpire(size int, cfg LessorConfig, b *testing.B) {
+	lg := zap.NewNop()
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	cfg.clock, cfg.ExpiryScheduler = fc, ms
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+	defer cleanup(be, tmpPath)
+	<-ms.runc
+	le.Promote(0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < size; j++ {
+			le.Grant(LeaseID(i*size+j+1), minLeaseTTL)
+		}
+		fc.Advance(time.Second)
+		for j := 0; j < size; j++ {
+			le.Renew(LeaseID(i*size + j + 1))
+		}
+		fc.Advance(time.Duration(2*minLeaseTTL) * time.Second)
+		b.StartTimer()
+
+		le.mu.Lock()
+		for n := 0; n < size; {
+			n += len(le.findExpiredLeases(1000))
+		}
+		le.mu.Unlock()
+	}
+}
+
+// benchmarkLessorGrantDuringExpiry grants leases while the lessor scans size
+// simultaneously expired leases, and reports the slowest grant.
+func benchmarkLessorGrantDuringExpiry(size int, b *testing.B) {
+	lg := zap.NewNop()
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc, ExpiryScheduler: ms})
+	defer le.Stop()
+	defer cleanup(be, tmpPath)
+	<-ms.runc
+	le.Promote(0)
+	for i := 0; i < size; i++ {
+		le.Grant(LeaseID(i+1), 1)
+	}
+	fc.Advance(2 * time.Second)
+
+	stopc, donec := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(donec)
+		for {
+			select {
+			case <-le.ExpiredLeaseBatchC():
+			case <-stopc:
+				return
+			default:
+				le.ScanExpired()
+			}
+		}
+	}()
+
+	var slowest time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		le.Grant(LeaseID(size+i+1), 100)
+		if d := time.Since(start); d > slowest {
+			slowest = d
+		}
+	}
+	b.StopTimer()
+	close(stopc)
+	<-donec
+	b.ReportMetric(float64(slowest.Nanoseconds()), "max-ns")
+}
+
+// benchmarkLessorAttach attaches an item to each of size leases per
+// iteration, as a transaction touching keys of many leases does.
+func benchmarkLessorAttach(size int, b *testing.B) {
+	lg := zap.NewNop()
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	defer cleanup(be, tmpPath)
+	for i := 0; i < size; i++ {
+		le.Grant(LeaseID(i+1), 100)
+	}
+	items := []LeaseItem{{"foo"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < size; j++ {
+			le.Attach(LeaseID(j+1), items)
+		}
+	}
+}
+
+func benchmarkLessorAttachBatch(size int, b *testing.B) {
+	lg := zap.NewNop()
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	defer cleanup(be, tmpPath)
+	batch := make(map[LeaseID][]LeaseItem, size)
+	for i := 0; i < size; i++ {
+		le.Grant(LeaseID(i+1), 100)
+		batch[LeaseID(i+1)] = []LeaseItem{{"foo"}}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		le.AttachBatch(batch)
+	}
+}
+
 func benchmarkLessorRevoke(size int, b *testing.B) {
 	lg := zap.NewNop()
 	be, tmpPath := backend.NewDefaultTmpBackend()
@@ -106,18 +288,77 @@ func benchmarkLessorRevoke(size int, b *testing.B) {
 }
 
 func benchmarkLessorRenew(size int, b *testing.B) {
+	benchmarkLessorRenewConfig(size, LessorConfig{MinLeaseTTL: minLeaseTTL}, b)
+}
+
+func benchmarkLessorRenewConfig(size int, cfg LessorConfig, b *testing.B) {
 	lg := zap.NewNop()
 	be, tmpPath := backend.NewDefaultTmpBackend()
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	le := newLessor(lg, be, cfg)
 	defer le.Stop()
 	defer cleanup(be, tmpPath)
+	le.Promote(0)
 	for i := 0; i < size; i++ {
-		le.Grant(LeaseID(i), int64(100+i))
+		le.Grant(LeaseID(i+1), int64(100+i))
 	}
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		le.Renew(LeaseID(i))
+		le.Renew(LeaseID(i%size + 1))
+	}
+}
+
+func benchmarkLessorRenewParallel(size int, b *testing.B) {
+	lg := zap.NewNop()
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	defer cleanup(be, tmpPath)
+	le.Promote(0)
+	for i := 0; i < size; i++ {
+		le.Grant(LeaseID(i+1), int64(100+i))
 	}
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt64(&next, 1)
+		for pb.Next() {
+			le.Renew(LeaseID(id%int64(size) + 1))
+			id++
+		}
+	})
+}
+
+// benchmarkLessorRenewBatch renews 10000 leases from parallel callers in
+// batches of the given size. An op is a single renewal.
+func benchmarkLessorRenewBatch(batch int, b *testing.B) {
+	lg := zap.NewNop()
+	be, tmpPath := backend.NewDefaultTmpBackend()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	defer cleanup(be, tmpPath)
+	le.Promote(0)
+	size := 10000
+	for i := 0; i < size; i++ {
+		le.Grant(LeaseID(i+1), int64(100+i))
+	}
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt64(&next, 1)
+		ids := make([]LeaseID, 0, batch)
+		for pb.Next() {
+			ids = append(ids, LeaseID(id%int64(size)+1))
+			id++
+			if len(ids) == batch {
+				le.RenewBatch(ids)
+				ids = ids[:0]
+			}
+		}
+		if len(ids) > 0 {
+			le.RenewBatch(ids)
+		}
+	})
 }
 
 func cleanup(b backend.Backend, path string) {
@@ -15,20 +15,31 @@
 package lease
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	pb "go.etcd.io/etcd/v3/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/v3/lease/leasepb"
 	"go.etcd.io/etcd/v3/mvcc/backend"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const (
@@ -99,9 +110,9 @@ func TestLessorGrant(t *testing.T) {
 	be.BatchTx().Unlock()
 }
 
-// TestLeaseConcurrentKeys ensures Lease.Keys method calls are guarded
-// from concurrent map writes on 'itemSet'.
-func TestLeaseConcurrentKeys(t *testing.T) {
+// TestLessorGrantMinTTL ensures TTLs below the minimum are raised to the
+// minimum, or rejected if StrictMinTTL is set.
+func TestLessorGrantMinTTL(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
@@ -109,473 +120,5427 @@ func TestLeaseConcurrentKeys(t *testing.T) {
 
 	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
 	defer le.Stop()
-	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
 
-	// grant a lease with long term (100 seconds) to
-	// avoid early termination during the test.
-	l, err := le.Grant(1, 100)
+	l, err := le.Grant(1, 1)
 	if err != nil {
-		t.Fatalf("could not grant lease for 100s ttl (%v)", err)
+		t.Fatal(err)
 	}
-
-	itemn := 10
-	items := make([]LeaseItem, itemn)
-	for i := 0; i < itemn; i++ {
-		items[i] = LeaseItem{Key: fmt.Sprintf("foo%d", i)}
+	if l.TTL() != minLeaseTTL {
+		t.Errorf("ttl = %d, want %d", l.TTL(), minLeaseTTL)
 	}
-	if err = le.Attach(l.ID, items); err != nil {
-		t.Fatalf("failed to attach items to the lease: %v", err)
+	ttl, err := le.Renew(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != minLeaseTTL {
+		t.Errorf("renewed ttl = %d, want %d", ttl, minLeaseTTL)
 	}
 
-	donec := make(chan struct{})
-	go func() {
-		le.Detach(l.ID, items)
-		close(donec)
-	}()
+	dir2, be2 := NewTestBackend(t)
+	defer os.RemoveAll(dir2)
+	defer be2.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(itemn)
-	for i := 0; i < itemn; i++ {
-		go func() {
-			defer wg.Done()
-			l.Keys()
-		}()
-	}
+	sle := newLessor(lg, be2, LessorConfig{MinLeaseTTL: minLeaseTTL, StrictMinTTL: true})
+	defer sle.Stop()
 
-	<-donec
-	wg.Wait()
+	_, err = sle.Grant(1, 1)
+	var terr *TTLTooSmallError
+	if !errors.As(err, &terr) || terr.MinTTL != minLeaseTTL {
+		t.Fatalf("grant = %v, want minimum TTL %d", err, minLeaseTTL)
+	}
+	if !errors.Is(err, ErrLeaseTTLTooSmall) {
+		t.Errorf("errors.Is(%v, ErrLeaseTTLTooSmall) = false, want true", err)
+	}
+	if sle.Lookup(1) != nil {
+		t.Error("lease with too small TTL is granted")
+	}
+	if _, err = sle.Grant(2, minLeaseTTL); err != nil {
+		t.Errorf("grant with minimum TTL = %v, want <nil>", err)
+	}
 }
 
-// TestLessorRevoke ensures Lessor can revoke a lease.
-// The items in the revoked lease should be removed from
-// the backend.
-// The revoked lease cannot be got from Lessor again.
-func TestLessorRevoke(t *testing.T) {
+// TestLessorGrantDuration ensures leases granted with sub-second TTLs expire
+// on time and keep their precision across restarts.
+func TestLessorGrantDuration(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	cfg := LessorConfig{MinLeaseTTL: minLeaseTTL, MinLeaseTTLDuration: 100 * time.Millisecond}
+	fc := newFakeClock()
+	cfg.clock = fc
+	le := newLessor(lg, be, cfg)
 	defer le.Stop()
-	var fd *fakeDeleter
-	le.SetRangeDeleter(func() TxnDelete {
-		fd = newFakeDeleter(be)
-		return fd
-	})
+	le.Promote(0)
 
-	// grant a lease with long term (100 seconds) to
-	// avoid early termination during the test.
-	l, err := le.Grant(1, 100)
+	l, err := le.GrantDuration(1, 200*time.Millisecond)
 	if err != nil {
-		t.Fatalf("could not grant lease for 100s ttl (%v)", err)
-	}
-
-	items := []LeaseItem{
-		{"foo"},
-		{"bar"},
+		t.Fatal(err)
 	}
-
-	if err = le.Attach(l.ID, items); err != nil {
-		t.Fatalf("failed to attach items to the lease: %v", err)
+	if l.TTLDuration() != 200*time.Millisecond || l.TTL() != 1 {
+		t.Errorf("ttl = %v (%ds), want 200ms (1s)", l.TTLDuration(), l.TTL())
 	}
-
-	if err = le.Revoke(l.ID); err != nil {
-		t.Fatal("failed to revoke lease:", err)
+	l, err = le.GrantDuration(2, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if le.Lookup(l.ID) != nil {
-		t.Errorf("got revoked lease %x", l.ID)
+	if l.TTLDuration() != 100*time.Millisecond {
+		t.Errorf("ttl = %v, want the minimum 100ms", l.TTLDuration())
 	}
 
-	wdeleted := []string{"bar_", "foo_"}
-	sort.Strings(fd.deleted)
-	if !reflect.DeepEqual(fd.deleted, wdeleted) {
-		t.Errorf("deleted= %v, want %v", fd.deleted, wdeleted)
+	expect := func(id LeaseID) {
+		t.Helper()
+		select {
+		case batch := <-le.ExpiredLeaseBatchC():
+			if len(batch.Leases) != 1 || batch.Leases[0].ID != id {
+				t.Fatalf("expired leases = %v, want lease %d", batch.Leases, id)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("lease %d did not expire", id)
+		}
 	}
+	fc.Advance(150 * time.Millisecond)
+	expect(2)
+	fc.Advance(50 * time.Millisecond)
+	expect(1)
 
-	be.BatchTx().Lock()
-	_, vs := be.BatchTx().UnsafeRange(leaseBucketName, int64ToBytes(int64(l.ID)), nil, 0)
-	if len(vs) != 0 {
-		t.Errorf("len(vs) = %d, want 0", len(vs))
+	cfg.clock = nil
+	nle := newLessor(lg, be, cfg)
+	defer nle.Stop()
+	if nl := nle.Lookup(1); nl == nil || nl.TTLDuration() != 200*time.Millisecond {
+		t.Errorf("recovered lease 1 = %+v, want ttl 200ms", nl)
 	}
-	be.BatchTx().Unlock()
 }
 
-// TestLessorRenew ensures Lessor can renew an existing lease.
-func TestLessorRenew(t *testing.T) {
+// TestLessorGrantResult ensures GrantResult describes the granted lease by
+// value.
+func TestLessorGrantResult(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
-	defer be.Close()
 	defer os.RemoveAll(dir)
+	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 5, MaxLifetime: 20 * time.Second, clock: fc})
 	defer le.Stop()
-	le.Promote(0)
 
-	l, err := le.Grant(1, minLeaseTTL)
+	l, err := le.Grant(1, 1)
 	if err != nil {
-		t.Fatalf("failed to grant lease (%v)", err)
+		t.Fatal(err)
+	}
+	if r, wr := l.GrantResult(), (LeaseGrantResult{ID: 1, TTL: 5, ExpirySeconds: -1}); r != wr {
+		t.Errorf("result of non-primary = %+v, want %+v", r, wr)
 	}
 
-	// manually change the ttl field
-	le.mu.Lock()
-	l.ttl = 10
-	le.mu.Unlock()
-	ttl, err := le.Renew(l.ID)
+	le.Promote(0)
+	l, err = le.Grant(2, 30)
 	if err != nil {
-		t.Fatalf("failed to renew lease (%v)", err)
+		t.Fatal(err)
 	}
-	if ttl != l.ttl {
-		t.Errorf("ttl = %d, want %d", ttl, l.ttl)
+	r := l.GrantResult()
+	if wr := (LeaseGrantResult{ID: 2, TTL: 30, ExpirySeconds: 20}); r != wr {
+		t.Errorf("result = %+v, want %+v", r, wr)
 	}
-
-	l = le.Lookup(l.ID)
-	if l.Remaining() < 9*time.Second {
-		t.Errorf("failed to renew the lease")
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wb := `{"id":2,"ttl":30,"expirySeconds":20}`; string(b) != wb {
+		t.Errorf("marshaled result = %s, want %s", b, wb)
 	}
 }
 
-func TestLessorRenewWithCheckpointer(t *testing.T) {
+// TestLessorGrantPermanent ensures permanent leases never expire, also after
+// promotion and recovery, and can still be revoked.
+func TestLessorGrantPermanent(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
-	defer be.Close()
 	defer os.RemoveAll(dir)
+	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
-	fakerCheckerpointer := func(ctx context.Context, cp *pb.LeaseCheckpointRequest) {
-		for _, cp := range cp.GetCheckpoints() {
-			le.Checkpoint(LeaseID(cp.GetID()), cp.GetRemaining_TTL())
-		}
-	}
+	cfg := LessorConfig{MinLeaseTTL: minLeaseTTL}
+	fc := newFakeClock()
+	cfg.clock = fc
+	le := newLessor(lg, be, cfg)
 	defer le.Stop()
-	// Set checkpointer
-	le.SetCheckpointer(fakerCheckerpointer)
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
 	le.Promote(0)
 
-	l, err := le.Grant(1, minLeaseTTL)
-	if err != nil {
-		t.Fatalf("failed to grant lease (%v)", err)
-	}
-
-	// manually change the ttl field
-	le.mu.Lock()
-	l.ttl = 10
-	l.remainingTTL = 10
-	le.mu.Unlock()
-	ttl, err := le.Renew(l.ID)
+	l, err := le.GrantPermanent(1)
 	if err != nil {
-		t.Fatalf("failed to renew lease (%v)", err)
+		t.Fatal(err)
 	}
-	if ttl != l.ttl {
-		t.Errorf("ttl = %d, want %d", ttl, l.ttl)
+	if !l.Permanent() || l.Remaining() != forever {
+		t.Fatalf("permanent lease remaining = %v, want forever", l.Remaining())
 	}
-	if l.remainingTTL != 0 {
-		t.Fatalf("remianingTTL = %d, want %d", l.remainingTTL, 0)
+	if _, err = le.Grant(2, minLeaseTTL); err != nil {
+		t.Fatal(err)
 	}
-
-	l = le.Lookup(l.ID)
-	if l.Remaining() < 9*time.Second {
-		t.Errorf("failed to renew the lease")
+	if _, err = le.Renew(1); err != ErrLeasePermanent {
+		t.Errorf("renew permanent lease = %v, want %v", err, ErrLeasePermanent)
 	}
-}
-
-// TestLessorRenewExtendPileup ensures Lessor extends leases on promotion if too many
-// expire at the same time.
-func TestLessorRenewExtendPileup(t *testing.T) {
-	oldRevokeRate := leaseRevokeRate
-	defer func() { leaseRevokeRate = oldRevokeRate }()
-	lg := zap.NewNop()
-	leaseRevokeRate = 10
-
-	dir, be := NewTestBackend(t)
-	defer os.RemoveAll(dir)
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
-	ttl := int64(10)
-	for i := 1; i <= leaseRevokeRate*10; i++ {
-		if _, err := le.Grant(LeaseID(2*i), ttl); err != nil {
-			t.Fatal(err)
-		}
-		// ttls that overlap spillover for ttl=10
-		if _, err := le.Grant(LeaseID(2*i+1), ttl+1); err != nil {
-			t.Fatal(err)
+	fc.Advance(time.Duration(minLeaseTTL+1) * time.Second)
+	select {
+	case batch := <-le.ExpiredLeaseBatchC():
+		for _, el := range batch.Leases {
+			if el.ID != 2 {
+				t.Fatalf("expired lease %d, want 2", el.ID)
+			}
 		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("lease 2 did not expire")
 	}
 
-	// simulate stop and recovery
-	le.Stop()
-	be.Close()
-	bcfg := backend.DefaultBackendConfig()
-	bcfg.Path = filepath.Join(dir, "be")
-	be = backend.New(bcfg)
-	defer be.Close()
-	le = newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
-	defer le.Stop()
-
-	// extend after recovery should extend expiration on lease pile-up
-	le.Promote(0)
-
-	windowCounts := make(map[int64]int)
-	for _, l := range le.leaseMap {
-		// round up slightly for baseline ttl
-		s := int64(l.Remaining().Seconds() + 0.1)
-		windowCounts[s]++
+	le.Demote()
+	le.Promote(time.Second)
+	if r := le.Lookup(1).Remaining(); r != forever {
+		t.Errorf("permanent lease remaining after promotion = %v, want forever", r)
 	}
 
-	for i := ttl; i < ttl+20; i++ {
-		c := windowCounts[i]
-		if c > leaseRevokeRate {
-			t.Errorf("expected at most %d expiring at %ds, got %d", leaseRevokeRate, i, c)
-		}
-		if c < leaseRevokeRate/2 {
-			t.Errorf("expected at least %d expiring at %ds, got %d", leaseRevokeRate/2, i, c)
-		}
+	cfg.clock = nil
+	nle := newLessor(lg, be, cfg)
+	defer nle.Stop()
+	nle.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	nle.Promote(0)
+	nl := nle.Lookup(1)
+	if nl == nil || !nl.Permanent() || nl.Remaining() != forever {
+		t.Fatalf("recovered lease = %+v, want permanent", nl)
+	}
+	if err = nle.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if nle.Lookup(1) != nil {
+		t.Error("permanent lease not revoked")
 	}
 }
 
-func TestLessorDetach(t *testing.T) {
+// TestLessorMaxLeases ensures granting fails once MaxLeases is reached, while
+// existing leases still renew.
+func TestLessorMaxLeases(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, MaxLeases: 2})
 	defer le.Stop()
 	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
 
-	// grant a lease with long term (100 seconds) to
-	// avoid early termination during the test.
-	l, err := le.Grant(1, 100)
-	if err != nil {
-		t.Fatalf("could not grant lease for 100s ttl (%v)", err)
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
 	}
-
-	items := []LeaseItem{
-		{"foo"},
-		{"bar"},
+	if _, err := le.Grant(3, 100); err != ErrTooManyLeases {
+		t.Fatalf("grant beyond max = %v, want %v", err, ErrTooManyLeases)
 	}
-
-	if err := le.Attach(l.ID, items); err != nil {
-		t.Fatalf("failed to attach items to the lease: %v", err)
+	if _, err := le.GrantPermanent(3); err != ErrTooManyLeases {
+		t.Fatalf("grant permanent beyond max = %v, want %v", err, ErrTooManyLeases)
 	}
-
-	if err := le.Detach(l.ID, items[0:1]); err != nil {
-		t.Fatalf("failed to de-attach items to the lease: %v", err)
+	if _, err := le.Renew(1); err != nil {
+		t.Fatal(err)
 	}
 
-	l = le.Lookup(l.ID)
-	if len(l.itemSet) != 1 {
-		t.Fatalf("len(l.itemSet) = %d, failed to de-attach items", len(l.itemSet))
+	if err := le.Revoke(1); err != nil {
+		t.Fatal(err)
 	}
-	if _, ok := l.itemSet[LeaseItem{"bar"}]; !ok {
-		t.Fatalf("de-attached wrong item, want %q exists", "bar")
+	if _, err := le.Grant(3, 100); err != nil {
+		t.Fatalf("grant after revoke = %v, want nil", err)
 	}
 }
 
-// TestLessorRecover ensures Lessor recovers leases from
-// persist backend.
-func TestLessorRecover(t *testing.T) {
+// TestLessorMaxItemsPerLease ensures attachments beyond MaxItemsPerLease fail
+// without attaching anything.
+func TestLessorMaxItemsPerLease(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, MaxItemsPerLease: 2})
 	defer le.Stop()
-	l1, err1 := le.Grant(1, 10)
-	l2, err2 := le.Grant(2, 20)
-	if err1 != nil || err2 != nil {
-		t.Fatalf("could not grant initial leases (%v, %v)", err1, err2)
-	}
 
-	// Create a new lessor with the same backend
-	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
-	defer nle.Stop()
-	nl1 := nle.Lookup(l1.ID)
-	if nl1 == nil || nl1.ttl != l1.ttl {
-		t.Errorf("nl1 = %v, want nl1.ttl= %d", nl1.ttl, l1.ttl)
+	if _, err := le.Grant(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	// attaching an item again does not count twice
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	err := le.Attach(1, []LeaseItem{{"baz"}})
+	if !errors.Is(err, ErrLeaseTooManyItems) {
+		t.Fatalf("attach beyond max = %v, want %v", err, ErrLeaseTooManyItems)
+	}
+	if e, ok := err.(*TooManyItemsError); !ok || e.ID != 1 || e.MaxItems != 2 {
+		t.Errorf("err = %#v, want lease 1 and maximum 2", err)
+	}
+	if id := le.GetLease(LeaseItem{"baz"}); id != NoLease {
+		t.Errorf("lease of baz = %x, want none", id)
 	}
 
-	nl2 := nle.Lookup(l2.ID)
-	if nl2 == nil || nl2.ttl != l2.ttl {
-		t.Errorf("nl2 = %v, want nl2.ttl= %d", nl2.ttl, l2.ttl)
+	_, err = le.GrantWithOptions(2, 100, GrantOptions{Items: []LeaseItem{{"a"}, {"b"}, {"c"}}})
+	if !errors.Is(err, ErrLeaseTooManyItems) {
+		t.Errorf("grant beyond max = %v, want %v", err, ErrLeaseTooManyItems)
+	}
+	if le.Lookup(2) != nil {
+		t.Error("lease with too many items is granted")
 	}
 }
 
-func TestLessorExpire(t *testing.T) {
+// TestLessorDetachAll ensures DetachAll empties the lease, so that revoking
+// it deletes no keys.
+func TestLessorDetachAll(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	testMinTTL := int64(1)
-
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	var fds []*fakeDeleter
+	le.SetRangeDeleter(func() TxnDelete {
+		fd := newFakeDeleter(be)
+		fds = append(fds, fd)
+		return fd
+	})
+
+	if _, err := le.DetachAll(1); err != ErrLeaseNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrLeaseNotFound)
+	}
+	items := []LeaseItem{{"a"}, {"b"}, {"c"}}
+	if _, err := le.GrantWithOptions(1, 100, GrantOptions{Items: items}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := le.DetachAll(1); err != nil || n != 3 {
+		t.Fatalf("detached = %d, %v, want 3, <nil>", n, err)
+	}
+	if n := le.Lookup(1).ItemCount(); n != 0 {
+		t.Errorf("items = %d after detaching all, want 0", n)
+	}
+	for _, it := range items {
+		if id := le.GetLease(it); id != NoLease {
+			t.Errorf("lease of %q = %x, want none", it.Key, id)
+		}
+	}
+	// the lease is kept for reuse
+	if err := le.Attach(1, []LeaseItem{{"d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := le.DetachAll(1); err != nil || n != 1 {
+		t.Fatalf("detached = %d, %v, want 1, <nil>", n, err)
+	}
+
+	if err := le.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range fds {
+		if len(fd.deleted) != 0 {
+			t.Errorf("deleted = %v, want none", fd.deleted)
+		}
+	}
+}
+
+// TestLessorRevokeChunkSize ensures the keys of a revoked lease are deleted
+// in transactions of at most RevokeChunkSize keys.
+func TestLessorRevokeChunkSize(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, RevokeChunkSize: 2})
+	defer le.Stop()
+	var fds []*fakeDeleter
+	le.SetRangeDeleter(func() TxnDelete {
+		fd := newFakeDeleter(be)
+		fds = append(fds, fd)
+		return fd
+	})
+
+	items := []LeaseItem{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}}
+	if _, err := le.GrantWithOptions(1, 100, GrantOptions{Items: items}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks [][]string
+	for _, fd := range fds {
+		chunks = append(chunks, fd.deleted)
+	}
+	wchunks := [][]string{{"a_", "b_"}, {"c_", "d_"}, {"e_"}}
+	if !reflect.DeepEqual(chunks, wchunks) {
+		t.Errorf("deleted chunks = %v, want %v", chunks, wchunks)
+	}
+	if le.Lookup(1) != nil {
+		t.Error("got revoked lease 1")
+	}
+}
+
+// TestLessorRevokeLockOrder ensures revoking does not hold mu within the
+// transactions of the range deleter, which lock the batch tx first.
+func TestLessorRevokeLockOrder(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, RevokeChunkSize: 2})
+	defer le.Stop()
+	txns, held := 0, 0
+	le.SetRangeDeleter(func() TxnDelete {
+		txns++
+		return &endDeleter{&lookupDeleter{newFakeDeleter(be), le}, func() {
+			if !le.mu.TryLock() {
+				held++
+				return
+			}
+			le.mu.Unlock()
+		}}
+	})
+
+	items := []LeaseItem{{"a"}, {"b"}, {"c"}}
+	if _, err := le.GrantWithOptions(1, 100, GrantOptions{Items: items}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if txns != 2 || held != 0 {
+		t.Errorf("txns = %d with mu held in %d, want 2 with mu held in none", txns, held)
+	}
+}
+
+// TestLessorResumeRevokes ensures a revocation interrupted between chunks is
+// finished after recovery.
+func TestLessorResumeRevokes(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	cfg := LessorConfig{MinLeaseTTL: minLeaseTTL, RevokeChunkSize: 2}
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+	txns := 0
+	le.SetRangeDeleter(func() TxnDelete {
+		if txns++; txns == 2 {
+			// the lease is already gone for renewals
+			if le.Lookup(1) != nil {
+				t.Error("lease 1 is found while revoking")
+			}
+			panic("crash")
+		}
+		return newFakeDeleter(be)
+	})
+
+	items := []LeaseItem{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}}
+	if _, err := le.GrantWithOptions(1, 100, GrantOptions{Items: items}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Grant(2, 100); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != "crash" {
+				t.Fatalf("recovered %v, want crash", r)
+			}
+		}()
+		le.Revoke(1)
+	}()
+
+	nle := newLessor(lg, be, cfg)
+	defer nle.Stop()
+	if nle.Lookup(1) != nil {
+		t.Fatal("lease 1 is recovered while revoking")
+	}
+	// the first chunk was deleted before the crash
+	if missing := nle.Reattach(map[LeaseID][]LeaseItem{1: items[2:]}); len(missing) != 0 {
+		t.Fatalf("missing = %v, want none", missing)
+	}
+	if id := nle.GetLease(LeaseItem{"c"}); id != NoLease {
+		t.Errorf("lease of c = %x, want none", id)
+	}
+	var fds []*fakeDeleter
+	nle.SetRangeDeleter(func() TxnDelete {
+		fd := newFakeDeleter(be)
+		fds = append(fds, fd)
+		return fd
+	})
+	if n := nle.ResumeRevokes(); n != 1 {
+		t.Fatalf("resumed = %d, want 1", n)
+	}
+	var chunks [][]string
+	for _, fd := range fds {
+		chunks = append(chunks, fd.deleted)
+	}
+	if wchunks := [][]string{{"c_", "d_"}, {"e_"}}; !reflect.DeepEqual(chunks, wchunks) {
+		t.Errorf("deleted chunks = %v, want %v", chunks, wchunks)
+	}
+	if n := nle.ResumeRevokes(); n != 0 {
+		t.Errorf("resumed again = %d, want 0", n)
+	}
+
+	rle := newLessor(lg, be, cfg)
+	defer rle.Stop()
+	rle.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	if n := rle.ResumeRevokes(); n != 0 || rle.Lookup(1) != nil || rle.Lookup(2) == nil {
+		t.Errorf("resumed = %d after finished revocation, want 0 and only lease 2", n)
+	}
+}
+
+// TestLessorRevokeByKey ensures a lease can be revoked or a single key
+// detached knowing only one of its keys.
+func TestLessorRevokeByKey(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	var fd *fakeDeleter
+	le.SetRangeDeleter(func() TxnDelete {
+		fd = newFakeDeleter(be)
+		return fd
+	})
+
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Attach(1, []LeaseItem{{"/locks/foo"}, {"/locks/bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Attach(2, []LeaseItem{{"/locks/baz"}, {"/sessions/baz"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := le.RevokeByKey([]byte("/locks/none")); id != NoLease || err != ErrKeyNotLeased {
+		t.Errorf("revoke by unleased key = %x, %v, want %x, %v", id, err, NoLease, ErrKeyNotLeased)
+	}
+	if id, err := le.DetachKey([]byte("/locks/none")); id != NoLease || err != ErrKeyNotLeased {
+		t.Errorf("detach unleased key = %x, %v, want %x, %v", id, err, NoLease, ErrKeyNotLeased)
+	}
+
+	id, err := le.RevokeByKey([]byte("/locks/foo"))
+	if err != nil || id != 1 {
+		t.Fatalf("revoke by key = %x, %v, want 1, <nil>", id, err)
+	}
+	if le.Lookup(1) != nil {
+		t.Error("lease 1 is not revoked")
+	}
+	if wdeleted := []string{"/locks/bar_", "/locks/foo_"}; !reflect.DeepEqual(fd.deleted, wdeleted) {
+		t.Errorf("deleted = %v, want %v", fd.deleted, wdeleted)
+	}
+
+	if id, err = le.DetachKey([]byte("/locks/baz")); err != nil || id != 2 {
+		t.Fatalf("detach key = %x, %v, want 2, <nil>", id, err)
+	}
+	if keys := le.Lookup(2).Keys(); !reflect.DeepEqual(keys, []string{"/sessions/baz"}) {
+		t.Errorf("keys of lease 2 = %v, want [/sessions/baz]", keys)
+	}
+	if id = le.GetLease(LeaseItem{"/locks/baz"}); id != NoLease {
+		t.Errorf("lease of detached key = %x, want none", id)
+	}
+}
+
+// TestLessorRevokeSync ensures a lease revoked by RevokeSync stays revoked
+// after a crash right after it returns.
+func TestLessorRevokeSync(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	be.ForceCommit()
+	if err := le.RevokeSync(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.RevokeSync(1); err != ErrLeaseNotFound {
+		t.Errorf("revoke of revoked lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+
+	// crash: the backend file only holds the committed transactions
+	data, err := ioutil.ReadFile(filepath.Join(dir, "be"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "crashed")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cbe := backend.NewDefaultBackend(path)
+	defer cbe.Close()
+
+	rle := newLessor(lg, cbe, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer rle.Stop()
+	if rle.Lookup(1) != nil || rle.Lookup(2) == nil {
+		t.Error("want lease 1 revoked and lease 2 kept after crash")
+	}
+}
+
+// TestLessorRevokeCrashRecovery ensures that, whichever backend commit a
+// chunked revocation crashes after, the recovered lessor either keeps the
+// lease with all its keys or finishes the revocation, never resurrecting it.
+func TestLessorRevokeCrashRecovery(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	cfg := LessorConfig{MinLeaseTTL: minLeaseTTL, RevokeChunkSize: 2}
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+
+	keys := map[string]LeaseID{"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "z": 2}
+	tx := be.BatchTx()
+	tx.Lock()
+	tx.UnsafeCreateBucket(testKeyBucket)
+	for k, id := range keys {
+		tx.UnsafePut(testKeyBucket, []byte(k), int64ToBytes(int64(id)))
+	}
+	tx.Unlock()
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, id := range keys {
+		if err := le.Attach(id, []LeaseItem{{k}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// snapshots are the states the backend recovers from after a crash right
+	// after each of its commits.
+	var snapshots []string
+	cut := func() {
+		path := filepath.Join(dir, fmt.Sprintf("cut%d", len(snapshots)))
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap := be.Snapshot()
+		if _, err = snap.WriteTo(f); err != nil {
+			t.Fatal(err)
+		}
+		snap.Close()
+		f.Close()
+		snapshots = append(snapshots, path)
+	}
+	cut()
+	le.SetRangeDeleter(func() TxnDelete {
+		if len(snapshots) == 1 {
+			// the lease is marked revoking, no key is deleted yet
+			cut()
+		}
+		return &keyDeleter{tx: lockedBatchTx(be), ended: cut}
+	})
+	if err := le.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 5 {
+		t.Fatalf("cut %d times, want 5", len(snapshots))
+	}
+
+	for i, path := range snapshots {
+		t.Run(fmt.Sprintf("cut%d", i), func(t *testing.T) {
+			cbe := backend.NewDefaultBackend(path)
+			defer cbe.Close()
+
+			rle := newLessor(lg, cbe, cfg)
+			defer rle.Stop()
+			rle.SetRangeDeleter(func() TxnDelete { return &keyDeleter{tx: lockedBatchTx(cbe)} })
+			// reattach the keys like the KV store does on recovery
+			batch := make(map[LeaseID][]LeaseItem)
+			for k, id := range testKeys(cbe) {
+				batch[id] = append(batch[id], LeaseItem{k})
+			}
+			if missing := rle.Reattach(batch); len(missing) != 0 {
+				t.Fatalf("keys of missing leases %v", missing)
+			}
+
+			resumed := rle.ResumeRevokes()
+			remaining := testKeys(cbe)
+			if i == 0 {
+				// crashed before the revocation was committed
+				if resumed != 0 || rle.Lookup(1) == nil || !reflect.DeepEqual(remaining, keys) {
+					t.Fatalf("resumed %d, keys %v; want lease 1 intact with keys %v", resumed, remaining, keys)
+				}
+				return
+			}
+			if want := map[string]LeaseID{"z": 2}; !reflect.DeepEqual(remaining, want) {
+				t.Errorf("keys = %v after recovery, want %v", remaining, want)
+			}
+			wresumed := 1
+			if i == len(snapshots)-1 {
+				// crashed after the revocation was committed
+				wresumed = 0
+			}
+			if resumed != wresumed {
+				t.Errorf("resumed = %d, want %d", resumed, wresumed)
+			}
+			if rle.Lookup(1) != nil || rle.Lookup(2) == nil {
+				t.Error("want lease 1 revoked and lease 2 kept")
+			}
+			cbe.ForceCommit()
+			nle := newLessor(lg, cbe, cfg)
+			defer nle.Stop()
+			if nle.Lookup(1) != nil || len(nle.revoking) != 0 {
+				t.Error("lease 1 recovered again after finishing its revocation")
+			}
+		})
+	}
+}
+
+// TestLeaseConcurrentKeys ensures Lease.Keys method calls are guarded
+// from concurrent map writes on 'itemSet'.
+func TestLeaseConcurrentKeys(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	// grant a lease with long term (100 seconds) to
+	// avoid early termination during the test.
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatalf("could not grant lease for 100s ttl (%v)", err)
+	}
+
+	itemn := 10
+	items := make([]LeaseItem, itemn)
+	for i := 0; i < itemn; i++ {
+		items[i] = LeaseItem{Key: fmt.Sprintf("foo%d", i)}
+	}
+	if err = le.Attach(l.ID, items); err != nil {
+		t.Fatalf("failed to attach items to the lease: %v", err)
+	}
+
+	donec := make(chan struct{})
+	go func() {
+		le.Detach(l.ID, items)
+		close(donec)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(itemn)
+	for i := 0; i < itemn; i++ {
+		go func() {
+			defer wg.Done()
+			l.Keys()
+		}()
+	}
+
+	<-donec
+	wg.Wait()
+}
+
+// TestLessorRevoke ensures Lessor can revoke a lease.
+// The items in the revoked lease should be removed from
+// the backend.
+// The revoked lease cannot be got from Lessor again.
+func TestLessorRevoke(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	var fd *fakeDeleter
+	le.SetRangeDeleter(func() TxnDelete {
+		fd = newFakeDeleter(be)
+		return fd
+	})
+
+	// grant a lease with long term (100 seconds) to
+	// avoid early termination during the test.
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatalf("could not grant lease for 100s ttl (%v)", err)
+	}
+
+	items := []LeaseItem{
+		{"foo"},
+		{"bar"},
+	}
+
+	if err = le.Attach(l.ID, items); err != nil {
+		t.Fatalf("failed to attach items to the lease: %v", err)
+	}
+
+	if err = le.Revoke(l.ID); err != nil {
+		t.Fatal("failed to revoke lease:", err)
+	}
+
+	if le.Lookup(l.ID) != nil {
+		t.Errorf("got revoked lease %x", l.ID)
+	}
+
+	wdeleted := []string{"bar_", "foo_"}
+	sort.Strings(fd.deleted)
+	if !reflect.DeepEqual(fd.deleted, wdeleted) {
+		t.Errorf("deleted= %v, want %v", fd.deleted, wdeleted)
+	}
+
+	be.BatchTx().Lock()
+	_, vs := be.BatchTx().UnsafeRange(leaseBucketName, int64ToBytes(int64(l.ID)), nil, 0)
+	if len(vs) != 0 {
+		t.Errorf("len(vs) = %d, want 0", len(vs))
+	}
+	be.BatchTx().Unlock()
+}
+
+// TestLessorRevokeWithoutRangeDeleter ensures revoking fails until a range
+// deleter is set, leaving the lease in place.
+func TestLessorRevokeWithoutRangeDeleter(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	if _, err := le.Grant(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := le.Revoke(1); err != ErrNoRangeDeleter {
+			t.Fatalf("revoke = %v, want %v", err, ErrNoRangeDeleter)
+		}
+	}
+	if le.Lookup(1) == nil {
+		t.Fatal("lease 1 is gone after failed revoke")
+	}
+
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	if err := le.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if le.Lookup(1) != nil {
+		t.Error("got revoked lease 1")
+	}
+}
+
+// TestLessorRevokeFunc ensures a lessor with a RevokeFunc revokes leases
+// through it and keeps the leases it fails for.
+func TestLessorRevokeFunc(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	errRevoke := errors.New("revoke failed")
+	var revoked []LeaseID
+	fail := true
+	cfg := LessorConfig{
+		MinLeaseTTL: minLeaseTTL,
+		RevokeFunc: func(l *Lease) error {
+			if fail {
+				return errRevoke
+			}
+			revoked = append(revoked, l.ID)
+			return nil
+		},
+	}
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = le.Attach(1, []LeaseItem{{"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = le.Revoke(1); err != errRevoke {
+		t.Fatalf("revoke = %v, want %v", err, errRevoke)
+	}
+	if le.Lookup(1) == nil || le.GetLease(LeaseItem{"foo"}) != 1 {
+		t.Fatal("lease 1 is changed by failed revoke")
+	}
+	select {
+	case <-l.revokec:
+		t.Fatal("failed revoke closed the lease")
+	default:
+	}
+
+	fail = false
+	if err = le.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(revoked, []LeaseID{1}) {
+		t.Errorf("revoked = %v, want [1]", revoked)
+	}
+	if le.Lookup(1) != nil || le.GetLease(LeaseItem{"foo"}) != NoLease {
+		t.Error("lease 1 is not removed")
+	}
+	select {
+	case <-l.revokec:
+	default:
+		t.Error("revoke did not close the lease")
+	}
+
+	le2 := newLessor(lg, be, cfg)
+	defer le2.Stop()
+	if le2.Lookup(1) != nil {
+		t.Error("revoked lease 1 is recovered")
+	}
+}
+
+// TestLessorRevokeDoesNotBlock ensures revoking a lease with many items does
+// not block other lease operations while its keys are deleted, and that no
+// item can be attached to it meanwhile.
+func TestLessorRevokeDoesNotBlock(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.Promote(0)
+
+	deleting, unblock := make(chan struct{}), make(chan struct{})
+	le.SetRangeDeleter(func() TxnDelete {
+		return &blockingDeleter{fakeDeleter: newFakeDeleter(be), deleting: deleting, unblock: unblock}
+	})
+
+	items := make([]LeaseItem, 10000)
+	for i := range items {
+		items[i] = LeaseItem{Key: fmt.Sprintf("foo%d", i)}
+	}
+	if _, err := le.GrantWithOptions(1, 100, GrantOptions{Items: items}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Grant(2, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- le.Revoke(1) }()
+	<-deleting
+
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		if _, err := le.Renew(2); err != nil {
+			t.Error(err)
+		}
+		if err := le.Attach(2, []LeaseItem{{"bar"}}); err != nil {
+			t.Error(err)
+		}
+		if err := le.Attach(1, []LeaseItem{{"baz"}}); err != ErrLeaseNotFound {
+			t.Errorf("attach to revoking lease = %v, want %v", err, ErrLeaseNotFound)
+		}
+		if le.Lookup(1) != nil {
+			t.Error("got revoking lease 1")
+		}
+	}()
+	select {
+	case <-donec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease operations blocked by revoke")
+	}
+
+	close(unblock)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if id := le.GetLease(LeaseItem{"baz"}); id != NoLease {
+		t.Errorf("lease of baz = %x, want none", id)
+	}
+}
+
+// blockingDeleter blocks its first delete until unblock is closed.
+type blockingDeleter struct {
+	*fakeDeleter
+	deleting chan struct{}
+	unblock  chan struct{}
+}
+
+func (bd *blockingDeleter) DeleteRange(key, end []byte) (int64, int64) {
+	if len(bd.deleted) == 0 {
+		close(bd.deleting)
+		<-bd.unblock
+	}
+	return bd.fakeDeleter.DeleteRange(key, end)
+}
+
+// TestLessorRevokeWithDeleted ensures RevokeWithDeleted returns the keys it
+// deleted.
+func TestLessorRevokeWithDeleted(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	if _, err := le.Grant(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.GrantWithOptions(2, 100, GrantOptions{RetainKeys: true, Items: []LeaseItem{{"baz"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := le.RevokeWithDeleted(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"bar", "foo"}) {
+		t.Errorf("deleted = %v, want [bar foo]", deleted)
+	}
+	if deleted, err = le.RevokeWithDeleted(2); err != nil || len(deleted) != 0 {
+		t.Errorf("revoke lease retaining keys = %v, %v, want none", deleted, err)
+	}
+	if _, err = le.RevokeWithDeleted(1); err != ErrLeaseNotFound {
+		t.Errorf("revoke revoked lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+}
+
+// TestLessorRetainKeys ensures revoking a lease granted with RetainKeys
+// detaches its keys without deleting them, and that its expiration is still
+// reported.
+func TestLessorRetainKeys(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	var fd *fakeDeleter
+	le.SetRangeDeleter(func() TxnDelete {
+		fd = newFakeDeleter(be)
+		return fd
+	})
+	le.Promote(0)
+
+	l, err := le.GrantWithOptions(1, 10, GrantOptions{RetainKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.RetainKeys() {
+		t.Fatal("granted lease does not retain keys")
+	}
+	if err = le.Attach(1, []LeaseItem{{"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := le.RevokePreview(1); err != nil || len(keys) != 0 {
+		t.Errorf("revoke preview = %v, %v, want none", keys, err)
+	}
+
+	fc.Advance(10 * time.Second)
+	select {
+	case batch := <-le.ExpiredLeaseBatchC():
+		if len(batch.Leases) == 0 || batch.Leases[0].ID != 1 {
+			t.Fatalf("expired leases = %v, want lease 1", batch.Leases)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expiration of lease retaining keys is not reported")
+	}
+
+	if err = le.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(fd.deleted) != 0 {
+		t.Errorf("deleted = %v, want none", fd.deleted)
+	}
+	if le.Lookup(1) != nil {
+		t.Error("got revoked lease 1")
+	}
+	if id := le.GetLease(LeaseItem{"foo"}); id != NoLease {
+		t.Errorf("lease of retained key = %x, want none", id)
+	}
+
+	// the option survives restarts
+	if _, err = le.GrantWithOptions(2, 100, GrantOptions{RetainKeys: true}); err != nil {
+		t.Fatal(err)
+	}
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer nle.Stop()
+	if nl := nle.Lookup(2); nl == nil || !nl.RetainKeys() {
+		t.Errorf("recovered lease 2 = %+v, want retaining keys", nl)
+	}
+}
+
+// TestLessorGrantWithItems ensures items given at grant time are attached to
+// the granted lease, and that invalid items prevent the grant.
+func TestLessorGrantWithItems(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	items := []LeaseItem{{"foo"}, {"bar"}}
+	l, err := le.GrantWithOptions(1, 100, GrantOptions{Items: items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := l.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"bar", "foo"}) {
+		t.Errorf("keys = %v, want [bar foo]", keys)
+	}
+	for _, it := range items {
+		if id := le.GetLease(it); id != 1 {
+			t.Errorf("lease of %q = %x, want 1", it.Key, id)
+		}
+	}
+
+	_, err = le.GrantWithOptions(2, 100, GrantOptions{Items: []LeaseItem{{"baz"}, {""}}})
+	if err != ErrLeaseItemInvalid {
+		t.Errorf("grant with invalid item = %v, want %v", err, ErrLeaseItemInvalid)
+	}
+	if le.Lookup(2) != nil {
+		t.Error("lease with invalid item is granted")
+	}
+	if id := le.GetLease(LeaseItem{"baz"}); id != NoLease {
+		t.Errorf("lease of baz = %x, want none", id)
+	}
+}
+
+// TestLessorFindExpiredLeasesOrder ensures expired leases are reported the
+// longest expired first and once, even if a lease was renewed after its first
+// heap item was pushed.
+func TestLessorFindExpiredLeasesOrder(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc, ExpiryScheduler: ms})
+	defer le.Stop()
+	<-ms.runc
+	le.Promote(0)
+
+	if _, err := le.Grant(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Grant(2, 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Grant(3, 20); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(4 * time.Second)
+	// lease 1 now expires after lease 2, but its stale heap item pops first
+	if _, err := le.Renew(1); err != nil {
+		t.Fatal(err)
+	}
+
+	fc.Advance(30 * time.Second)
+	le.ScanExpired()
+
+	var ids []LeaseID
+	for _, l := range (<-le.ExpiredLeaseBatchC()).Leases {
+		ids = append(ids, l.ID)
+	}
+	if !reflect.DeepEqual(ids, []LeaseID{2, 1, 3}) {
+		t.Errorf("expired leases = %v, want [2 1 3]", ids)
+	}
+}
+
+// TestLessorExpiredLeaseConcurrentAccess ensures the leases of an expired batch
+// can be read while the lessor keeps updating them. Run with -race.
+func TestLessorExpiredLeaseConcurrentAccess(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(10 * time.Second)
+
+	var batch ExpiredLeaseBatch
+	select {
+	case batch = <-le.ExpiredLeaseBatchC():
+	case <-time.After(3 * time.Second):
+		t.Fatal("lease 1 did not expire")
+	}
+
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		for i := 0; i < 100; i++ {
+			for _, l := range batch.Leases {
+				l.Keys()
+				l.TTL()
+				l.RemainingTTL()
+				l.TimeToLive()
+				l.Remaining()
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := le.Attach(1, []LeaseItem{{fmt.Sprintf("foo%d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := le.Checkpoint(1, int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	le.Promote(0)
+	<-donec
+}
+
+// TestLessorHoldRelease ensures a held lease survives past its TTL, also across
+// renewals and promotions, and expires again after release.
+func TestLessorHoldRelease(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	if _, err := le.Grant(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Hold(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Hold(2); err != ErrLeaseNotFound {
+		t.Errorf("hold missing lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+
+	fc.Advance(10 * time.Second)
+	if ttl, err := le.Renew(1); err != nil || ttl != 5 {
+		t.Errorf("renew held lease = %d, %v, want 5, nil", ttl, err)
+	}
+	le.Demote()
+	le.Promote(0)
+	if len(le.HandoffState()) != 0 {
+		t.Errorf("handoff state = %v, want none for held lease", le.HandoffState())
+	}
+	fc.Advance(10 * time.Second)
+	le.mu.Lock()
+	expired := le.findExpiredLeases(16)
+	le.mu.Unlock()
+	if len(expired) != 0 {
+		t.Fatalf("expired leases = %v, want none while held", expired)
+	}
+	if r := le.Lookup(1).Remaining(); r != forever {
+		t.Fatalf("remaining of held lease = %v, want forever", r)
+	}
+
+	if err := le.Release(1); err != nil {
+		t.Fatal(err)
+	}
+	if r := le.Lookup(1).Remaining(); r != 5*time.Second {
+		t.Errorf("remaining of released lease = %v, want 5s", r)
+	}
+	fc.Advance(5 * time.Second)
+	select {
+	case batch := <-le.ExpiredLeaseBatchC():
+		if len(batch.Leases) == 0 || batch.Leases[0].ID != 1 {
+			t.Fatalf("expired leases = %v, want lease 1", batch.Leases)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("released lease did not expire")
+	}
+}
+
+// TestLessorExpiredBatchSplit ensures many leases expiring together reach the
+// consumer in capped batches that do not mix leases expiring apart.
+func TestLessorExpiredBatchSplit(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	cfg := LessorConfig{
+		MinLeaseTTL:      1,
+		ExpiredBatchSize: 10,
+		ExpiryEpsilon:    100 * time.Millisecond,
+		clock:            fc,
+	}
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+	le.Promote(0)
+
+	for id := LeaseID(1); id <= 95; id++ {
+		if _, err := le.Grant(id, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc.Advance(500 * time.Millisecond)
+	for id := LeaseID(96); id <= 100; id++ {
+		if _, err := le.Grant(id, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc.Advance(20 * time.Second)
+
+	var sizes []int
+	for n := 0; n < 100; {
+		select {
+		case batch := <-le.ExpiredLeaseBatchC():
+			late := batch.Leases[0].ID > 95
+			for _, l := range batch.Leases {
+				if (l.ID > 95) != late {
+					t.Fatalf("batch %v mixes leases expiring apart", batch.Leases)
+				}
+			}
+			sizes = append(sizes, len(batch.Leases))
+			n += len(batch.Leases)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("received %d expired leases, want 100", n)
+		}
+	}
+	if wsizes := []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 5, 5}; !reflect.DeepEqual(sizes, wsizes) {
+		t.Errorf("batch sizes = %v, want %v", sizes, wsizes)
+	}
+}
+
+// TestLessorRevokeExpired ensures RevokeExpired revokes a lease only if it is
+// still expired.
+func TestLessorRevokeExpired(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.RevokeExpired(1); !errors.Is(err, ErrNotPrimary) {
+		t.Fatalf("revoke on non-primary = %v, want %v", err, ErrNotPrimary)
+	}
+
+	le.Promote(0)
+	fc.Advance(5 * time.Second)
+	if err := le.RevokeExpired(1); err != ErrLeaseRenewed {
+		t.Fatalf("revoke of live lease = %v, want %v", err, ErrLeaseRenewed)
+	}
+	if le.Lookup(1) == nil {
+		t.Fatal("live lease is revoked")
+	}
+
+	fc.Advance(5 * time.Second)
+	if err := le.RevokeExpired(1); err != nil {
+		t.Fatal(err)
+	}
+	if le.Lookup(1) != nil {
+		t.Error("got revoked lease 1")
+	}
+}
+
+// TestLessorRevokeIdempotent ensures revoking a lease twice succeeds only
+// with RevokeIdempotent.
+func TestLessorRevokeIdempotent(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	if _, err := le.Grant(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.RevokeIdempotent(1); err != nil {
+		t.Fatal("failed to revoke lease:", err)
+	}
+	if le.Lookup(1) != nil {
+		t.Error("got revoked lease 1")
+	}
+	if err := le.RevokeIdempotent(1); err != nil {
+		t.Errorf("revoke again = %v, want <nil>", err)
+	}
+	if err := le.Revoke(1); err != ErrLeaseNotFound {
+		t.Errorf("strict revoke again = %v, want %v", err, ErrLeaseNotFound)
+	}
+}
+
+// TestLessorRevokeByPrefix ensures RevokeByPrefix revokes only the leases
+// whose ID has the given high byte.
+func TestLessorRevokeByPrefix(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	fooID := func(i int) LeaseID { return LeaseID(0x01<<56 | i) }
+	barID := func(i int) LeaseID { return LeaseID(0x02<<56 | i) }
+	for i := 1; i <= 3; i++ {
+		if _, err := le.Grant(fooID(i), 100); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := le.Grant(barID(i), 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := le.RevokeByPrefix(0x01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("revoked = %d, want 3", n)
+	}
+	for i := 1; i <= 3; i++ {
+		if le.Lookup(fooID(i)) != nil {
+			t.Errorf("got revoked lease %x", fooID(i))
+		}
+		if le.Lookup(barID(i)) == nil {
+			t.Errorf("lease %x is unexpectedly revoked", barID(i))
+		}
+	}
+
+	if n, err = le.RevokeByPrefix(0x01); err != nil || n != 0 {
+		t.Errorf("revoke again = %d, %v, want 0, <nil>", n, err)
+	}
+}
+
+// TestLessorRevokePreview ensures RevokePreview lists the keys attached to
+// TestLessorItemCount ensures ItemCount counts the items attached to a lease.
+// TestLessorItemTTL ensures items attached with a TTL are detached and
+// deleted once it passes, while the lease lives on.
+func TestLessorItemTTL(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc, ExpiryScheduler: ms})
+	defer le.Stop()
+	<-ms.runc
+	var fds []*fakeDeleter
+	le.SetRangeDeleter(func() TxnDelete {
+		fd := newFakeDeleter(be)
+		fds = append(fds, fd)
+		return fd
+	})
+	le.Promote(0)
+
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = le.Grant(2, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err = le.AttachWithOptions(1, []LeaseItem{{Key: "foo"}}, AttachOptions{TTL: -time.Second}); err != ErrInvalidItemTTL {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidItemTTL)
+	}
+	ttl := AttachOptions{TTL: 5 * time.Second}
+	for _, key := range []string{"expired", "reattached", "detached"} {
+		if err = le.AttachWithOptions(1, []LeaseItem{{Key: key}}, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = le.Attach(1, []LeaseItem{{Key: "kept"}, {Key: "reattached"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = le.Detach(1, []LeaseItem{{Key: "detached"}}); err != nil {
+		t.Fatal(err)
+	}
+	// items of revoked leases no longer expire
+	if err = le.AttachWithOptions(2, []LeaseItem{{Key: "revoked"}}, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err = le.Revoke(2); err != nil {
+		t.Fatal(err)
+	}
+	fds = nil
+
+	fc.Advance(4 * time.Second)
+	// renewing the lease does not extend its items
+	if _, err = le.Renew(1); err != nil {
+		t.Fatal(err)
+	}
+	le.ScanExpired()
+	if len(fds) != 0 {
+		t.Fatalf("deleted items before their expiry")
+	}
+
+	fc.Advance(2 * time.Second)
+	le.ScanExpired()
+	var deleted []string
+	for _, fd := range fds {
+		deleted = append(deleted, fd.deleted...)
+	}
+	if wdeleted := []string{"expired_"}; !reflect.DeepEqual(deleted, wdeleted) {
+		t.Errorf("deleted = %v, want %v", deleted, wdeleted)
+	}
+	if le.Lookup(1) != l {
+		t.Fatal("lease with an expired item not alive")
+	}
+	keys := l.Keys()
+	sort.Strings(keys)
+	if wkeys := []string{"kept", "reattached"}; !reflect.DeepEqual(keys, wkeys) {
+		t.Errorf("keys = %v, want %v", keys, wkeys)
+	}
+	if id := le.GetLease(LeaseItem{Key: "expired"}); id != NoLease {
+		t.Errorf("lease of expired item = %x, want %x", id, NoLease)
+	}
+	if n := len(le.itemExpiryMap); n != 0 {
+		t.Errorf("scheduled item expiries = %d, want 0", n)
+	}
+}
+
+// TestLessorGrantWhileItemExpiry ensures granting leases does not deadlock
+// with the expiration loop deleting expired items.
+func TestLessorGrantWhileItemExpiry(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc, ExpiryScheduler: ms})
+	defer le.Stop()
+	// hold the lock of the batch tx for a while so that the next grant runs
+	// meanwhile.
+	deletingc := make(chan struct{}, 1)
+	le.SetRangeDeleter(func() TxnDelete {
+		ld := &lookupDeleter{newFakeDeleter(be), le}
+		select {
+		case deletingc <- struct{}{}:
+		default:
+		}
+		time.Sleep(time.Millisecond)
+		return ld
+	})
+	<-ms.runc
+	le.Promote(0)
+
+	stopc, scanc := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(scanc)
+		for {
+			select {
+			case <-stopc:
+				return
+			default:
+			}
+			le.ScanExpired()
+		}
+	}()
+
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		for id := LeaseID(1); id <= 20; id++ {
+			if _, err := le.Grant(id, 100); err != nil {
+				t.Error(err)
+				return
+			}
+			item := []LeaseItem{{Key: fmt.Sprint(id)}}
+			if err := le.AttachWithOptions(id, item, AttachOptions{TTL: time.Second}); err != nil {
+				t.Error(err)
+				return
+			}
+			// expire the item and grant the next lease while deleting it
+			fc.Advance(2 * time.Second)
+			<-deletingc
+		}
+	}()
+
+	select {
+	case <-donec:
+	case <-time.After(10 * time.Second):
+		t.Fatal("grant deadlocked with item expiry")
+	}
+	close(stopc)
+	<-scanc
+}
+
+func TestLessorItemCount(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	if _, err := le.ItemCount(1); err != ErrLeaseNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if _, err := le.Grant(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := le.ItemCount(1); err != nil || n != 0 {
+		t.Fatalf("items of fresh lease = %d, %v, want 0, <nil>", n, err)
+	}
+	if err := le.Attach(1, []LeaseItem{{"a"}, {"b"}, {"c"}, {"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := le.ItemCount(1); err != nil || n != 3 {
+		t.Fatalf("items = %d, %v, want 3, <nil>", n, err)
+	}
+	if err := le.Detach(1, []LeaseItem{{"b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := le.ItemCount(1); err != nil || n != 2 {
+		t.Fatalf("items after detach = %d, %v, want 2, <nil>", n, err)
+	}
+}
+
+// a lease without revoking it.
+func TestLessorRevokePreview(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	var fd *fakeDeleter
+	le.SetRangeDeleter(func() TxnDelete {
+		fd = newFakeDeleter(be)
+		return fd
+	})
+
+	if _, err := le.RevokePreview(1); err != ErrLeaseNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrLeaseNotFound)
+	}
+
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatalf("could not grant lease for 100s ttl (%v)", err)
+	}
+	items := []LeaseItem{{"foo"}, {"bar"}, {"baz"}}
+	if err = le.Attach(l.ID, items); err != nil {
+		t.Fatalf("failed to attach items to the lease: %v", err)
+	}
+
+	keys, err := le.RevokePreview(l.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wkeys := []string{"bar", "baz", "foo"}; !reflect.DeepEqual(keys, wkeys) {
+		t.Errorf("keys = %v, want %v", keys, wkeys)
+	}
+
+	if fd != nil {
+		t.Errorf("preview unexpectedly deleted %v", fd.deleted)
+	}
+	if le.Lookup(l.ID) == nil {
+		t.Errorf("lease %x is revoked by preview", l.ID)
+	}
+	if len(l.Keys()) != len(items) {
+		t.Errorf("len(keys) = %d, want %d", len(l.Keys()), len(items))
+	}
+}
+
+// TestLessorLeaseInfo ensures LeaseInfo describes a lease and its grant
+// time survives recovery.
+func TestLessorLeaseInfo(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	if _, err := le.LeaseInfo(1, 0); err != ErrLeaseNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrLeaseNotFound)
+	}
+
+	before := time.Now()
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = le.Attach(l.ID, []LeaseItem{{"foo"}, {"bar"}, {"baz"}}); err != nil {
+		t.Fatal(err)
+	}
+	le.Promote(0)
+
+	info, err := le.LeaseInfo(l.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != l.ID || info.TTL != 100 || info.KeyCount != 3 {
+		t.Errorf("info = %+v, want ID %x, TTL 100 and 3 keys", info, l.ID)
+	}
+	if info.TimeToLive != 99 && info.TimeToLive != 100 {
+		t.Errorf("time to live = %d, want 99 or 100", info.TimeToLive)
+	}
+	if wkeys := []string{"bar", "baz"}; !reflect.DeepEqual(info.Keys, wkeys) {
+		t.Errorf("keys = %v, want %v", info.Keys, wkeys)
+	}
+	if info.GrantedAt.Before(before) || info.GrantedAt.After(time.Now()) {
+		t.Errorf("granted at %v, want between %v and now", info.GrantedAt, before)
+	}
+
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer nle.Stop()
+	ninfo, err := nle.LeaseInfo(l.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ninfo.GrantedAt.Before(info.GrantedAt) || ninfo.GrantedAt.After(time.Now()) {
+		t.Errorf("recovered granted at %v, want between %v and now", ninfo.GrantedAt, info.GrantedAt)
+	}
+	if ninfo.Keys != nil {
+		t.Errorf("keys = %v, want none", ninfo.Keys)
+	}
+}
+
+// TestLessorForEachLease ensures ForEachLease visits copies of the leases and
+// stops once the visitor returns false.
+func TestLessorForEachLease(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err := le.Grant(LeaseID(i), 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := le.Attach(LeaseID(i), []LeaseItem{{fmt.Sprintf("foo%d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[LeaseID]bool)
+	le.ForEachLease(func(l *Lease) bool {
+		seen[l.ID] = true
+		return true
+	})
+	if len(seen) != 10 {
+		t.Fatalf("visited %d leases, want 10", len(seen))
+	}
+
+	visited := 0
+	le.ForEachLease(func(l *Lease) bool {
+		visited++
+		if l == le.leaseMap[l.ID] {
+			t.Errorf("visited lease %x is not a copy", l.ID)
+		}
+		if !l.Equal(le.leaseMap[l.ID]) {
+			t.Errorf("copy of lease %x differs from the lease", l.ID)
+		}
+		// modifying the copy leaves the lease alone
+		l.itemSet[LeaseItem{"bar"}] = struct{}{}
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Errorf("visited %d leases, want 3", visited)
+	}
+	for i := 1; i <= 10; i++ {
+		if keys := le.Lookup(LeaseID(i)).Keys(); len(keys) != 1 {
+			t.Errorf("keys of lease %x = %v after modifying its copy", i, keys)
+		}
+	}
+}
+
+// TestLessorTopLeasesByItems ensures item counts follow attachments, revokes
+// and reattachment after recovery.
+func TestLessorTopLeasesByItems(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	items := map[LeaseID][]LeaseItem{
+		1: {{"a"}},
+		2: {{"b"}, {"c"}, {"d"}},
+		3: {{"e"}, {"f"}},
+		4: {{"g"}, {"h"}, {"i"}, {"j"}},
+	}
+	for id, its := range items {
+		if _, err := le.GrantWithOptions(id, 100, GrantOptions{Items: its}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Detach(4, []LeaseItem{{"g"}, {"h"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Revoke(2); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(ls []*Lease) []LeaseID {
+		var ids []LeaseID
+		for _, l := range ls {
+			ids = append(ids, l.ID)
+		}
+		return ids
+	}
+	if got := ids(le.TopLeasesByItems(2)); !reflect.DeepEqual(got, []LeaseID{3, 4}) {
+		t.Errorf("top leases = %v, want [3 4]", got)
+	}
+	if got := le.TopLeasesByItems(0); len(got) != 0 {
+		t.Errorf("top 0 leases = %v, want none", ids(got))
+	}
+	if info, _ := le.LeaseInfo(4, 0); info.KeyCount != 2 {
+		t.Errorf("key count = %d, want 2", info.KeyCount)
+	}
+
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer nle.Stop()
+	nle.Reattach(map[LeaseID][]LeaseItem{1: items[1], 3: items[3]})
+	if got := ids(nle.TopLeasesByItems(10)); !reflect.DeepEqual(got, []LeaseID{3, 1, 4}) {
+		t.Errorf("recovered top leases = %v, want [3 1 4]", got)
+	}
+	if n := nle.Lookup(3).ItemCount(); n != 2 {
+		t.Errorf("recovered item count = %d, want 2", n)
+	}
+}
+
+// TestLessorGrantedAt ensures the grant time is kept on renew, but not
+// persisted, as it differs among members; recovered leases take the time of
+// their recovery.
+func TestLessorGrantedAt(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grantedAt := l.GrantedAt()
+	if !grantedAt.Equal(fc.Now()) {
+		t.Errorf("granted at = %v, want %v", grantedAt, fc.Now())
+	}
+	fc.Advance(time.Second)
+	if _, err = le.Renew(l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !le.Lookup(l.ID).GrantedAt().Equal(grantedAt) {
+		t.Errorf("granted at = %v after renew, want %v", le.Lookup(l.ID).GrantedAt(), grantedAt)
+	}
+
+	tx := be.BatchTx()
+	tx.Lock()
+	_, vs := tx.UnsafeRange(leaseBucketName, int64ToBytes(int64(l.ID)), nil, 0)
+	tx.Unlock()
+	var lpb leasepb.Lease
+	if len(vs) != 1 {
+		t.Fatalf("lease records = %d, want 1", len(vs))
+	}
+	if err = lpb.Unmarshal(vs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if lpb.GrantedAt != 0 {
+		t.Errorf("persisted granted at = %d, want 0", lpb.GrantedAt)
+	}
+
+	fc.Advance(time.Second)
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, clock: fc})
+	defer nle.Stop()
+	if nl := nle.Lookup(1); nl == nil || !nl.GrantedAt().Equal(fc.Now()) {
+		t.Errorf("recovered lease 1 = %+v, want granted at %v", nl, fc.Now())
+	}
+}
+
+// TestLessorRenew ensures Lessor can renew an existing lease.
+func TestLessorRenew(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer be.Close()
+	defer os.RemoveAll(dir)
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.Promote(0)
+
+	l, err := le.Grant(1, minLeaseTTL)
+	if err != nil {
+		t.Fatalf("failed to grant lease (%v)", err)
+	}
+
+	// manually change the ttl field
+	le.mu.Lock()
+	l.ttl = 10
+	le.mu.Unlock()
+	ttl, err := le.Renew(l.ID)
+	if err != nil {
+		t.Fatalf("failed to renew lease (%v)", err)
+	}
+	if ttl != l.ttl {
+		t.Errorf("ttl = %d, want %d", ttl, l.ttl)
+	}
+
+	l = le.Lookup(l.ID)
+	if l.Remaining() < 9*time.Second {
+		t.Errorf("failed to renew the lease")
+	}
+}
+
+// TestLessorRenewMissing ensures Renew of a missing lease fails unless the
+// lessor tolerates it.
+func TestLessorRenewMissing(t *testing.T) {
+	for _, tolerate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tolerate=%v", tolerate), func(t *testing.T) {
+			lg := zap.NewNop()
+			dir, be := NewTestBackend(t)
+			defer os.RemoveAll(dir)
+			defer be.Close()
+
+			le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, TolerateMissingRenew: tolerate})
+			defer le.Stop()
+			le.Promote(0)
+
+			ttl, err := le.Renew(1)
+			if tolerate {
+				if err != nil || ttl != 0 {
+					t.Errorf("renew = %d, %v, want 0, <nil>", ttl, err)
+				}
+			} else if err != ErrLeaseNotFound {
+				t.Errorf("renew = %d, %v, want %v", ttl, err, ErrLeaseNotFound)
+			}
+			if le.Lookup(1) != nil {
+				t.Error("renew of missing lease granted it")
+			}
+		})
+	}
+}
+
+// TestLessorMaxLifetime ensures renewals and promotions do not extend a
+// lease past its maximum lifetime.
+func TestLessorMaxLifetime(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer be.Close()
+	defer os.RemoveAll(dir)
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, MaxLifetime: 20 * time.Second})
+	defer le.Stop()
+	le.Promote(0)
+
+	l, err := le.Grant(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pretend the lease was granted 15 seconds ago
+	l.grantedAt = time.Now().Add(-15 * time.Second)
+
+	ttl, err := le.Renew(l.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 5 {
+		t.Errorf("ttl = %d, want 5", ttl)
+	}
+	if r := l.Remaining(); r > 5*time.Second || r < 4*time.Second {
+		t.Errorf("remaining = %v, want about 5s", r)
+	}
+
+	le.Demote()
+	le.Promote(time.Minute)
+	if r := l.Remaining(); r > 5*time.Second {
+		t.Errorf("remaining after promotion = %v, want at most 5s", r)
+	}
+
+	l.grantedAt = time.Now().Add(-21 * time.Second)
+	if _, err = le.Renew(l.ID); err != ErrLeaseLifetimeExceeded {
+		t.Errorf("err = %v, want %v", err, ErrLeaseLifetimeExceeded)
+	}
+}
+
+func TestLessorRenewWithCheckpointer(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer be.Close()
+	defer os.RemoveAll(dir)
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	fakerCheckerpointer := func(ctx context.Context, cp *pb.LeaseCheckpointRequest) {
+		for _, cp := range cp.GetCheckpoints() {
+			le.Checkpoint(LeaseID(cp.GetID()), cp.GetRemaining_TTL())
+		}
+	}
+	defer le.Stop()
+	// Set checkpointer
+	le.SetCheckpointer(fakerCheckerpointer)
+	le.Promote(0)
+
+	l, err := le.Grant(1, minLeaseTTL)
+	if err != nil {
+		t.Fatalf("failed to grant lease (%v)", err)
+	}
+
+	// manually change the ttl field
+	le.mu.Lock()
+	l.ttl = 10
+	l.remainingTTL = 10
+	le.mu.Unlock()
+	ttl, err := le.Renew(l.ID)
+	if err != nil {
+		t.Fatalf("failed to renew lease (%v)", err)
+	}
+	if ttl != l.ttl {
+		t.Errorf("ttl = %d, want %d", ttl, l.ttl)
+	}
+	if l.remainingTTL != 0 {
+		t.Fatalf("remianingTTL = %d, want %d", l.remainingTTL, 0)
+	}
+
+	l = le.Lookup(l.ID)
+	if l.Remaining() < 9*time.Second {
+		t.Errorf("failed to renew the lease")
+	}
+}
+
+// TestLessorRenewExtendPileup ensures Lessor extends leases on promotion if too many
+// expire at the same time.
+func TestLessorRenewExtendPileup(t *testing.T) {
+	oldRevokeRate := leaseRevokeRate
+	defer func() { leaseRevokeRate = oldRevokeRate }()
+	lg := zap.NewNop()
+	leaseRevokeRate = 10
+
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	ttl := int64(10)
+	for i := 1; i <= leaseRevokeRate*10; i++ {
+		if _, err := le.Grant(LeaseID(2*i), ttl); err != nil {
+			t.Fatal(err)
+		}
+		// ttls that overlap spillover for ttl=10
+		if _, err := le.Grant(LeaseID(2*i+1), ttl+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// simulate stop and recovery
+	le.Stop()
+	be.Close()
+	bcfg := backend.DefaultBackendConfig()
+	bcfg.Path = filepath.Join(dir, "be")
+	be = backend.New(bcfg)
+	defer be.Close()
+	le = newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	// extend after recovery should extend expiration on lease pile-up
+	le.Promote(0)
+
+	windowCounts := make(map[int64]int)
+	for _, l := range le.leaseMap {
+		// round up slightly for baseline ttl
+		s := int64(l.Remaining().Seconds() + 0.1)
+		windowCounts[s]++
+	}
+
+	for i := ttl; i < ttl+20; i++ {
+		c := windowCounts[i]
+		if c > leaseRevokeRate {
+			t.Errorf("expected at most %d expiring at %ds, got %d", leaseRevokeRate, i, c)
+		}
+		if c < leaseRevokeRate/2 {
+			t.Errorf("expected at least %d expiring at %ds, got %d", leaseRevokeRate/2, i, c)
+		}
+	}
+}
+
+func TestLessorDetach(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	// grant a lease with long term (100 seconds) to
+	// avoid early termination during the test.
+	l, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatalf("could not grant lease for 100s ttl (%v)", err)
+	}
+
+	items := []LeaseItem{
+		{"foo"},
+		{"bar"},
+	}
+
+	if err := le.Attach(l.ID, items); err != nil {
+		t.Fatalf("failed to attach items to the lease: %v", err)
+	}
+
+	if err := le.Detach(l.ID, items[0:1]); err != nil {
+		t.Fatalf("failed to de-attach items to the lease: %v", err)
+	}
+
+	l = le.Lookup(l.ID)
+	if len(l.itemSet) != 1 {
+		t.Fatalf("len(l.itemSet) = %d, failed to de-attach items", len(l.itemSet))
+	}
+	if _, ok := l.itemSet[LeaseItem{"bar"}]; !ok {
+		t.Fatalf("de-attached wrong item, want %q exists", "bar")
+	}
+}
+
+// TestLessorAttachDetachBatch ensures batched attachments apply to all
+// leases of the batch or to none of them.
+func TestLessorAttachDetachBatch(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := map[LeaseID][]LeaseItem{
+		1: {{"foo"}, {"bar"}},
+		2: {{"baz"}},
+		3: {{"qux"}},
+	}
+	if err := le.AttachBatch(batch); err != ErrLeaseNotFound {
+		t.Fatalf("attach with missing lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if id := le.GetLease(LeaseItem{"foo"}); id != NoLease {
+		t.Fatalf("item attached to lease %x after failed batch", id)
+	}
+
+	delete(batch, 3)
+	if err := le.AttachBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	for id, items := range batch {
+		for _, it := range items {
+			if got := le.GetLease(it); got != id {
+				t.Errorf("lease of %q = %x, want %x", it.Key, got, id)
+			}
+		}
+	}
+
+	detach := map[LeaseID][]LeaseItem{1: {{"foo"}}, 2: {{"baz"}}, 3: {{"qux"}}}
+	if err := le.DetachBatch(detach); err != ErrLeaseNotFound {
+		t.Fatalf("detach with missing lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if id := le.GetLease(LeaseItem{"foo"}); id != 1 {
+		t.Fatalf("item detached from lease 1 after failed batch")
+	}
+
+	delete(detach, 3)
+	if err := le.DetachBatch(detach); err != nil {
+		t.Fatal(err)
+	}
+	if keys := le.Lookup(1).Keys(); !reflect.DeepEqual(keys, []string{"bar"}) {
+		t.Errorf("keys of lease 1 = %v, want [bar]", keys)
+	}
+	if keys := le.Lookup(2).Keys(); len(keys) != 0 {
+		t.Errorf("keys of lease 2 = %v, want none", keys)
+	}
+}
+
+// TestLessorTransferItems ensures items move between leases at once and stay
+// in place if either lease is missing.
+func TestLessorTransferItems(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := le.TransferItems(1, 3, []LeaseItem{{"foo"}}); err != ErrLeaseNotFound {
+		t.Fatalf("transfer to missing lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if id := le.GetLease(LeaseItem{"foo"}); id != 1 {
+		t.Fatalf("lease of foo = %x after failed transfer, want 1", id)
+	}
+	// baz is not attached to lease 1, so foo is not moved either
+	if err := le.TransferItems(1, 2, []LeaseItem{{"foo"}, {"baz"}}); err != ErrKeyNotLeased {
+		t.Fatalf("transfer of unattached item = %v, want %v", err, ErrKeyNotLeased)
+	}
+	if id := le.GetLease(LeaseItem{"foo"}); id != 1 {
+		t.Fatalf("lease of foo = %x after failed transfer, want 1", id)
+	}
+	if id := le.GetLease(LeaseItem{"baz"}); id != NoLease {
+		t.Fatalf("lease of baz = %x after failed transfer, want none", id)
+	}
+
+	if err := le.TransferItems(1, 2, []LeaseItem{{"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if id := le.GetLease(LeaseItem{"foo"}); id != 2 {
+		t.Errorf("lease of foo = %x, want 2", id)
+	}
+	if keys := le.Lookup(1).Keys(); !reflect.DeepEqual(keys, []string{"bar"}) {
+		t.Errorf("keys of lease 1 = %v, want [bar]", keys)
+	}
+	if keys := le.Lookup(2).Keys(); !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Errorf("keys of lease 2 = %v, want [foo]", keys)
+	}
+}
+
+// TestLessorTransfer ensures Transfer moves all items of a lease to another.
+func TestLessorTransfer(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Attach(2, []LeaseItem{{"baz"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ids := range [][2]LeaseID{{1, 3}, {3, 1}} {
+		if err := le.Transfer(ids[0], ids[1]); err != ErrLeaseNotFound {
+			t.Fatalf("transfer from %x to %x = %v, want %v", ids[0], ids[1], err, ErrLeaseNotFound)
+		}
+	}
+	if err := le.Transfer(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := le.Lookup(1).ItemCount(); n != 2 {
+		t.Fatalf("items of lease 1 = %d after transfer to itself, want 2", n)
+	}
+
+	if err := le.Transfer(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := le.Lookup(1).ItemCount(); n != 0 {
+		t.Errorf("items of lease 1 = %d, want 0", n)
+	}
+	keys := le.Lookup(2).Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"bar", "baz", "foo"}) {
+		t.Errorf("keys of lease 2 = %v, want [bar baz foo]", keys)
+	}
+	for _, k := range keys {
+		if id := le.GetLease(LeaseItem{k}); id != 2 {
+			t.Errorf("lease of %s = %x, want 2", k, id)
+		}
+	}
+}
+
+// TestLessorPromoteHugeTTL ensures recovered leases with TTLs too large for
+// the expiry arithmetic do not expire right after Promote.
+func TestLessorPromoteHugeTTL(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	maxSeconds := int64(math.MaxInt64 / int64(time.Second))
+	records := []leasepb.Lease{
+		{ID: 1, TTL: math.MaxInt64},
+		{ID: 2, TTL: maxSeconds},
+		{ID: 3, TTL: 10, RemainingTTL: math.MaxInt64},
+	}
+	tx := be.BatchTx()
+	tx.Lock()
+	tx.UnsafeCreateBucket(leaseBucketName)
+	for _, lpb := range records {
+		val, err := lpb.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.UnsafePut(leaseBucketName, int64ToBytes(lpb.ID), val)
+	}
+	tx.Unlock()
+
+	fc := newFakeClock()
+	fc.Advance(time.Hour)
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(time.Minute)
+	fc.Advance(time.Second)
+
+	for _, lpb := range records {
+		if rem := le.Lookup(LeaseID(lpb.ID)).Remaining(); rem <= 0 {
+			t.Errorf("remaining of lease %d = %v, want positive", lpb.ID, rem)
+		}
+	}
+	le.ScanExpired()
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		t.Fatalf("leases %v expired after promotion", b.Leases)
+	default:
+	}
+}
+
+// TestLessorRecover ensures Lessor recovers leases from
+// persist backend.
+func TestLessorRecover(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	l1, err1 := le.Grant(1, 10)
+	l2, err2 := le.Grant(2, 20)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("could not grant initial leases (%v, %v)", err1, err2)
+	}
+
+	// Create a new lessor with the same backend
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer nle.Stop()
+	nl1 := nle.Lookup(l1.ID)
+	if nl1 == nil || nl1.ttl != l1.ttl {
+		t.Errorf("nl1 = %v, want nl1.ttl= %d", nl1.ttl, l1.ttl)
+	}
+
+	nl2 := nle.Lookup(l2.ID)
+	if nl2 == nil || nl2.ttl != l2.ttl {
+		t.Errorf("nl2 = %v, want nl2.ttl= %d", nl2.ttl, l2.ttl)
+	}
+}
+
+// TestLessorRefreshFromBackend ensures RefreshFromBackend picks up a TTL
+// changed in the backend.
+func TestLessorRefreshFromBackend(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	l, err := le.Grant(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(5 * time.Second)
+
+	lpb := l.proto()
+	lpb.TTL = 30
+	val, err := lpb.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := int64ToBytes(int64(l.ID))
+	be.BatchTx().Lock()
+	be.BatchTx().UnsafePut(leaseBucketName, key, val)
+	be.BatchTx().Unlock()
+
+	if err = le.RefreshFromBackend(1); err != nil {
+		t.Fatal(err)
+	}
+	if l.TTL() != 30 || l.Remaining() != 30*time.Second {
+		t.Errorf("refreshed lease = (%d, %v), want (30, 30s)", l.TTL(), l.Remaining())
+	}
+
+	if err = le.RefreshFromBackend(2); err != ErrLeaseNotFound {
+		t.Errorf("refresh missing lease = %v, want %v", err, ErrLeaseNotFound)
+	}
+	be.BatchTx().Lock()
+	be.BatchTx().UnsafeDelete(leaseBucketName, key)
+	be.BatchTx().Unlock()
+	if err = le.RefreshFromBackend(1); err != ErrLeaseNotFound {
+		t.Errorf("refresh lease missing from backend = %v, want %v", err, ErrLeaseNotFound)
+	}
+}
+
+// TestLessorRecordVersion ensures lease records are persisted with their
+// version, records written before versioning are recovered, and records of a
+// later version are refused.
+func TestLessorRecordVersion(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	putRecord := func(lpb leasepb.Lease) {
+		val, err := lpb.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		be.BatchTx().Lock()
+		be.BatchTx().UnsafePut(leaseBucketName, int64ToBytes(lpb.ID), val)
+		be.BatchTx().Unlock()
+	}
+	putRecord(leasepb.Lease{ID: 2, TTL: 20})
+
+	be.BatchTx().Lock()
+	_, vs := be.BatchTx().UnsafeRange(leaseBucketName, int64ToBytes(1), nil, 0)
+	be.BatchTx().Unlock()
+	var lpb leasepb.Lease
+	if err := lpb.Unmarshal(vs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if lpb.Version != leaseRecordVersion {
+		t.Errorf("persisted version = %d, want %d", lpb.Version, leaseRecordVersion)
+	}
+	le.Stop()
+
+	le = newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	if l := le.Lookup(2); l == nil || l.TTL() != 20 {
+		t.Fatalf("unversioned lease 2 = %+v, want TTL 20", l)
+	}
+
+	putRecord(leasepb.Lease{ID: 1, TTL: 10, Version: leaseRecordVersion + 1})
+	err := le.RefreshFromBackend(1)
+	var verr *RecordVersionError
+	if !errors.As(err, &verr) || !errors.Is(err, ErrLeaseRecordVersion) {
+		t.Fatalf("refresh of newer record = %v, want %v", err, ErrLeaseRecordVersion)
+	}
+	if verr.ID != 1 || verr.Version != leaseRecordVersion+1 {
+		t.Errorf("version error = %+v, want lease 1 of version %d", verr, leaseRecordVersion+1)
+	}
+	if err := le.Recover(be, nil); !errors.As(err, &verr) || verr.ID != 1 {
+		t.Errorf("recover of newer record = %v, want version error of lease 1", err)
+	}
+	le.Stop()
+
+	if _, err := NewLessorWithConfig(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL}); !errors.As(err, &verr) || verr.ID != 1 {
+		t.Errorf("start on newer record = %v, want version error of lease 1", err)
+	}
+}
+
+// TestLessorMaxLeaseID ensures the highest granted lease ID survives the
+// revocation of its lease and restarts.
+func TestLessorMaxLeaseID(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	if id := le.MaxLeaseID(); id != NoLease {
+		t.Fatalf("max lease id of empty lessor = %x, want none", id)
+	}
+	for _, id := range []LeaseID{1, 5, 3} {
+		if _, err := le.Grant(id, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Revoke(5); err != nil {
+		t.Fatal(err)
+	}
+	if id := le.MaxLeaseID(); id != 5 {
+		t.Errorf("max lease id = %x, want 5", id)
+	}
+	le.Stop()
+
+	le = newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	if id := le.MaxLeaseID(); id != 5 {
+		t.Errorf("max lease id after restart = %x, want 5", id)
+	}
+}
+
+// TestLessorMigrateRecords ensures a lessor started on a bucket of records
+// written before versioning migrates them once, and refuses a bucket of a
+// later schema version.
+func TestLessorMigrateRecords(t *testing.T) {
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	tx := be.BatchTx()
+	tx.Lock()
+	tx.UnsafeCreateBucket(leaseBucketName)
+	for _, lpb := range []leasepb.Lease{{ID: 1, TTL: 10}, {ID: 2, TTL: 20}} {
+		val, err := lpb.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.UnsafePut(leaseBucketName, int64ToBytes(lpb.ID), val)
+	}
+	tx.Unlock()
+
+	migrations := func() []observer.LoggedEntry {
+		core, logs := observer.New(zap.InfoLevel)
+		le := newLessor(zap.New(core), be, LessorConfig{MinLeaseTTL: 1})
+		defer le.Stop()
+		if l := le.Lookup(2); l == nil || l.TTL() != 20 {
+			t.Fatalf("migrated lease 2 = %+v, want TTL 20", l)
+		}
+		return logs.FilterMessage("migrated lease records").AllUntimed()
+	}
+	entries := migrations()
+	if len(entries) != 1 || entries[0].ContextMap()["records"] != int64(2) {
+		t.Fatalf("migration logs = %v, want one of 2 records", entries)
+	}
+
+	tx.Lock()
+	_, vs := tx.UnsafeRange(leaseBucketName, int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	for _, v := range vs {
+		var lpb leasepb.Lease
+		if err := lpb.Unmarshal(v); err != nil {
+			t.Fatal(err)
+		}
+		if lpb.Version != leaseRecordVersion {
+			t.Errorf("version of migrated lease %x = %d, want %d", lpb.ID, lpb.Version, leaseRecordVersion)
+		}
+	}
+	tx.Unlock()
+
+	// migrated once
+	if entries = migrations(); len(entries) != 0 {
+		t.Errorf("migration logs on restart = %v, want none", entries)
+	}
+
+	tx.Lock()
+	tx.UnsafePut(leaseBucketName, leaseSchemaKey, []byte{0, 0, 0, byte(leaseRecordVersion + 1)})
+	tx.Unlock()
+	_, err := NewLessorWithConfig(zap.NewNop(), be, LessorConfig{MinLeaseTTL: 1})
+	var verr *RecordVersionError
+	if !errors.As(err, &verr) || verr.ID != NoLease || verr.Version != leaseRecordVersion+1 {
+		t.Errorf("start on newer schema = %v, want version error of the bucket", err)
+	}
+}
+
+// TestLessorReattach ensures Reattach restores the items of recovered leases
+// and reports the leases that do not exist.
+func TestLessorReattach(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	if _, err := le.GrantWithOptions(1, 10, GrantOptions{Items: []LeaseItem{{"foo"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer nle.Stop()
+	var fd *fakeDeleter
+	nle.SetRangeDeleter(func() TxnDelete {
+		fd = newFakeDeleter(be)
+		return fd
+	})
+	if keys := nle.Lookup(1).Keys(); len(keys) != 0 {
+		t.Fatalf("keys of recovered lease = %v, want none before reattach", keys)
+	}
+
+	missing := nle.Reattach(map[LeaseID][]LeaseItem{
+		1: {{"foo"}},
+		3: {{"bar"}},
+		2: {{"baz"}},
+	})
+	if !reflect.DeepEqual(missing, []LeaseID{2, 3}) {
+		t.Errorf("missing = %v, want [2 3]", missing)
+	}
+	if id := nle.GetLease(LeaseItem{"foo"}); id != 1 {
+		t.Errorf("lease of foo = %x, want 1", id)
+	}
+	if id := nle.GetLease(LeaseItem{"bar"}); id != NoLease {
+		t.Errorf("lease of bar = %x, want none", id)
+	}
+
+	if err := nle.Revoke(1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fd.deleted, []string{"foo_"}) {
+		t.Errorf("deleted = %v, want [foo_]", fd.deleted)
+	}
+}
+
+// TestLessorRecoverBucketName ensures lessors sharing a backend through
+// distinct buckets grant and recover their leases independently.
+func TestLessorRecoverBucketName(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fooCfg := LessorConfig{MinLeaseTTL: minLeaseTTL, BucketName: "lease_foo"}
+	barCfg := LessorConfig{MinLeaseTTL: minLeaseTTL, BucketName: "lease_bar"}
+
+	fooLe := newLessor(lg, be, fooCfg)
+	barLe := newLessor(lg, be, barCfg)
+	fooLe.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	if _, err := fooLe.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fooLe.Grant(2, 20); err != nil {
+		t.Fatal(err)
+	}
+	// the same ID must not collide with the lease of the other lessor
+	if _, err := barLe.Grant(1, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := fooLe.Revoke(2); err != nil {
+		t.Fatal(err)
+	}
+	fooLe.Stop()
+	barLe.Stop()
+
+	fooLe = newLessor(lg, be, fooCfg)
+	defer fooLe.Stop()
+	barLe = newLessor(lg, be, barCfg)
+	defer barLe.Stop()
+
+	if ls := fooLe.Leases(); len(ls) != 1 || ls[0].ID != 1 || ls[0].ttl != 10 {
+		t.Errorf("foo leases = %+v, want lease 1 with ttl 10", ls)
+	}
+	if ls := barLe.Leases(); len(ls) != 1 || ls[0].ID != 1 || ls[0].ttl != 30 {
+		t.Errorf("bar leases = %+v, want lease 1 with ttl 30", ls)
+	}
+}
+
+// TestLessorCompactBucketName ensures Compact leaves the bucket of another
+// lessor sharing the backend alone.
+func TestLessorCompactBucketName(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fooLe := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, BucketName: "lease_foo"})
+	defer fooLe.Stop()
+	barLe := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, BucketName: "lease_bar"})
+	defer barLe.Stop()
+
+	if _, err := fooLe.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	for id := LeaseID(1); id <= 3; id++ {
+		if _, err := barLe.Grant(id, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fooLe.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := be.BatchTx()
+	tx.Lock()
+	_, foo := tx.UnsafeRange([]byte("lease_foo"), int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	_, bar := tx.UnsafeRange([]byte("lease_bar"), int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	tx.Unlock()
+	if len(foo) != 1 || len(bar) != 3 {
+		t.Errorf("records = %d in foo, %d in bar, want 1, 3", len(foo), len(bar))
+	}
+}
+
+// TestLessorGrantLogged ensures grants are logged while an idle lessor
+// stays silent.
+func TestLessorGrantLogged(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(zap.New(core), be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	// let runLoop look for expired leases at least once
+	time.Sleep(600 * time.Millisecond)
+
+	entries := logs.AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d, want 1: %v", len(entries), entries)
+	}
+	if entries[0].Message != "granted lease" {
+		t.Errorf("message = %q, want %q", entries[0].Message, "granted lease")
+	}
+	if id := entries[0].ContextMap()["lease-id"]; id != int64(1) {
+		t.Errorf("lease-id = %v, want 1", id)
+	}
+}
+
+// TestLessorStopThenCloseBackend ensures the backend can be closed as soon as
+// Stop returns.
+func TestLessorStopThenCloseBackend(t *testing.T) {
+	lg := zap.NewNop()
+	for i := 0; i < 1000; i++ {
+		dir, be := NewTestBackend(t)
+
+		le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, AutoRevoke: true})
+		for j := 1; j <= 10; j++ {
+			if _, err := le.Grant(LeaseID(j), 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// promote with the leases already expired so that runLoop revokes
+		// them concurrently with Stop
+		le.Promote(-time.Second)
+
+		le.Stop()
+		be.Close()
+		os.RemoveAll(dir)
+
+		select {
+		case <-le.doneC:
+		default:
+			t.Fatal("runLoop still running after Stop returned")
+		}
+		// stopping twice is a no-op
+		le.Stop()
+	}
+}
+
+// callMutators calls the lessor methods that change leases or the primary
+// state, and returns their errors by method.
+func callMutators(le *lessor, dump []byte) map[string]error {
+	errs := make(map[string]error)
+	_, errs["Grant"] = le.Grant(100, 10)
+	_, errs["GrantWithOptions"] = le.GrantWithOptions(101, 10, GrantOptions{})
+	_, errs["GrantDuration"] = le.GrantDuration(102, 10*time.Second)
+	_, errs["GrantPermanent"] = le.GrantPermanent(103)
+	errs["Revoke"] = le.Revoke(1)
+	errs["RevokeExpired"] = le.RevokeExpired(1)
+	_, errs["RevokeWithDeleted"] = le.RevokeWithDeleted(1)
+	errs["RevokeSync"] = le.RevokeSync(1)
+	errs["RevokeIdempotent"] = le.RevokeIdempotent(1)
+	errs["RefreshFromBackend"] = le.RefreshFromBackend(1)
+	errs["Checkpoint"] = le.Checkpoint(1, 5)
+	errs["Attach"] = le.Attach(1, []LeaseItem{{Key: "bar"}})
+	errs["AttachWithOptions"] = le.AttachWithOptions(1, []LeaseItem{{Key: "baz"}}, AttachOptions{TTL: time.Second})
+	errs["AttachBatch"] = le.AttachBatch(map[LeaseID][]LeaseItem{1: {{Key: "bar"}}})
+	errs["Detach"] = le.Detach(1, []LeaseItem{{Key: "foo"}})
+	_, errs["DetachAll"] = le.DetachAll(1)
+	errs["DetachBatch"] = le.DetachBatch(map[LeaseID][]LeaseItem{1: {{Key: "foo"}}})
+	errs["TransferItems"] = le.TransferItems(1, 2, []LeaseItem{{Key: "foo"}})
+	errs["Transfer"] = le.Transfer(1, 2)
+	errs["Promote"] = le.Promote(0)
+	errs["PromoteWithHandoff"] = le.PromoteWithHandoff(0, nil)
+	errs["Hold"] = le.Hold(1)
+	errs["Release"] = le.Release(1)
+	_, errs["Renew"] = le.Renew(1)
+	_, _, errs["RenewIfBelow"] = le.RenewIfBelow(1, time.Hour)
+	_, rerrs := le.RenewBatch([]LeaseID{1})
+	errs["RenewBatch"] = rerrs[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	errs["WaitExpired"] = le.WaitExpired(ctx, 1)
+	cancel()
+	errs["Compact"] = le.Compact()
+	_, errs["ReadFrom"] = le.ReadFrom(bytes.NewReader(dump))
+	errs["Demote"] = le.Demote()
+	errs["Reset"] = le.Reset()
+	return errs
+}
+
+// callOthers calls the lessor methods not called by callMutators.
+func callOthers(le *lessor, be backend.Backend) {
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.SetCheckpointer(func(context.Context, *pb.LeaseCheckpointRequest) {})
+	le.SetPrimaryHint("a")
+	le.SetPrimaryLeader(1)
+	le.RevokeByPrefix(0)
+	le.RevokeByKey([]byte("foo"))
+	le.RevokePreview(1)
+	le.ItemCount(1)
+	le.ResumeRevokes()
+	le.MaxLeaseID()
+	le.Reattach(map[LeaseID][]LeaseItem{1: {{Key: "foo"}}})
+	le.GetLease(LeaseItem{Key: "foo"})
+	le.DetachKey([]byte("foo"))
+	le.HandoffState()
+	le.OnPrimaryChange(func(bool) {})
+	le.Freeze()
+	le.Unfreeze()
+	le.LoopHealthy()
+	le.ScanExpired()
+	le.Health()
+	le.ExpiryDropCount()
+	le.LastScanDuration()
+	le.Snapshot()
+	le.Generation()
+	le.IsPrimary()
+	le.PrimaryGeneration()
+	le.Lookup(1)
+	le.LeaseInfo(1, 0)
+	le.ExpiryTime(1)
+	le.Leases()
+	le.ForEachLease(func(*Lease) bool { return true })
+	le.TopLeasesByItems(1)
+	le.ExpiringWithin(time.Hour)
+	le.StaleLeases(0)
+	le.Stats()
+	le.CountByTTLRange(0, 100)
+	le.ExpiredLeasesC()
+	le.ExpiredLeaseBatchC()
+	le.ExpiredAck([]LeaseID{1}, false)
+	le.WriteTo(ioutil.Discard)
+	le.Recover(be, func() TxnDelete { return newFakeDeleter(be) })
+}
+
+// TestLessorStopped ensures the methods of a stopped lessor do not panic,
+// the ones changing leases or the primary state return ErrLessorStopped,
+// and the others find no leases.
+func TestLessorStopped(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
+	for i := 1; i <= 2; i++ {
+		if _, err := le.Grant(LeaseID(i), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Attach(1, []LeaseItem{{Key: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if _, err := le.WriteTo(&dump); err != nil {
+		t.Fatal(err)
+	}
+	expiredC := le.ExpiredLeasesC()
+
+	le.Stop()
+	for method, err := range callMutators(le, dump.Bytes()) {
+		if err != ErrLessorStopped {
+			t.Errorf("%s err = %v, want %v", method, err, ErrLessorStopped)
+		}
+	}
+	callOthers(le, be)
+
+	if ls := le.Leases(); len(ls) != 0 {
+		t.Errorf("len(leases) = %d, want 0", len(ls))
+	}
+	if l := le.Lookup(1); l != nil {
+		t.Errorf("lookup = %v, want <nil>", l)
+	}
+	if id := le.GetLease(LeaseItem{Key: "foo"}); id != NoLease {
+		t.Errorf("lease of foo = %x, want %x", id, NoLease)
+	}
+	for _, c := range []<-chan []*Lease{expiredC, le.ExpiredLeasesC()} {
+		select {
+		case _, ok := <-c:
+			if ok {
+				t.Error("received expired leases from a stopped lessor")
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("expired leases chan not closed")
+		}
+	}
+	// stopping again is a no-op
+	le.Stop()
+}
+
+// TestLessorStopConcurrent ensures the lessor methods are safe to call
+// concurrently with Stop, and no goroutine of the lessor outlives it.
+func TestLessorStopConcurrent(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	lessorGoroutines := func() int {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		return strings.Count(string(buf), "lease.(*lessor)")
+	}
+	before := lessorGoroutines()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
+	var dump bytes.Buffer
+	le.WriteTo(&dump)
+	le.ExpiredLeasesC()
+
+	stopc := make(chan struct{})
+	var wg sync.WaitGroup
+	loop := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopc:
+					return
+				default:
+				}
+				f()
+			}
+		}()
+	}
+	// mutate from a single goroutine, as etcdserver applies in order;
+	// revocations take the backend lock before the lessor lock.
+	loop(func() {
+		callMutators(le, dump.Bytes())
+		callOthers(le, be)
+	})
+	for i := 0; i < 3; i++ {
+		loop(func() {
+			le.Leases()
+			le.Lookup(100)
+			le.LeaseInfo(100, 0)
+			le.Snapshot()
+			le.HandoffState()
+			le.WriteTo(ioutil.Discard)
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	le.Stop()
+	// let the callers run against the stopped lessor for a while
+	time.Sleep(100 * time.Millisecond)
+	close(stopc)
+
+	donec := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(donec)
+	}()
+	select {
+	case <-donec:
+	case <-time.After(10 * time.Second):
+		t.Fatal("lessor methods blocked after Stop")
+	}
+
+	var n int
+	for i := 0; i < 20; i++ {
+		if n = lessorGoroutines(); n <= before {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("lessor goroutine frames = %d after Stop, want <= %d", n, before)
+}
+
+// TestLessorRecoverWhileRunning ensures Recover is safe to call
+// concurrently with grants, renewals and expirations.
+func TestLessorRecoverWhileRunning(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	rd := func() TxnDelete { return newFakeDeleter(be) }
+	le.SetRangeDeleter(rd)
+	le.Promote(0)
+
+	stopc := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-stopc:
+				return
+			default:
+			}
+			le.Grant(LeaseID(i), 1)
+			le.Renew(LeaseID(i / 2))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case b := <-le.ExpiredLeaseBatchC():
+				for _, l := range b.Leases {
+					if le.Generation() == b.Generation {
+						le.Revoke(l.ID)
+					}
+				}
+			case <-stopc:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			time.Sleep(200 * time.Millisecond)
+			le.Recover(be, rd)
+			if le.Generation() != 0 {
+				t.Errorf("generation = %d after recover, want 0", le.Generation())
+			}
+			le.Promote(0)
+		}
+	}()
+
+	time.Sleep(2500 * time.Millisecond)
+	close(stopc)
+	wg.Wait()
+}
+
+// TestLessorCompact ensures Compact reclaims the space of revoked leases
+// and keeps the live ones.
+func TestLessorCompact(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	n := 10000
+	for i := 1; i <= n; i++ {
+		if _, err := le.Grant(LeaseID(i), 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	be.ForceCommit()
+	for i := 11; i <= n; i++ {
+		if err := le.Revoke(LeaseID(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a record left behind, as by revoking without range deleter
+	stale := &Lease{ID: LeaseID(n + 1), ttl: 100}
+	tx := be.BatchTx()
+	tx.Lock()
+	stale.unsafePersistTo(tx, leaseBucketName)
+	tx.Unlock()
+	be.ForceCommit()
+
+	size := be.Size()
+	if err := le.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if be.Size() >= size {
+		t.Errorf("size after compaction = %d, want < %d", be.Size(), size)
+	}
+
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer nle.Stop()
+	ls := nle.Leases()
+	if len(ls) != 10 {
+		t.Fatalf("len(leases) = %d, want 10", len(ls))
+	}
+	for _, l := range ls {
+		if l.ID < 1 || l.ID > 10 {
+			t.Errorf("recovered unexpected lease %x", l.ID)
+		}
+	}
+}
+
+// TestLessorCompactDuringRevoke ensures Compact keeps the record of a lease
+// being revoked, so that the revocation is resumed after a crash.
+func TestLessorCompactDuringRevoke(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	cfg := LessorConfig{MinLeaseTTL: minLeaseTTL, RevokeChunkSize: 1}
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+	deleting, unblock := make(chan struct{}), make(chan struct{})
+	txns := 0
+	le.SetRangeDeleter(func() TxnDelete {
+		if txns++; txns == 2 {
+			close(deleting)
+			<-unblock
+			panic("crash")
+		}
+		return newFakeDeleter(be)
+	})
+
+	items := []LeaseItem{{"a"}, {"b"}}
+	if _, err := le.GrantWithOptions(1, 100, GrantOptions{Items: items}); err != nil {
+		t.Fatal(err)
+	}
+	donec := make(chan struct{})
+	go func() {
+		defer func() {
+			if r := recover(); r != "crash" {
+				t.Errorf("recovered %v, want crash", r)
+			}
+			close(donec)
+		}()
+		le.Revoke(1)
+	}()
+	<-deleting
+	if err := le.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	close(unblock)
+	<-donec
+
+	nle := newLessor(lg, be, cfg)
+	defer nle.Stop()
+	nle.Reattach(map[LeaseID][]LeaseItem{1: items[1:]})
+	var fds []*fakeDeleter
+	nle.SetRangeDeleter(func() TxnDelete {
+		fd := newFakeDeleter(be)
+		fds = append(fds, fd)
+		return fd
+	})
+	if n := nle.ResumeRevokes(); n != 1 {
+		t.Fatalf("resumed = %d, want 1", n)
+	}
+	if len(fds) != 1 || !reflect.DeepEqual(fds[0].deleted, []string{"b_"}) {
+		t.Errorf("deleted = %v, want [b_]", fds)
+	}
+}
+
+func TestLessorReset(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.minLeaseTTL = 1
+	le.Promote(0)
+
+	var ls []*Lease
+	for i := 1; i <= 3; i++ {
+		l, err := le.Grant(LeaseID(i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = le.Attach(l.ID, []LeaseItem{{Key: fmt.Sprintf("foo%d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+		ls = append(ls, l)
+	}
+
+	if err := le.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(le.Leases()); n != 0 {
+		t.Errorf("len(leases) = %d, want 0", n)
+	}
+	if id := le.MaxLeaseID(); id != NoLease {
+		t.Errorf("max lease ID = %x, want %x", id, NoLease)
+	}
+	if id := le.GetLease(LeaseItem{Key: "foo1"}); id != NoLease {
+		t.Errorf("lease of foo1 = %x, want %x", id, NoLease)
+	}
+	for _, l := range ls {
+		select {
+		case <-l.revokec:
+		default:
+			t.Errorf("lease %x not done after reset", l.ID)
+		}
+	}
+
+	tx := be.BatchTx()
+	tx.Lock()
+	ks, _ := tx.UnsafeRange(leaseBucketName, int64ToBytes(0), int64ToBytes(math.MaxInt64), 0)
+	_, vs := tx.UnsafeRange(leaseBucketName, leaseMaxIDKey, nil, 0)
+	tx.Unlock()
+	if len(ks) != 0 || len(vs) != 0 {
+		t.Errorf("lease records, max IDs = %d, %d after reset, want 0, 0", len(ks), len(vs))
+	}
+
+	// the expiry scan finds nothing, while the leases would have expired
+	le.ScanExpired()
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		t.Fatalf("got expired leases %v after reset", b.Leases)
+	case <-time.After(2 * time.Second):
+	}
+
+	// lease IDs may be reused
+	if _, err := le.Grant(1, minLeaseTTL); err != nil {
+		t.Fatal(err)
+	}
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer nle.Stop()
+	if n := len(nle.Leases()); n != 1 {
+		t.Errorf("len(recovered leases) = %d, want 1", n)
+	}
+}
+
+func TestLessorExpire(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	testMinTTL := int64(1)
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: testMinTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	le.Promote(1 * time.Second)
+	l, err := le.Grant(1, testMinTTL)
+	if err != nil {
+		t.Fatalf("failed to create lease: %v", err)
+	}
+
+	select {
+	case el := <-le.ExpiredLeasesC():
+		if el[0].ID != l.ID {
+			t.Fatalf("expired id = %x, want %x", el[0].ID, l.ID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("failed to receive expired lease")
+	}
+
+	donec := make(chan struct{})
+	go func() {
+		// expired lease cannot be renewed
+		if _, err := le.Renew(l.ID); err != ErrLeaseNotFound {
+			t.Fatalf("unexpected renew")
+		}
+		donec <- struct{}{}
+	}()
+
+	select {
+	case <-donec:
+		t.Fatalf("renew finished before lease revocation")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// expired lease can be revoked
+	if err := le.Revoke(l.ID); err != nil {
+		t.Fatalf("failed to revoke expired lease: %v", err)
+	}
+
+	select {
+	case <-donec:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("renew has not returned after lease revocation")
+	}
+}
+
+// TestLessorExpiredLeaseBatchGeneration ensures expired lease batches carry
+// the primary generation they were found under.
+func TestLessorExpiredLeaseBatchGeneration(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+
+	le.Promote(0)
+	le.Demote()
+	le.Promote(0)
+	if _, err := le.Grant(1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		if len(b.Leases) != 1 || b.Leases[0].ID != 1 {
+			t.Fatalf("expired leases = %v, want lease 1", b.Leases)
+		}
+		if b.Generation != 2 {
+			t.Fatalf("generation = %d, want 2", b.Generation)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("failed to receive expired lease")
+	}
+	if g := le.Generation(); g != 2 {
+		t.Fatalf("generation = %d, want 2", g)
+	}
+}
+
+// TestLessorWaitExpired ensures WaitExpired returns once the lease is found
+// expired without consuming the expired lease channel.
+func TestLessorWaitExpired(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
+
+	if err := le.WaitExpired(context.TODO(), 1); err != ErrLeaseNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrLeaseNotFound)
+	}
+
+	if _, err := le.Grant(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Grant(2, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := le.WaitExpired(ctx, 1); err != nil {
+		t.Fatalf("failed to wait for expiry: %v", err)
+	}
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		if len(b.Leases) != 1 || b.Leases[0].ID != 1 {
+			t.Fatalf("expired leases = %v, want lease 1", b.Leases)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("failed to receive expired lease")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := le.WaitExpired(ctx, 2); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	donec := make(chan error, 1)
+	go func() { donec <- le.WaitExpired(context.TODO(), 2) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := le.Revoke(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-donec; err != ErrLeaseNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrLeaseNotFound)
+	}
+	le.waitMu.Lock()
+	defer le.waitMu.Unlock()
+	if len(le.expiryWaiters) != 0 {
+		t.Errorf("len(expiryWaiters) = %d, want 0", len(le.expiryWaiters))
+	}
+}
+
+// TestLessorExpireSlowConsumer ensures no expired lease is dropped when the
+// consumer of expired leases falls behind.
+func TestLessorExpireSlowConsumer(t *testing.T) {
+	oldRevokeRate := leaseRevokeRate
+	defer func() { leaseRevokeRate = oldRevokeRate }()
+	leaseRevokeRate = 20
+
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, ExpiredLeasesBufferSize: 1})
+	defer le.Stop()
+	le.Promote(0)
+	blocked := counterValue(leaseExpiredBatchesBlocked)
+
+	n := 5 * leaseRevokeRate / 2
+	for i := 1; i <= n; i++ {
+		if _, err := le.Grant(LeaseID(i), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// let batches pile up before consuming them one at a time
+	time.Sleep(2 * time.Second)
+	expired := make(map[LeaseID]struct{})
+	timeout := time.After(10 * time.Second)
+	for len(expired) < n {
+		select {
+		case b := <-le.ExpiredLeaseBatchC():
+			for _, l := range b.Leases {
+				expired[l.ID] = struct{}{}
+			}
+			time.Sleep(100 * time.Millisecond)
+		case <-timeout:
+			t.Fatalf("received %d expired leases, want %d", len(expired), n)
+		}
+	}
+	if counterValue(leaseExpiredBatchesBlocked) <= blocked {
+		t.Error("expected blocked sends of expired batches to be counted")
+	}
+}
+
+// TestLessorAutoRevoke ensures a lessor configured with AutoRevoke revokes
+// expired leases by itself and notifies about them afterwards.
+func TestLessorAutoRevoke(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, AutoRevoke: true})
+	defer le.Stop()
+	var (
+		mu sync.Mutex
+		fd *fakeDeleter
+	)
+	le.SetRangeDeleter(func() TxnDelete {
+		mu.Lock()
+		defer mu.Unlock()
+		fd = newFakeDeleter(be)
+		return fd
+	})
+
+	le.Promote(0)
+	l, err := le.Grant(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = le.Attach(l.ID, []LeaseItem{{"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		if len(b.Leases) != 1 || b.Leases[0].ID != l.ID {
+			t.Fatalf("expired leases = %v, want lease %x", b.Leases, l.ID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("failed to receive expired lease")
+	}
+
+	if le.Lookup(l.ID) != nil {
+		t.Errorf("got revoked lease %x", l.ID)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(fd.deleted, []string{"foo_"}) {
+		t.Errorf("deleted = %v, want %v", fd.deleted, []string{"foo_"})
+	}
+}
+
+// TestLessorStopClosesExpiredC ensures consumers ranging over the expired
+// lease batches return once the lessor is stopped.
+func TestLessorStopClosesExpiredC(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		for range le.ExpiredLeaseBatchC() {
+		}
+	}()
+	le.Stop()
+	// stopping again must not close the chan twice
+	le.Stop()
+
+	select {
+	case <-donec:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expired lease batch chan not closed after stop")
+	}
+}
+
+// TestLessorGrantWhileAutoRevoke ensures granting leases does not deadlock
+// with the expiration loop revoking expired leases by itself.
+func TestLessorGrantWhileAutoRevoke(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, AutoRevoke: true, clock: fc, ExpiryScheduler: ms})
+	defer le.Stop()
+	// hold the lock of the batch tx for a while, as a store with a lot to
+	// delete would, so that the next grant runs meanwhile.
+	revokingc := make(chan struct{}, 1)
+	le.SetRangeDeleter(func() TxnDelete {
+		fd := newFakeDeleter(be)
+		select {
+		case revokingc <- struct{}{}:
+		default:
+		}
+		time.Sleep(time.Millisecond)
+		return fd
+	})
+	<-ms.runc
+	le.Promote(0)
+
+	stopc, scanc := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(scanc)
+		for {
+			select {
+			case <-stopc:
+				return
+			default:
+			}
+			le.ScanExpired()
+		}
+	}()
+
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		for id := LeaseID(1); id <= 20; id++ {
+			if _, err := le.Grant(id, 1); err != nil {
+				t.Error(err)
+				return
+			}
+			// expire the lease and grant the next one while revoking it
+			fc.Advance(2 * time.Second)
+			<-revokingc
+		}
+	}()
+
+	select {
+	case <-donec:
+	case <-time.After(10 * time.Second):
+		t.Fatal("grant deadlocked with auto revoke")
+	}
+	close(stopc)
+	<-scanc
+}
+
+// TestLessorExpiryDropCount ensures the notifications about revoked leases
+// dropped for a consumer that never drains them are counted.
+func TestLessorExpiryDropCount(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	cfg := LessorConfig{
+		MinLeaseTTL:             1,
+		AutoRevoke:              true,
+		ExpiredLeasesBufferSize: 1,
+		clock:                   fc,
+	}
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
+	dropped := counterValue(leaseExpiredBatchesDropped)
+
+	for id := LeaseID(1); id <= 3; id++ {
+		if _, err := le.Grant(id, 1); err != nil {
+			t.Fatal(err)
+		}
+		fc.Advance(2 * time.Second)
+		// the first notification fills the channel, the others are dropped
+		for start := time.Now(); le.ExpiryDropCount() != uint64(id-1) || len(le.ExpiredLeaseBatchC()) != 1; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("drop count after lease %x = %d, want %d", id, le.ExpiryDropCount(), id-1)
+			}
+		}
+	}
+	if d := counterValue(leaseExpiredBatchesDropped) - dropped; d != 2 {
+		t.Errorf("dropped batches metric increased by %v, want 2", d)
+	}
+}
+
+func TestLessorExpireAndDemote(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	testMinTTL := int64(1)
+
 	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: testMinTTL})
 	defer le.Stop()
 
-	le.Promote(1 * time.Second)
-	l, err := le.Grant(1, testMinTTL)
+	le.Promote(1 * time.Second)
+	l, err := le.Grant(1, testMinTTL)
+	if err != nil {
+		t.Fatalf("failed to create lease: %v", err)
+	}
+
+	select {
+	case el := <-le.ExpiredLeasesC():
+		if el[0].ID != l.ID {
+			t.Fatalf("expired id = %x, want %x", el[0].ID, l.ID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("failed to receive expired lease")
+	}
+
+	donec := make(chan struct{})
+	go func() {
+		// expired lease cannot be renewed
+		if _, err := le.Renew(l.ID); !errors.Is(err, ErrNotPrimary) {
+			t.Fatalf("unexpected renew: %v", err)
+		}
+		donec <- struct{}{}
+	}()
+
+	select {
+	case <-donec:
+		t.Fatalf("renew finished before demotion")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// demote will cause the renew request to fail with ErrNotPrimary
+	le.Demote()
+
+	select {
+	case <-donec:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("renew has not returned after lessor demotion")
+	}
+}
+
+// TestLessorDemoteDropsExpired ensures Demote discards expired lease
+// batches not yet received and resets the primary generation.
+func TestLessorDemoteDropsExpired(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+
+	if g := le.Generation(); g != 0 {
+		t.Fatalf("generation = %d, want 0", g)
+	}
+	le.Promote(0)
+	if g := le.Generation(); g != 1 {
+		t.Fatalf("generation = %d, want 1", g)
+	}
+	if _, err := le.Grant(1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(le.expiredC) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed to find expired lease")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	le.Demote()
+	if n := len(le.expiredC); n != 0 {
+		t.Fatalf("len(expiredC) = %d, want 0", n)
+	}
+	if g := le.Generation(); g != 0 {
+		t.Fatalf("generation = %d, want 0", g)
+	}
+
+	le.Promote(0)
+	if g := le.Generation(); g != 2 {
+		t.Fatalf("generation = %d, want 2", g)
+	}
+}
+
+// TestLessorIsPrimary ensures IsPrimary follows promotions and demotions and
+// PrimaryGeneration reveals a flap between two reads.
+func TestLessorIsPrimary(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+
+	if le.IsPrimary() || le.PrimaryGeneration() != 0 {
+		t.Fatalf("new lessor = (%v, %d), want (false, 0)", le.IsPrimary(), le.PrimaryGeneration())
+	}
+	le.Promote(0)
+	g := le.PrimaryGeneration()
+	if !le.IsPrimary() || g != 1 {
+		t.Fatalf("promoted lessor = (%v, %d), want (true, 1)", le.IsPrimary(), g)
+	}
+
+	le.Demote()
+	if le.IsPrimary() || le.PrimaryGeneration() != 1 {
+		t.Fatalf("demoted lessor = (%v, %d), want (false, 1)", le.IsPrimary(), le.PrimaryGeneration())
+	}
+	le.Promote(0)
+	if !le.IsPrimary() {
+		t.Fatal("lessor is not primary after promotion")
+	}
+	if g2 := le.PrimaryGeneration(); g2 == g {
+		t.Errorf("primary generation = %d after a flap, want other than %d", g2, g)
+	}
+}
+
+// TestLeaseTimeToLive ensures TimeToLive reports -1 for leases without
+// deadline, rounds partial seconds up and does not overflow for the maximum
+// TTL.
+func TestLeaseTimeToLive(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, clock: fc})
+	defer le.Stop()
+
+	l, err := le.Grant(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := l.TimeToLive(); ttl != -1 {
+		t.Errorf("ttl of lease without deadline = %d, want -1", ttl)
+	}
+
+	le.Promote(0)
+	fc.Advance(500 * time.Millisecond)
+	if ttl := l.TimeToLive(); ttl != 10 {
+		t.Errorf("ttl = %d, want 10", ttl)
+	}
+	if info, err := le.LeaseInfo(1, 0); err != nil || info.TimeToLive != 10 {
+		t.Errorf("info ttl = %d, %v, want 10", info.TimeToLive, err)
+	}
+
+	ml, err := le.Grant(2, MaxLeaseTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := ml.TimeToLive(); ttl != MaxLeaseTTL {
+		t.Errorf("ttl = %d, want %d", ttl, MaxLeaseTTL)
+	}
+	if ml.Remaining() <= 0 || le.expired(ml) {
+		t.Errorf("lease with max ttl is expired, remaining %v", ml.Remaining())
+	}
+
+	le.Demote()
+	if ttl := ml.TimeToLive(); ttl != -1 {
+		t.Errorf("ttl after demotion = %d, want -1", ttl)
+	}
+}
+
+// TestLessorNotPrimaryHint ensures a non-primary lessor rejects renewals
+// with the registered primary hint.
+func TestLessorNotPrimaryHint(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := le.Renew(1)
+	if !errors.Is(err, ErrNotPrimary) {
+		t.Fatalf("err = %v, want %v", err, ErrNotPrimary)
+	}
+	if err.Error() != ErrNotPrimary.Error() {
+		t.Errorf("error = %q, want %q", err.Error(), ErrNotPrimary.Error())
+	}
+
+	le.SetPrimaryHint("http://10.0.0.1:2380")
+	_, err = le.Renew(1)
+	if !errors.Is(err, ErrNotPrimary) {
+		t.Fatalf("err = %v, want %v", err, ErrNotPrimary)
+	}
+	npe, ok := err.(*NotPrimaryError)
+	if !ok {
+		t.Fatalf("err = %T, want *NotPrimaryError", err)
+	}
+	if npe.Primary != "http://10.0.0.1:2380" {
+		t.Errorf("primary = %q, want %q", npe.Primary, "http://10.0.0.1:2380")
+	}
+}
+
+// TestLessorNotPrimaryLeader ensures the NotPrimaryError of renewals on a
+// non-primary lessor carries the member ID registered by SetPrimaryLeader.
+func TestLessorNotPrimaryLeader(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	le.SetPrimaryLeader(0x8e9e05c52164694d)
+	_, err := le.Renew(1)
+	var npe *NotPrimaryError
+	if !errors.As(err, &npe) {
+		t.Fatalf("err = %v, want *NotPrimaryError", err)
+	}
+	if npe.Leader != 0x8e9e05c52164694d || npe.Primary != "8e9e05c52164694d" {
+		t.Errorf("leader, primary = %x, %q, want 8e9e05c52164694d", npe.Leader, npe.Primary)
+	}
+
+	// the leader is lost
+	le.SetPrimaryLeader(0)
+	if _, err = le.Renew(1); !errors.As(err, &npe) || npe.Leader != 0 || npe.Primary != "" {
+		t.Errorf("err = %#v, want *NotPrimaryError without leader", err)
+	}
+}
+
+// TestLessorRequirePrimary ensures a lessor with RequirePrimary set only
+// mutates leases as the primary.
+func TestLessorRequirePrimary(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, RequirePrimary: true})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+
+	if _, err := le.Grant(1, 100); !errors.Is(err, ErrNotPrimary) {
+		t.Fatalf("grant on non-primary = %v, want %v", err, ErrNotPrimary)
+	}
+
+	le.Promote(0)
+	for _, id := range []LeaseID{1, 2} {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	le.Demote()
+
+	item := []LeaseItem{{"foo"}}
+	batch := map[LeaseID][]LeaseItem{1: item}
+	tests := []struct {
+		name string
+		f    func() error
+	}{
+		{"grant", func() error { _, err := le.Grant(3, 100); return err }},
+		{"revoke", func() error { return le.Revoke(2) }},
+		{"attach", func() error { return le.Attach(1, []LeaseItem{{"baz"}}) }},
+		{"attach batch", func() error { return le.AttachBatch(batch) }},
+		{"detach", func() error { return le.Detach(1, item) }},
+		{"detach batch", func() error { return le.DetachBatch(batch) }},
+		{"transfer", func() error { return le.TransferItems(1, 2, item) }},
+	}
+	for _, tt := range tests {
+		if err := tt.f(); !errors.Is(err, ErrNotPrimary) {
+			t.Errorf("%s on non-primary = %v, want %v", tt.name, err, ErrNotPrimary)
+		}
+	}
+
+	if le.Lookup(3) != nil || le.Lookup(2) == nil {
+		t.Error("leases changed on non-primary")
+	}
+	if n := le.Lookup(1).ItemCount(); n != 2 {
+		t.Errorf("items of lease 1 = %d, want 2", n)
+	}
+}
+
+// TestLessorDemotedMutations ensures a demoted lessor keeps applying
+// mutations by default and only rejects renewals.
+func TestLessorDemotedMutations(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
+	le.Demote()
+
+	if _, err := le.Grant(1, 100); err != nil {
+		t.Fatalf("grant on demoted lessor = %v", err)
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}}); err != nil {
+		t.Fatalf("attach on demoted lessor = %v", err)
+	}
+	if _, err := le.Renew(1); !errors.Is(err, ErrNotPrimary) {
+		t.Errorf("renew on demoted lessor = %v, want %v", err, ErrNotPrimary)
+	}
+	if err := le.Revoke(1); err != nil {
+		t.Fatalf("revoke on demoted lessor = %v", err)
+	}
+}
+
+// TestLessorOnPrimaryChange ensures primary change callbacks run in order
+// and may call back into the lessor, even to promote or demote it.
+func TestLessorOnPrimaryChange(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	var (
+		got []string
+		id  LeaseID
+	)
+	le.OnPrimaryChange(func(primary bool) {
+		got = append(got, fmt.Sprintf("first %v", primary))
+		if !primary {
+			return
+		}
+		id++
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Errorf("grant from callback = %v", err)
+		}
+		if _, err := le.Renew(id); err != nil {
+			t.Errorf("renew from callback = %v", err)
+		}
+	})
+	le.OnPrimaryChange(func(primary bool) {
+		got = append(got, fmt.Sprintf("second %v", primary))
+		if primary && len(got) == 2 {
+			// demoting from a callback is delivered after this notification
+			le.Demote()
+		}
+	})
+
+	le.Promote(0)
+	le.Demote() // already demoted by the callback; no notification
+	le.Promote(0)
+
+	want := []string{"first true", "second true", "first false", "second false", "first true", "second true"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications = %v, want %v", got, want)
+	}
+	if le.Lookup(1) == nil || le.Lookup(2) == nil {
+		t.Error("leases granted from callbacks not found")
+	}
+}
+
+// TestLessorFreeze ensures a frozen lessor reports no expired lease while
+// renewals keep working.
+func TestLessorFreeze(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	le.Promote(0)
+	le.Freeze()
+
+	if _, err := le.Grant(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Grant(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Renew(2); err != nil {
+		t.Fatalf("failed to renew frozen lease: %v", err)
+	}
+
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		t.Fatalf("received expired leases %v while frozen", b.Leases)
+	case <-time.After(2 * time.Second):
+	}
+
+	le.Unfreeze()
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		// a renewed lease may be reported once per pending heap entry
+		ids := make(map[LeaseID]struct{})
+		for _, l := range b.Leases {
+			ids[l.ID] = struct{}{}
+		}
+		if len(ids) != 2 {
+			t.Fatalf("expired leases = %v, want leases 1 and 2", b.Leases)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("failed to receive expired leases after unfreeze")
+	}
+}
+
+func TestLessorMaxTTL(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	_, err := le.Grant(1, MaxLeaseTTL+1)
+	if err != ErrLeaseTTLTooLarge {
+		t.Fatalf("grant unexpectedly succeeded")
+	}
+}
+
+// TestLessorGrantTTLBounds ensures leases granted with TTLs up to
+// MaxLeaseTTL live their TTL across renewals and larger TTLs are rejected
+// rather than overflowing the expiry.
+func TestLessorGrantTTLBounds(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	tests := []struct {
+		ttl  int64
+		werr error
+	}{
+		{10, nil},
+		{3600, nil},
+		{math.MaxInt32, nil},
+		{MaxLeaseTTL, nil},
+		{MaxLeaseTTL + 1, ErrLeaseTTLTooLarge},
+		{math.MaxInt64, ErrLeaseTTLTooLarge},
+	}
+	for i, tt := range tests {
+		id := LeaseID(i + 1)
+		l, err := le.Grant(id, tt.ttl)
+		if err != tt.werr {
+			t.Fatalf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if err != nil {
+			if le.Lookup(id) != nil {
+				t.Errorf("#%d: rejected lease granted", i)
+			}
+			continue
+		}
+		fc.Advance(5 * time.Second)
+		if ttl, err := le.Renew(id); err != nil || ttl != tt.ttl {
+			t.Fatalf("#%d: renew = %d, %v, want %d, <nil>", i, ttl, err, tt.ttl)
+		}
+		if rem := l.Remaining(); rem != time.Duration(tt.ttl)*time.Second {
+			t.Errorf("#%d: remaining = %v, want %ds", i, rem, tt.ttl)
+		}
+	}
+	if _, err := le.GrantDuration(LeaseID(len(tests)+1), time.Duration(math.MaxInt64)); err != ErrLeaseTTLTooLarge {
+		t.Errorf("err = %v, want %v", err, ErrLeaseTTLTooLarge)
+	}
+}
+
+// TestLessorMinLeaseTTLMaxInt64 ensures a minimum TTL of math.MaxInt64
+// seconds, as passed by snapshot restore, saturates instead of overflowing.
+func TestLessorMinLeaseTTLMaxInt64(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: math.MaxInt64, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	if le.minLeaseTTLDuration != forever {
+		t.Errorf("minimum TTL = %v, want %v", le.minLeaseTTLDuration, forever)
+	}
+	l, err := le.GrantDuration(1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(time.Hour)
+	if rem := l.Remaining(); rem <= 0 {
+		t.Errorf("remaining = %v, want positive", rem)
+	}
+}
+
+// TestLessorExpiringWithin ensures ExpiringWithin lists copies of only the
+// leases expiring within the window.
+func TestLessorExpiringWithin(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+
+	for i, ttl := range []int64{30, 10, 20, 60} {
+		if _, err := le.Grant(LeaseID(i+1), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := le.Attach(2, []LeaseItem{{"foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ls := le.ExpiringWithin(time.Hour); len(ls) != 0 {
+		t.Fatalf("leases without deadline = %v, want none", ls)
+	}
+
+	le.Promote(0)
+	ls := le.ExpiringWithin(30 * time.Second)
+	var ids []LeaseID
+	for _, l := range ls {
+		ids = append(ids, l.ID)
+	}
+	if wids := []LeaseID{2, 3, 1}; !reflect.DeepEqual(ids, wids) {
+		t.Errorf("expiring leases = %v, want %v", ids, wids)
+	}
+	l := ls[0]
+	if l == le.Lookup(2) {
+		t.Error("got lease 2 itself, want a copy")
+	}
+	if l.TTL() != 10 || !l.ExpiryTracked() || l.Remaining() <= 0 || l.Remaining() > 10*time.Second {
+		t.Errorf("copy of lease 2 has TTL %d, remaining %v, want tracked TTL 10", l.TTL(), l.Remaining())
+	}
+	if keys := l.Keys(); !reflect.DeepEqual(keys, []string{"foo"}) {
+		t.Errorf("keys of lease 2 = %v, want [foo]", keys)
+	}
+	if ls = le.ExpiringWithin(5 * time.Second); len(ls) != 0 {
+		t.Errorf("leases expiring within 5s = %v, want none", ls)
+	}
+}
+
+// TestLessorStaleLeases ensures StaleLeases lists the leases not renewed
+// within the window since the last renewal or promotion.
+func TestLessorStaleLeases(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, clock: fc})
+	defer le.Stop()
+
+	for id := LeaseID(1); id <= 3; id++ {
+		if _, err := le.Grant(id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := le.StaleLeases(0); ids != nil {
+		t.Fatalf("stale leases of non-primary lessor = %v, want nil", ids)
+	}
+
+	le.Promote(0)
+	fc.Advance(20 * time.Second)
+	if _, err := le.Renew(2); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(20 * time.Second)
+
+	if ids := le.StaleLeases(30 * time.Second); !reflect.DeepEqual(ids, []LeaseID{1, 3}) {
+		t.Errorf("stale leases = %v, want [1 3]", ids)
+	}
+	info, err := le.LeaseInfo(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fc.Now().Add(-20 * time.Second); !info.LastRenewed.Equal(want) {
+		t.Errorf("last renewed = %v, want %v", info.LastRenewed, want)
+	}
+
+	// promotion counts as renewal
+	le.Demote()
+	le.Promote(0)
+	if ids := le.StaleLeases(0); len(ids) != 0 {
+		t.Errorf("stale leases after promotion = %v, want none", ids)
+	}
+}
+
+// TestLessorStats ensures Stats reports the TTL distribution, items, expiring
+// leases and age of outstanding leases.
+func TestLessorStats(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	if st := le.Stats(); st.Count != 0 || st.MinTTL != 0 || st.MaxTTL != 0 || st.MeanTTL != 0 {
+		t.Fatalf("stats of empty lessor = %+v, want zero values", st)
+	}
+
+	ttls := []int64{1, 5, 10, 30, 60, 300, 3600, 7200}
+	for i, ttl := range ttls {
+		if _, err := le.Grant(LeaseID(i+1), ttl); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			fc.Advance(5 * time.Second)
+		}
+	}
+	if err := le.Attach(1, []LeaseItem{{"foo"}, {"bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Attach(8, []LeaseItem{{"baz"}}); err != nil {
+		t.Fatal(err)
+	}
+	// left out of the TTL stats
+	if _, err := le.GrantPermanent(LeaseID(len(ttls) + 1)); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(10 * time.Second)
+
+	st := le.Stats()
+	if st.Count != len(ttls)+1 || st.Permanent != 1 {
+		t.Errorf("count, permanent = %d, %d, want %d, 1", st.Count, st.Permanent, len(ttls)+1)
+	}
+	if st.ItemCount != 3 {
+		t.Errorf("items = %d, want 3", st.ItemCount)
+	}
+	if st.MinTTL != 1 || st.MaxTTL != 7200 {
+		t.Errorf("min, max = %d, %d, want 1, 7200", st.MinTTL, st.MaxTTL)
+	}
+	if st.MeanTTL != 1400.75 {
+		t.Errorf("mean = %v, want 1400.75", st.MeanTTL)
+	}
+	if st.P50TTL != 30 || st.P99TTL != 7200 {
+		t.Errorf("p50, p99 = %d, %d, want 30, 7200", st.P50TTL, st.P99TTL)
+	}
+	// the leases of up to 60s expire within the default window of a minute
+	if st.Expiring != 5 {
+		t.Errorf("expiring = %d, want 5", st.Expiring)
+	}
+	if st.OldestAge != 15*time.Second {
+		t.Errorf("oldest age = %v, want 15s", st.OldestAge)
+	}
+	wbuckets := []LeaseStatsBucket{
+		{UpperBound: 1, Count: 1},
+		{UpperBound: 10, Count: 2},
+		{UpperBound: 60, Count: 2},
+		{UpperBound: 600, Count: 1},
+		{UpperBound: math.MaxInt64, Count: 2},
+	}
+	if !reflect.DeepEqual(st.Buckets, wbuckets) {
+		t.Errorf("buckets = %+v, want %+v", st.Buckets, wbuckets)
+	}
+}
+
+// TestLessorStatsConfig ensures Stats uses the configured buckets and expiry
+// window.
+func TestLessorStatsConfig(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{
+		MinLeaseTTL:       1,
+		StatsBuckets:      []int64{10, 100},
+		StatsExpiryWindow: 10 * time.Second,
+		clock:             newFakeClock(),
+	})
+	defer le.Stop()
+	le.Promote(0)
+
+	for i, ttl := range []int64{5, 50, 500} {
+		if _, err := le.Grant(LeaseID(i+1), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := le.Stats()
+	if st.Expiring != 1 {
+		t.Errorf("expiring = %d, want 1", st.Expiring)
+	}
+	wbuckets := []LeaseStatsBucket{
+		{UpperBound: 10, Count: 1},
+		{UpperBound: 100, Count: 1},
+		{UpperBound: math.MaxInt64, Count: 1},
+	}
+	if !reflect.DeepEqual(st.Buckets, wbuckets) {
+		t.Errorf("buckets = %+v, want %+v", st.Buckets, wbuckets)
+	}
+}
+
+// TestLessorCountByTTLRange ensures CountByTTLRange counts the leases within
+// inclusive TTL bounds.
+func TestLessorCountByTTLRange(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+
+	for i, ttl := range []int64{1, 5, 5, 10, 30, 60, 3600} {
+		if _, err := le.Grant(LeaseID(i+1), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := le.GrantPermanent(100); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		min, max int64
+		want     int
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{1, 5, 3},
+		{5, 30, 4},
+		{31, 59, 0},
+		{60, math.MaxInt64, 2},
+		{0, math.MaxInt64, 7},
+		{10, 5, 0},
+	}
+	for _, tt := range tests {
+		if n := le.CountByTTLRange(tt.min, tt.max); n != tt.want {
+			t.Errorf("count of TTLs in [%d, %d] = %d, want %d", tt.min, tt.max, n, tt.want)
+		}
+	}
+}
+
+func TestLessorCheckpointScheduling(t *testing.T) {
+	lg := zap.NewNop()
+
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, CheckpointInterval: 1 * time.Second})
+	le.minLeaseTTL = 1
+	checkpointedC := make(chan struct{})
+	le.SetCheckpointer(func(ctx context.Context, lc *pb.LeaseCheckpointRequest) {
+		close(checkpointedC)
+		if len(lc.Checkpoints) != 1 {
+			t.Errorf("expected 1 checkpoint but got %d", len(lc.Checkpoints))
+		}
+		c := lc.Checkpoints[0]
+		if c.Remaining_TTL != 1 {
+			t.Errorf("expected checkpoint to be called with Remaining_TTL=%d but got %d", 1, c.Remaining_TTL)
+		}
+	})
+	defer le.Stop()
+	le.Promote(0)
+
+	_, err := le.Grant(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TODO: Is there any way to avoid doing this wait? Lease TTL granularity is in seconds.
+	select {
+	case <-checkpointedC:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected checkpointer to be called, but it was not")
+	}
+}
+
+func TestLessorCheckpointsRestoredOnPromote(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	l, err := le.Grant(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le.Checkpoint(l.ID, 5)
+	le.Promote(0)
+	remaining := l.Remaining().Seconds()
+	if !(remaining > 4 && remaining < 5) {
+		t.Fatalf("expected expiry to be less than 1s in the future, but got %f seconds", remaining)
+	}
+}
+
+// TestLessorPromoteWithHandoff ensures leases handed off from the old primary
+// keep their remaining time on the new primary.
+func TestLessorPromoteWithHandoff(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	if le.HandoffState() != nil {
+		t.Fatal("expected no handoff state from a non-primary lessor")
+	}
+	le.Promote(0)
+	l1, err := le.Grant(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = le.Grant(2, 100); err != nil {
+		t.Fatal(err)
+	}
+	// simulate lease 1 being close to expiry on the old primary
+	l1.refreshRemaining(2 * time.Second)
+
+	state := le.HandoffState()
+	if len(state) != 2 {
+		t.Fatalf("len(state) = %d, want 2", len(state))
+	}
+
+	// recover the leases into a new primary
+	nle := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer nle.Stop()
+	// lease 2 is not handed off and falls back to the full TTL
+	var filtered []LeaseHandoff
+	for _, h := range state {
+		if h.ID == l1.ID {
+			filtered = append(filtered, h)
+		}
+	}
+	nle.PromoteWithHandoff(0, filtered)
+
+	if r := nle.Lookup(1).Remaining(); r > 2*time.Second || r < time.Second {
+		t.Errorf("remaining of handed off lease = %v, want about 2s", r)
+	}
+	if r := nle.Lookup(2).Remaining(); r < 99*time.Second {
+		t.Errorf("remaining of lease without handoff = %v, want about 100s", r)
+	}
+}
+
+// TestLessorClockStep ensures steps of the wall clock neither expire leases
+// early nor keep them alive past their TTL.
+func TestLessorClockStep(t *testing.T) {
+	for _, step := range []time.Duration{10 * time.Minute, -10 * time.Minute} {
+		t.Run(step.String(), func(t *testing.T) {
+			lg := zap.NewNop()
+			dir, be := NewTestBackend(t)
+			defer os.RemoveAll(dir)
+			defer be.Close()
+
+			fc := newFakeClock()
+			le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+			defer le.Stop()
+			le.Promote(0)
+
+			l, err := le.Grant(1, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !l.grantedAt.Equal(fc.Now()) {
+				t.Errorf("grantedAt = %v, want %v", l.grantedAt, fc.Now())
+			}
+
+			fc.Step(step)
+			if rem := l.Remaining(); rem != 10*time.Second {
+				t.Fatalf("remaining = %v after stepping the wall clock, want 10s", rem)
+			}
+			select {
+			case batch := <-le.ExpiredLeaseBatchC():
+				t.Fatalf("unexpected expired leases %v after stepping the wall clock", batch.Leases)
+			case <-time.After(time.Second):
+			}
+
+			fc.Advance(10 * time.Second)
+			select {
+			case batch := <-le.ExpiredLeaseBatchC():
+				if len(batch.Leases) == 0 || batch.Leases[0].ID != 1 {
+					t.Fatalf("expired leases = %v, want lease 1", batch.Leases)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("lease did not expire after its TTL")
+			}
+		})
+	}
+}
+
+// TestLessorRenewAllocs ensures renewals neither allocate nor grow the lease
+// heap, as they are the hottest path of the lessor.
+func TestLessorRenewAllocs(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	defer le.Stop()
+	le.Promote(0)
+
+	for i := 1; i <= 10; i++ {
+		if _, err := le.Grant(LeaseID(i), 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := LeaseID(0)
+	allocs := testing.AllocsPerRun(1000, func() {
+		id = id%10 + 1
+		if _, err := le.Renew(id); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("allocs per renew = %v, want 0", allocs)
+	}
+
+	le.heapMu.Lock()
+	n := le.leaseHeap.Len()
+	le.heapMu.Unlock()
+	if n != 10 {
+		t.Errorf("lease heap length = %d after renewals, want 10", n)
+	}
+}
+
+// TestLessorRenewClockStep ensures a lease renewed around a step of the wall
+// clock lives exactly its TTL from the renewal.
+func TestLessorRenewClockStep(t *testing.T) {
+	for _, step := range []time.Duration{10 * time.Minute, -10 * time.Minute} {
+		t.Run(step.String(), func(t *testing.T) {
+			lg := zap.NewNop()
+			dir, be := NewTestBackend(t)
+			defer os.RemoveAll(dir)
+			defer be.Close()
+
+			fc := newFakeClock()
+			le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+			defer le.Stop()
+			le.Promote(0)
+
+			l, err := le.Grant(1, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc.Advance(5 * time.Second)
+			fc.Step(step)
+			if ttl, err := le.Renew(1); err != nil || ttl != 10 {
+				t.Fatalf("renew = %d, %v, want 10, <nil>", ttl, err)
+			}
+			fc.Step(-step)
+			if rem := l.Remaining(); rem != 10*time.Second {
+				t.Fatalf("remaining = %v, want 10s", rem)
+			}
+
+			fc.Advance(9 * time.Second)
+			if le.expired(l) {
+				t.Fatal("lease expired before its TTL")
+			}
+			fc.Advance(time.Second)
+			if !le.expired(l) {
+				t.Fatal("lease did not expire after its TTL")
+			}
+		})
+	}
+}
+
+// TestLessorWallClockFloor ensures that, with WallClockFloor, a lease granted
+// while the wall clock is stepped back does not lose the step from its maximum
+// lifetime once the wall clock is corrected.
+func TestLessorWallClockFloor(t *testing.T) {
+	tests := []struct {
+		floor bool
+		want  time.Duration
+	}{
+		{false, time.Hour},
+		{true, 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("floor=%v", tt.floor), func(t *testing.T) {
+			lg := zap.NewNop()
+			dir, be := NewTestBackend(t)
+			defer os.RemoveAll(dir)
+			defer be.Close()
+
+			fc := newFakeClock()
+			le := newLessor(lg, be, LessorConfig{
+				MinLeaseTTL:    1,
+				MaxLifetime:    2 * time.Hour,
+				WallClockFloor: tt.floor,
+				clock:          fc,
+			})
+			defer le.Stop()
+			le.Promote(0)
+
+			// the lessor reads the wall clock before the step
+			if _, err := le.Grant(1, 10); err != nil {
+				t.Fatal(err)
+			}
+			fc.Step(-time.Hour)
+			l, err := le.Grant(2, 10*3600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc.Step(time.Hour)
+
+			if _, err = le.Renew(2); err != nil {
+				t.Fatal(err)
+			}
+			if rem := l.Remaining(); rem != tt.want {
+				t.Errorf("remaining = %v, want %v", rem, tt.want)
+			}
+		})
+	}
+}
+
+// TestLessorExpiryGrace ensures a lease renewed within the expiry grace after
+// its expiry is not reported as expired.
+func TestLessorExpiryGrace(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, ExpiryGrace: time.Second, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(10*time.Second + 500*time.Millisecond)
+	select {
+	case batch := <-le.ExpiredLeaseBatchC():
+		t.Fatalf("unexpected expired leases %v within the grace", batch.Leases)
+	case <-time.After(time.Second):
+	}
+
+	// the renewal races the revocation the grace makes up for
+	ttl, err := le.Renew(1)
+	if err != nil || ttl != 10 {
+		t.Fatalf("renew = %d, %v, want 10, <nil>", ttl, err)
+	}
+
+	fc.Advance(10*time.Second + 500*time.Millisecond)
+	select {
+	case batch := <-le.ExpiredLeaseBatchC():
+		t.Fatalf("unexpected expired leases %v within the grace", batch.Leases)
+	case <-time.After(time.Second):
+	}
+	fc.Advance(time.Second)
+	select {
+	case batch := <-le.ExpiredLeaseBatchC():
+		if len(batch.Leases) == 0 || batch.Leases[0].ID != 1 {
+			t.Fatalf("expired leases = %v, want lease 1", batch.Leases)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("lease did not expire after the grace")
+	}
+}
+
+// TestLessorExpiryScheduler ensures a lessor with a custom ExpiryScheduler
+// only reports expired leases when scanned through ScanExpired.
+func TestLessorExpiryScheduler(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, ExpiryScheduler: ms, clock: fc})
+	defer le.Stop()
+	<-ms.runc
+	le.Promote(0)
+
+	if _, err := le.Grant(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(2 * time.Second)
+
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		t.Fatalf("expired leases %v reported without a scan", b.Leases)
+	case <-time.After(time.Second):
+	}
+
+	le.ScanExpired()
+	select {
+	case b := <-le.ExpiredLeaseBatchC():
+		if len(b.Leases) != 1 || b.Leases[0].ID != 1 {
+			t.Fatalf("expired leases = %v, want lease 1", b.Leases)
+		}
+	default:
+		t.Fatal("scan reported no expired lease")
+	}
+}
+
+// manualScheduler leaves scans to the test.
+type manualScheduler struct {
+	runc chan struct{}
+}
+
+func (s *manualScheduler) Run(le Lessor, stopc <-chan struct{}) {
+	close(s.runc)
+	<-stopc
+}
+
+// TestLessorScanDuration ensures each scan is observed by the scan duration
+// metric and reported by LastScanDuration.
+func TestLessorScanDuration(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, AutoRevoke: true, clock: fc, ExpiryScheduler: ms})
+	defer le.Stop()
+	<-ms.runc
+	le.Promote(0)
+
+	// revoking the expired lease takes a second
+	le.SetRangeDeleter(func() TxnDelete {
+		fc.Advance(time.Second)
+		return newFakeDeleter(be)
+	})
+	if _, err := le.Grant(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(2 * time.Second)
+
+	observed := histogramCount(leaseExpiryScanDuration)
+	le.ScanExpired()
+	if le.Lookup(1) != nil {
+		t.Fatal("expired lease is not revoked")
+	}
+	if d := le.LastScanDuration(); d != time.Second {
+		t.Errorf("last scan duration = %v, want 1s", d)
+	}
+	le.ScanExpired()
+	if d := le.LastScanDuration(); d != 0 {
+		t.Errorf("last scan duration = %v, want 0", d)
+	}
+	if n := histogramCount(leaseExpiryScanDuration); n != observed+2 {
+		t.Errorf("observed scans = %d, want %d", n, observed+2)
+	}
+}
+
+// TestLessorExpiryGranularity ensures expiries are rounded up to the grid of
+// ExpiryGranularity and never shortened.
+func TestLessorExpiryGranularity(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	grid := 5 * time.Second
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, ExpiryGranularity: grid, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	check := func(l *Lease, ttl time.Duration, wexpiry time.Duration) {
+		t.Helper()
+		if l.expiry != wexpiry {
+			t.Errorf("expiry of lease %x = %v, want %v", l.ID, l.expiry, wexpiry)
+		}
+		if l.expiry%grid != 0 {
+			t.Errorf("expiry of lease %x = %v, not on the grid", l.ID, l.expiry)
+		}
+		if rem := l.Remaining(); rem < ttl {
+			t.Errorf("remaining of lease %x = %v, shorter than its TTL %v", l.ID, rem, ttl)
+		}
+	}
+
+	fc.Advance(1300 * time.Millisecond)
+	l1, err := le.Grant(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := le.GrantDuration(2, 7500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(l1, 10*time.Second, 15*time.Second)
+	check(l2, 7500*time.Millisecond, 10*time.Second)
+
+	// on the grid already
+	fc.Advance(3700 * time.Millisecond)
+	if _, err = le.Renew(1); err != nil {
+		t.Fatal(err)
+	}
+	check(l1, 10*time.Second, 15*time.Second)
+
+	fc.Advance(100 * time.Millisecond)
+	if _, err = le.Renew(1); err != nil {
+		t.Fatal(err)
+	}
+	check(l1, 10*time.Second, 20*time.Second)
+}
+
+// TestLessorRenewCoalesce ensures only the first of the renewals within the
+// coalesce window refreshes the expiry.
+func TestLessorRenewCoalesce(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, RenewCoalesceWindow: time.Second, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	l, err := le.Grant(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coalesced := counterValue(leaseRenewCoalesced)
+	for i := 0; i < 9; i++ {
+		fc.Advance(100 * time.Millisecond)
+		if ttl, err := le.Renew(1); err != nil || ttl != 10 {
+			t.Fatalf("renew = %d, %v, want 10, <nil>", ttl, err)
+		}
+	}
+	if rem := l.Remaining(); rem != 10*time.Second-900*time.Millisecond {
+		t.Errorf("remaining = %v after coalesced renewals, want 9.1s", rem)
+	}
+	if n := counterValue(leaseRenewCoalesced) - coalesced; n != 9 {
+		t.Errorf("coalesced renewals = %v, want 9", n)
+	}
+
+	fc.Advance(100 * time.Millisecond)
+	if _, err := le.Renew(1); err != nil {
+		t.Fatal(err)
+	}
+	if rem := l.Remaining(); rem != 10*time.Second {
+		t.Errorf("remaining = %v after renewal past the window, want 10s", rem)
+	}
+}
+
+// TestLessorGrantLimiter ensures grants denied by the grant limiter fail
+// without being granted or persisted.
+func TestLessorGrantLimiter(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	cfg := LessorConfig{MinLeaseTTL: 1, GrantLimiter: newTokenBucketLimiter(1, 2, fc), clock: fc}
+	le := newLessor(lg, be, cfg)
+	le.Promote(0)
+
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.GrantWithOptions(id, 10, GrantOptions{Token: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := le.GrantWithOptions(3, 10, GrantOptions{Token: "a"})
+	var rerr *GrantRateError
+	if !errors.As(err, &rerr) || rerr.Token != "a" || !errors.Is(err, ErrGrantRateExceeded) {
+		t.Fatalf("err = %v, want %v for token a", err, ErrGrantRateExceeded)
+	}
+	if le.Lookup(3) != nil {
+		t.Error("denied lease granted")
+	}
+	if _, err := le.GrantWithOptions(4, 10, GrantOptions{Token: "b"}); err != nil {
+		t.Errorf("grant of another token = %v, want <nil>", err)
+	}
+	fc.Advance(time.Second)
+	if _, err := le.GrantWithOptions(5, 10, GrantOptions{Token: "a"}); err != nil {
+		t.Errorf("grant after refill = %v, want <nil>", err)
+	}
+	le.Stop()
+
+	// the denied grant was not persisted
+	le = newLessor(lg, be, LessorConfig{MinLeaseTTL: 1})
+	defer le.Stop()
+	if n := len(le.Leases()); n != 4 || le.Lookup(3) != nil {
+		t.Errorf("recovered %d leases, lease 3 %v, want 4 leases without lease 3", n, le.Lookup(3))
+	}
+}
+
+// TestLessorGrantRate ensures grants beyond the grant rate fail until the
+// bucket refills.
+func TestLessorGrantRate(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, GrantRate: 2, GrantBurst: 3, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	id := LeaseID(1)
+	grant := func() error {
+		_, err := le.Grant(id, 10)
+		if err == nil {
+			id++
+		}
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := grant(); err != nil {
+			t.Fatalf("#%d: grant within the burst = %v", i, err)
+		}
+	}
+	if err := grant(); !errors.Is(err, ErrGrantRateExceeded) {
+		t.Fatalf("err = %v, want %v", err, ErrGrantRateExceeded)
+	}
+	if le.Lookup(id) != nil {
+		t.Fatal("rate limited lease granted")
+	}
+
+	// refills a grant every 500ms
+	fc.Advance(500 * time.Millisecond)
+	if err := grant(); err != nil {
+		t.Fatalf("grant after refill = %v", err)
+	}
+	if err := grant(); !errors.Is(err, ErrGrantRateExceeded) {
+		t.Fatalf("err = %v, want %v", err, ErrGrantRateExceeded)
+	}
+	fc.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if err := grant(); err != nil {
+			t.Fatalf("#%d: grant after refill = %v", i, err)
+		}
+	}
+	if n := len(le.Leases()); n != 6 {
+		t.Errorf("leases = %d, want 6", n)
+	}
+}
+
+// TestLessorGrantRateWithLimiter ensures the grant rate applies on top of the
+// grant limiter, failing with the same error.
+func TestLessorGrantRateWithLimiter(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	cfg := LessorConfig{
+		MinLeaseTTL:  1,
+		GrantLimiter: newTokenBucketLimiter(1, 10, fc),
+		GrantRate:    1,
+		GrantBurst:   1,
+		clock:        fc,
+	}
+	le := newLessor(lg, be, cfg)
+	defer le.Stop()
+	le.Promote(0)
+
+	if _, err := le.GrantWithOptions(1, 10, GrantOptions{Token: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := le.GrantWithOptions(2, 10, GrantOptions{Token: "b"})
+	var rerr *GrantRateError
+	if !errors.As(err, &rerr) || rerr.Token != "b" || !errors.Is(err, ErrGrantRateExceeded) {
+		t.Fatalf("err = %v, want %v for token b", err, ErrGrantRateExceeded)
+	}
+}
+
+// TestLessorExpiryWheel ensures leases scheduled in the expiry wheel expire
+// like leases in the heap, following renewals and revocations.
+func TestLessorExpiryWheel(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{
+		MinLeaseTTL:       1,
+		ExpiryGranularity: time.Second,
+		ExpiryWheel:       true,
+		ExpiryScheduler:   ms,
+		clock:             fc,
+	})
+	defer le.Stop()
+	<-ms.runc
+	le.SetRangeDeleter(func() TxnDelete { return newFakeDeleter(be) })
+	le.Promote(0)
+
+	for id := LeaseID(1); id <= 4; id++ {
+		if _, err := le.Grant(id, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := le.Grant(5, 10); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(time.Second)
+	if _, err := le.Renew(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := le.Revoke(2); err != nil {
+		t.Fatal(err)
+	}
+
+	expire := func(d time.Duration) []LeaseID {
+		fc.Advance(d)
+		le.ScanExpired()
+		var ids []LeaseID
+		for {
+			select {
+			case b := <-le.ExpiredLeaseBatchC():
+				for _, l := range b.Leases {
+					ids = append(ids, l.ID)
+				}
+			default:
+				sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+				return ids
+			}
+		}
+	}
+	if ids := expire(1500 * time.Millisecond); !reflect.DeepEqual(ids, []LeaseID{3, 4}) {
+		t.Errorf("expired leases = %v, want [3 4]", ids)
+	}
+	if ids := expire(time.Second); !reflect.DeepEqual(ids, []LeaseID{1}) {
+		t.Errorf("expired leases = %v, want renewed lease 1", ids)
+	}
+	if n := le.wheel.Len(); n != 1 {
+		t.Errorf("scheduled leases = %d, want 1", n)
+	}
+}
+
+// TestLessorExpiryTime ensures ExpiryTime returns the wall clock deadline of
+// the granted TTL on the primary only.
+func TestLessorExpiryTime(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	if _, err := le.ExpiryTime(1); err != ErrLeaseNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrLeaseNotFound)
+	}
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	want := fc.Now().Add(10 * time.Second)
+	fc.Advance(3 * time.Second)
+	if exp, err := le.ExpiryTime(1); err != nil || !exp.Equal(want) {
+		t.Errorf("expiry = %v, %v, want %v, <nil>", exp, err, want)
+	}
+
+	le.Demote()
+	if exp, err := le.ExpiryTime(1); err != nil || !exp.IsZero() {
+		t.Errorf("expiry after demotion = %v, %v, want zero time, <nil>", exp, err)
+	}
+}
+
+// TestLessorExpiryTracked ensures inspection reports no expiry instead of a
+// deadline while the lessor is not the primary.
+func TestLessorExpiryTracked(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+
+	check := func(stage string, wtracked bool) {
+		t.Helper()
+		info, err := le.LeaseInfo(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wttl := int64(-1)
+		if wtracked {
+			wttl = 10
+		}
+		if info.ExpiryTracked != wtracked || info.TimeToLive != wttl {
+			t.Errorf("%s: info tracked, ttl = %v, %d, want %v, %d", stage, info.ExpiryTracked, info.TimeToLive, wtracked, wttl)
+		}
+		if tracked := le.Lookup(1).ExpiryTracked(); tracked != wtracked {
+			t.Errorf("%s: lease tracked = %v, want %v", stage, tracked, wtracked)
+		}
+		if ls := le.Snapshot().Leases; len(ls) != 1 || ls[0].ExpiryTracked != wtracked || ls[0].TimeToLive != wttl {
+			t.Errorf("%s: snapshot leases = %+v, want tracked %v with ttl %d", stage, ls, wtracked, wttl)
+		}
+		exp, err := le.ExpiryTime(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp.IsZero() == wtracked {
+			t.Errorf("%s: expiry time = %v, want zero time %v", stage, exp, !wtracked)
+		}
+		wexpiring := 0
+		if wtracked {
+			wexpiring = 1
+		}
+		if n := le.Stats().Expiring; n != wexpiring {
+			t.Errorf("%s: expiring = %d, want %d", stage, n, wexpiring)
+		}
+	}
+
+	// granted before any promotion
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	check("not promoted", false)
+	le.Promote(0)
+	check("promoted", true)
+	le.Demote()
+	check("demoted", false)
+	le.Promote(0)
+	check("promoted again", true)
+}
+
+// TestLessorRenewIfBelow ensures RenewIfBelow renews only leases with less
+// than the threshold remaining.
+func TestLessorRenewIfBelow(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
+	defer le.Stop()
+	le.Promote(0)
+
+	far, err := le.Grant(1, 100)
 	if err != nil {
-		t.Fatalf("failed to create lease: %v", err)
+		t.Fatal(err)
 	}
-
-	select {
-	case el := <-le.ExpiredLeasesC():
-		if el[0].ID != l.ID {
-			t.Fatalf("expired id = %x, want %x", el[0].ID, l.ID)
-		}
-	case <-time.After(10 * time.Second):
-		t.Fatalf("failed to receive expired lease")
+	near, err := le.Grant(2, 10)
+	if err != nil {
+		t.Fatal(err)
 	}
+	fc.Advance(8 * time.Second)
 
-	donec := make(chan struct{})
-	go func() {
-		// expired lease cannot be renewed
-		if _, err := le.Renew(l.ID); err != ErrLeaseNotFound {
-			t.Fatalf("unexpected renew")
-		}
-		donec <- struct{}{}
-	}()
-
-	select {
-	case <-donec:
-		t.Fatalf("renew finished before lease revocation")
-	case <-time.After(50 * time.Millisecond):
+	renewed, ttl, err := le.RenewIfBelow(1, 5*time.Second)
+	if err != nil || renewed || ttl != 92 {
+		t.Errorf("renew of lease far from expiry = %v, %d, %v, want false, 92, <nil>", renewed, ttl, err)
+	}
+	if rem := far.Remaining(); rem != 92*time.Second {
+		t.Errorf("remaining = %v, want 92s", rem)
 	}
 
-	// expired lease can be revoked
-	if err := le.Revoke(l.ID); err != nil {
-		t.Fatalf("failed to revoke expired lease: %v", err)
+	renewed, ttl, err = le.RenewIfBelow(2, 5*time.Second)
+	if err != nil || !renewed || ttl != 10 {
+		t.Errorf("renew of lease near expiry = %v, %d, %v, want true, 10, <nil>", renewed, ttl, err)
+	}
+	if rem := near.Remaining(); rem != 10*time.Second {
+		t.Errorf("remaining = %v, want 10s", rem)
 	}
 
-	select {
-	case <-donec:
-	case <-time.After(10 * time.Second):
-		t.Fatalf("renew has not returned after lease revocation")
+	if _, _, err := le.RenewIfBelow(3, 5*time.Second); err != ErrLeaseNotFound {
+		t.Errorf("err = %v, want %v", err, ErrLeaseNotFound)
 	}
 }
 
-func TestLessorExpireAndDemote(t *testing.T) {
+func TestLessorRenewBatch(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	testMinTTL := int64(1)
-
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: testMinTTL})
+	fc := newFakeClock()
+	// no scans, which would take mu exclusively
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc, ExpiryScheduler: ms})
 	defer le.Stop()
+	<-ms.runc
 
-	le.Promote(1 * time.Second)
-	l, err := le.Grant(1, testMinTTL)
-	if err != nil {
-		t.Fatalf("failed to create lease: %v", err)
+	for i := 1; i <= 2; i++ {
+		if _, err := le.Grant(LeaseID(i), int64(10*i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := []LeaseID{1, 2, 3}
+	_, errs := le.RenewBatch(ids)
+	for i, err := range errs {
+		if !errors.Is(err, ErrNotPrimary) {
+			t.Errorf("err of lease %x on non-primary = %v, want %v", ids[i], err, ErrNotPrimary)
+		}
 	}
 
-	select {
-	case el := <-le.ExpiredLeasesC():
-		if el[0].ID != l.ID {
-			t.Fatalf("expired id = %x, want %x", el[0].ID, l.ID)
+	le.Promote(0)
+	fc.Advance(5 * time.Second)
+	ttls, errs := le.RenewBatch(ids)
+	wttls := []int64{10, 20, -1}
+	werrs := []error{nil, nil, ErrLeaseNotFound}
+	if !reflect.DeepEqual(ttls, wttls) || !reflect.DeepEqual(errs, werrs) {
+		t.Fatalf("renewals = %v, %v, want %v, %v", ttls, errs, wttls, werrs)
+	}
+	for i, id := range ids[:2] {
+		if rem := le.Lookup(id).Remaining(); rem != time.Duration(wttls[i])*time.Second {
+			t.Errorf("remaining of lease %x = %v, want %ds", id, rem, wttls[i])
 		}
-	case <-time.After(10 * time.Second):
-		t.Fatalf("failed to receive expired lease")
 	}
 
+	// a batch shares mu with the other renewals, as Renew does
+	le.mu.RLock()
 	donec := make(chan struct{})
 	go func() {
-		// expired lease cannot be renewed
-		if _, err := le.Renew(l.ID); err != ErrNotPrimary {
-			t.Fatalf("unexpected renew: %v", err)
-		}
-		donec <- struct{}{}
+		defer close(donec)
+		le.RenewBatch(ids[:2])
 	}()
-
-	select {
-	case <-donec:
-		t.Fatalf("renew finished before demotion")
-	case <-time.After(50 * time.Millisecond):
-	}
-
-	// demote will cause the renew request to fail with ErrNotPrimary
-	le.Demote()
-
 	select {
 	case <-donec:
-	case <-time.After(10 * time.Second):
-		t.Fatalf("renew has not returned after lessor demotion")
+	case <-time.After(5 * time.Second):
+		t.Error("batch renewal blocked by a reader")
 	}
+	le.mu.RUnlock()
 }
 
-func TestLessorMaxTTL(t *testing.T) {
+// TestLessorLoopHealthy ensures LoopHealthy turns false while the loop is
+// stuck and once the lessor is stopped.
+func TestLessorLoopHealthy(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
 	defer le.Stop()
 
-	_, err := le.Grant(1, MaxLeaseTTL+1)
-	if err != ErrLeaseTTLTooLarge {
-		t.Fatalf("grant unexpectedly succeeded")
+	waitHealthy := func(want bool) {
+		for i := 0; i < 20; i++ {
+			if le.LoopHealthy() == want {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("LoopHealthy() = %v, want %v", !want, want)
+	}
+	waitHealthy(true)
+
+	// wedge the loop by holding the lock it scans under
+	le.mu.Lock()
+	time.Sleep(leaseScanInterval + 100*time.Millisecond)
+	fc.Advance(4 * leaseScanInterval)
+	if le.LoopHealthy() {
+		t.Error("LoopHealthy() = true while the loop is stuck")
+	}
+	le.mu.Unlock()
+	waitHealthy(true)
+
+	le.Stop()
+	if le.LoopHealthy() {
+		t.Error("LoopHealthy() = true after Stop")
 	}
 }
 
-func TestLessorCheckpointScheduling(t *testing.T) {
+// TestLessorHealth ensures Health reports the state of the expiration
+// machinery.
+func TestLessorHealth(t *testing.T) {
 	lg := zap.NewNop()
-
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL, CheckpointInterval: 1 * time.Second})
-	le.minLeaseTTL = 1
-	checkpointedC := make(chan struct{})
-	le.SetCheckpointer(func(ctx context.Context, lc *pb.LeaseCheckpointRequest) {
-		close(checkpointedC)
-		if len(lc.Checkpoints) != 1 {
-			t.Errorf("expected 1 checkpoint but got %d", len(lc.Checkpoints))
-		}
-		c := lc.Checkpoints[0]
-		if c.Remaining_TTL != 1 {
-			t.Errorf("expected checkpoint to be called with Remaining_TTL=%d but got %d", 1, c.Remaining_TTL)
-		}
-	})
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
 	defer le.Stop()
+
+	if h := le.Health(); h.Primary || h.LeaseCount != 0 {
+		t.Fatalf("health = %+v, want non-primary without leases", h)
+	}
+
+	for id := LeaseID(1); id <= 2; id++ {
+		if _, err := le.Grant(id, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
 	le.Promote(0)
+	fc.Advance(2 * time.Second)
 
-	_, err := le.Grant(1, 2)
-	if err != nil {
-		t.Fatal(err)
+	// the expired leases are found but not consumed
+	var h LessorHealth
+	for i := 0; i < 20; i++ {
+		if h = le.Health(); h.PendingExpired != 0 && h.LastScan.Equal(fc.Now()) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !h.Healthy || !h.Primary || h.LeaseCount != 2 || h.PendingExpired != 1 {
+		t.Errorf("health = %+v, want healthy primary with 2 leases and 1 pending batch", h)
+	}
+	if !h.LastScan.Equal(fc.Now()) {
+		t.Errorf("last scan = %v, want %v", h.LastScan, fc.Now())
 	}
 
-	// TODO: Is there any way to avoid doing this wait? Lease TTL granularity is in seconds.
-	select {
-	case <-checkpointedC:
-	case <-time.After(2 * time.Second):
-		t.Fatal("expected checkpointer to be called, but it was not")
+	le.Stop()
+	if h = le.Health(); h.Healthy {
+		t.Error("lessor is healthy after Stop")
 	}
 }
 
-func TestLessorCheckpointsRestoredOnPromote(t *testing.T) {
+// TestLessorSnapshot ensures Snapshot reflects granted leases and attached
+// items, and marshals to JSON.
+func TestLessorSnapshot(t *testing.T) {
 	lg := zap.NewNop()
 	dir, be := NewTestBackend(t)
 	defer os.RemoveAll(dir)
 	defer be.Close()
 
-	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: minLeaseTTL})
+	fc := newFakeClock()
+	le := newLessor(lg, be, LessorConfig{MinLeaseTTL: 1, clock: fc})
 	defer le.Stop()
-	l, err := le.Grant(1, 10)
+	le.Promote(0)
+
+	if _, err := le.GrantWithOptions(2, 20, GrantOptions{Items: []LeaseItem{{"foo"}, {"bar"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := le.Grant(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(5 * time.Second)
+
+	snap := le.Snapshot()
+	wsnap := LessorSnapshot{
+		Primary:    true,
+		LeaseCount: 2,
+		Stats:      le.Stats(),
+		Leases: []LeaseSnapshot{
+			{ID: 1, TTL: 10, TimeToLive: 5, ExpiryTracked: true},
+			{ID: 2, TTL: 20, TimeToLive: 15, ExpiryTracked: true, ItemCount: 2},
+		},
+	}
+	if !reflect.DeepEqual(snap, wsnap) {
+		t.Errorf("snapshot = %+v, want %+v", snap, wsnap)
+	}
+	if st := snap.Stats; st.Count != 2 || st.ItemCount != 2 || st.Expiring != 2 {
+		t.Errorf("snapshot stats = %+v, want 2 leases with 2 items expiring", st)
+	}
+
+	b, err := json.Marshal(snap)
 	if err != nil {
 		t.Fatal(err)
 	}
-	le.Checkpoint(l.ID, 5)
-	le.Promote(0)
-	remaining := l.Remaining().Seconds()
-	if !(remaining > 4 && remaining < 5) {
-		t.Fatalf("expected expiry to be less than 1s in the future, but got %f seconds", remaining)
+	var got LessorSnapshot
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
 	}
+	if !reflect.DeepEqual(got, snap) {
+		t.Errorf("unmarshaled snapshot = %+v, want %+v", got, snap)
+	}
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func histogramCount(h prometheus.Histogram) uint64 {
+	m := &dto.Metric{}
+	h.Write(m)
+	return m.GetHistogram().GetSampleCount()
+}
+
+// fakeClock is a clock whose wall and monotonic readings are moved by hand.
+type fakeClock struct {
+	mu      sync.Mutex
+	wall    time.Time
+	elapsed time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{wall: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wall
+}
+
+func (c *fakeClock) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.elapsed
+}
+
+// Advance moves both readings of the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wall = c.wall.Add(d)
+	c.elapsed += d
+}
+
+// Step moves only the wall clock by d, as NTP stepping the system clock does.
+func (c *fakeClock) Step(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wall = c.wall.Add(d)
 }
 
 type fakeDeleter struct {
@@ -596,6 +5561,71 @@ func (fd *fakeDeleter) DeleteRange(key, end []byte) (int64, int64) {
 	return 0, 0
 }
 
+// lookupDeleter is a fakeDeleter that looks up the lease of each key it
+// deletes, as the store does.
+type lookupDeleter struct {
+	*fakeDeleter
+	le Lessor
+}
+
+func (ld *lookupDeleter) DeleteRange(key, end []byte) (int64, int64) {
+	ld.le.GetLease(LeaseItem{Key: string(key)})
+	return ld.fakeDeleter.DeleteRange(key, end)
+}
+
+// endDeleter calls ended before ending the transaction of its TxnDelete.
+type endDeleter struct {
+	TxnDelete
+	ended func()
+}
+
+func (ed *endDeleter) End() {
+	ed.ended()
+	ed.TxnDelete.End()
+}
+
+// testKeyBucket holds the keys of tests revoking through a keyDeleter, each
+// mapped to its lease.
+var testKeyBucket = []byte("testkey")
+
+// keyDeleter deletes keys from testKeyBucket in the backend transaction the
+// lessor also deletes the lease record in, and calls ended once it is done.
+type keyDeleter struct {
+	tx    backend.BatchTx
+	ended func()
+}
+
+func lockedBatchTx(be backend.Backend) backend.BatchTx {
+	tx := be.BatchTx()
+	tx.Lock()
+	return tx
+}
+
+func (kd *keyDeleter) DeleteRange(key, end []byte) (int64, int64) {
+	kd.tx.UnsafeDelete(testKeyBucket, key)
+	return 1, 0
+}
+
+func (kd *keyDeleter) End() {
+	kd.tx.Unlock()
+	if kd.ended != nil {
+		kd.ended()
+	}
+}
+
+// testKeys returns the keys in testKeyBucket and their leases.
+func testKeys(be backend.Backend) map[string]LeaseID {
+	keys := make(map[string]LeaseID)
+	tx := be.BatchTx()
+	tx.Lock()
+	defer tx.Unlock()
+	tx.UnsafeForEach(testKeyBucket, func(k, v []byte) error {
+		keys[string(k)] = LeaseID(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return keys
+}
+
 func NewTestBackend(t *testing.T) (string, backend.Backend) {
 	tmpPath, err := ioutil.TempDir("", "lease")
 	if err != nil {
@@ -605,3 +5635,173 @@ func NewTestBackend(t *testing.T) (string, backend.Backend) {
 	bcfg.Path = filepath.Join(tmpPath, "be")
 	return tmpPath, backend.New(bcfg)
 }
+
+// TestLessorExpiredAck ensures nacked expired leases are delivered again
+// after the retry backoff, ordered by expiry, and acked leases are not.
+func TestLessorExpiredAck(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{
+		MinLeaseTTL:         1,
+		ExpiredRetryBackoff: 2 * time.Second,
+		ExpiryScheduler:     ms,
+		clock:               fc,
+	})
+	defer le.Stop()
+	<-ms.runc
+	le.Promote(0)
+
+	for id, ttl := range map[LeaseID]int64{1: 1, 2: 2, 3: 3, 4: 6} {
+		if _, err := le.Grant(id, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expire := func(d time.Duration) []LeaseID {
+		fc.Advance(d)
+		le.ScanExpired()
+		var ids []LeaseID
+		for {
+			select {
+			case b := <-le.ExpiredLeaseBatchC():
+				for _, l := range b.Leases {
+					ids = append(ids, l.ID)
+				}
+			default:
+				return ids
+			}
+		}
+	}
+
+	if ids := expire(4 * time.Second); !reflect.DeepEqual(ids, []LeaseID{1, 2, 3}) {
+		t.Fatalf("expired leases = %v, want [1 2 3]", ids)
+	}
+	le.ExpiredAck([]LeaseID{3}, true)
+	le.ExpiredAck([]LeaseID{2, 1}, false)
+	// lease 4 is not expired, so it is not delivered early
+	le.ExpiredAck([]LeaseID{4}, false)
+
+	if ids := expire(time.Second); len(ids) != 0 {
+		t.Fatalf("expired leases = %v within the backoff, want none", ids)
+	}
+	// nacked leases come back ahead of lease 4, which expired later
+	if ids := expire(time.Second); !reflect.DeepEqual(ids, []LeaseID{1, 2, 4}) {
+		t.Fatalf("expired leases = %v after the backoff, want [1 2 4]", ids)
+	}
+	if ids := expire(time.Minute); len(ids) != 0 {
+		t.Fatalf("expired leases = %v, want none", ids)
+	}
+}
+
+// TestLessorMaxPendingExpiredBatches ensures the expiry scan stops looking for
+// expired leases once MaxPendingExpiredBatches batches are pending.
+func TestLessorMaxPendingExpiredBatches(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	fc := newFakeClock()
+	ms := &manualScheduler{runc: make(chan struct{})}
+	le := newLessor(lg, be, LessorConfig{
+		MinLeaseTTL:              1,
+		ExpiredLeasesBufferSize:  1,
+		MaxPendingExpiredBatches: 1,
+		ExpiredBatchSize:         1,
+		ExpiryScheduler:          ms,
+		clock:                    fc,
+	})
+	defer le.Stop()
+	<-ms.runc
+	le.Promote(0)
+
+	for id := LeaseID(1); id <= 3; id++ {
+		if _, err := le.Grant(id, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc.Advance(2 * time.Second)
+	le.ScanExpired()
+	// one batch is sent, the other two are pending
+	if n := le.Health().PendingExpired; n != 3 {
+		t.Fatalf("pending expired batches = %d, want 3", n)
+	}
+
+	if _, err := le.Grant(4, 1); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(2 * time.Second)
+	le.ScanExpired()
+	if n := le.Health().PendingExpired; n != 3 {
+		t.Fatalf("pending expired batches = %d, want 3 as the limit is reached", n)
+	}
+
+	var ids []LeaseID
+	for len(ids) < 4 {
+		select {
+		case b := <-le.ExpiredLeaseBatchC():
+			for _, l := range b.Leases {
+				ids = append(ids, l.ID)
+			}
+		default:
+			le.ScanExpired()
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if want := []LeaseID{1, 2, 3, 4}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("expired leases = %v, want %v", ids, want)
+	}
+}
+
+// TestLessorConfigValidate ensures NewLessorWithConfig rejects invalid
+// configs with a ConfigError naming the field.
+func TestLessorConfigValidate(t *testing.T) {
+	lg := zap.NewNop()
+	dir, be := NewTestBackend(t)
+	defer os.RemoveAll(dir)
+	defer be.Close()
+
+	tests := []struct {
+		cfg   LessorConfig
+		field string
+	}{
+		{LessorConfig{CheckpointInterval: -time.Second}, "CheckpointInterval"},
+		{LessorConfig{ExpiryGrace: -time.Second}, "ExpiryGrace"},
+		{LessorConfig{MinLeaseTTL: -1}, "MinLeaseTTL"},
+		{LessorConfig{MinLeaseTTL: MaxLeaseTTL + 1}, "MinLeaseTTL"},
+		{LessorConfig{MinLeaseTTLDuration: (MaxLeaseTTL + 1) * time.Second}, "MinLeaseTTLDuration"},
+		{LessorConfig{MaxLeases: -1}, "MaxLeases"},
+		{LessorConfig{ExpiredBatchSize: -1}, "ExpiredBatchSize"},
+		{LessorConfig{MinLeaseTTL: 10, MaxLifetime: 5 * time.Second}, "MaxLifetime"},
+		{LessorConfig{StatsBuckets: []int64{10, 10}}, "StatsBuckets"},
+		{LessorConfig{StatsBuckets: []int64{0, 10}}, "StatsBuckets"},
+		{LessorConfig{ExpiryWheel: true}, "ExpiryWheel"},
+		{LessorConfig{GrantRate: -1}, "GrantRate"},
+		{LessorConfig{GrantRate: 1, GrantBurst: -1}, "GrantBurst"},
+	}
+	for i, tt := range tests {
+		le, err := NewLessorWithConfig(lg, be, tt.cfg)
+		if le != nil {
+			le.Stop()
+			t.Errorf("#%d: created lessor for invalid config", i)
+		}
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("#%d: err = %v, want %v", i, err, ErrInvalidConfig)
+			continue
+		}
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) || cerr.Field != tt.field {
+			t.Errorf("#%d: err = %v, want error for field %s", i, err, tt.field)
+		}
+	}
+
+	le, err := NewLessorWithConfig(lg, be, LessorConfig{MinLeaseTTL: 10, MaxLifetime: time.Minute, StatsBuckets: []int64{10, 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	le.Stop()
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"sync"
+	"time"
+)
+
+// GrantLimiter limits the rate of lease grants per caller.
+type GrantLimiter interface {
+	// Allow reports whether a grant on behalf of the caller identified by
+	// token may proceed.
+	Allow(token string) bool
+}
+
+// sharedLimiter limits all callers alike, whatever their token.
+type sharedLimiter struct {
+	*tokenBucketLimiter
+}
+
+func (sl sharedLimiter) Allow(string) bool { return sl.tokenBucketLimiter.Allow("") }
+
+// allLimiters allows a grant only if each of its limiters does.
+type allLimiters []GrantLimiter
+
+func (ls allLimiters) Allow(token string) bool {
+	for _, l := range ls {
+		if !l.Allow(token) {
+			return false
+		}
+	}
+	return true
+}
+
+// minLimiterSweep is the number of tracked tokens below which the token
+// bucket limiter does not sweep full buckets.
+const minLimiterSweep = 1024
+
+type tokenBucketLimiter struct {
+	rate  float64
+	burst float64
+	clock clock
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// sweepAt is the number of tracked tokens at which full buckets are
+	// dropped, so that callers passing ever new tokens do not grow the map
+	// without bound.
+	sweepAt int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucketGrantLimiter returns a GrantLimiter allowing each token r
+// grants per second on average, in bursts of up to burst grants.
+func NewTokenBucketGrantLimiter(r float64, burst int) GrantLimiter {
+	return newTokenBucketLimiter(r, burst, newSystemClock())
+}
+
+func newTokenBucketLimiter(r float64, burst int, clk clock) *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		rate:    r,
+		burst:   float64(burst),
+		clock:   clk,
+		buckets: make(map[string]*tokenBucket),
+		sweepAt: minLimiterSweep,
+	}
+}
+
+func (tl *tokenBucketLimiter) Allow(token string) bool {
+	now := tl.clock.Now()
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	b := tl.buckets[token]
+	if b == nil {
+		if len(tl.buckets) >= tl.sweepAt {
+			tl.sweep(now)
+		}
+		b = &tokenBucket{tokens: tl.burst, last: now}
+		tl.buckets[token] = b
+	}
+	b.refill(now, tl.rate, tl.burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops the buckets refilled to the burst, which are the same as no
+// bucket at all.
+func (tl *tokenBucketLimiter) sweep(now time.Time) {
+	for token, b := range tl.buckets {
+		if b.refill(now, tl.rate, tl.burst); b.tokens >= tl.burst {
+			delete(tl.buckets, token)
+		}
+	}
+	tl.sweepAt = 2 * len(tl.buckets)
+	if tl.sweepAt < minLimiterSweep {
+		tl.sweepAt = minLimiterSweep
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
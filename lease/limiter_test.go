@@ -0,0 +1,74 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	fc := newFakeClock()
+	tl := newTokenBucketLimiter(2, 3, fc)
+
+	for i := 0; i < 3; i++ {
+		if !tl.Allow("a") {
+			t.Fatalf("#%d: denied within the burst", i)
+		}
+	}
+	if tl.Allow("a") {
+		t.Fatal("allowed beyond the burst")
+	}
+	if !tl.Allow("b") {
+		t.Fatal("denied another token")
+	}
+
+	// refills at 2 per second
+	fc.Advance(500 * time.Millisecond)
+	if !tl.Allow("a") {
+		t.Fatal("denied after refill")
+	}
+	if tl.Allow("a") {
+		t.Fatal("allowed beyond the refill")
+	}
+	// up to the burst only
+	fc.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !tl.Allow("a") {
+			t.Fatalf("#%d: denied within the burst after refill", i)
+		}
+	}
+	if tl.Allow("a") {
+		t.Fatal("allowed beyond the burst after refill")
+	}
+}
+
+func TestTokenBucketLimiterSweep(t *testing.T) {
+	fc := newFakeClock()
+	tl := newTokenBucketLimiter(1, 1, fc)
+
+	for i := 0; i < minLimiterSweep; i++ {
+		tl.Allow(fmt.Sprint(i))
+	}
+	fc.Advance(time.Second)
+	// the buckets of all tokens refilled, so they are dropped
+	if !tl.Allow("new") {
+		t.Fatal("denied new token")
+	}
+	if n := len(tl.buckets); n != 1 {
+		t.Errorf("tracked tokens = %d, want 1", n)
+	}
+}
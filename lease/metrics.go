@@ -40,6 +40,44 @@ var (
 		Help:      "The number of renewed leases seen by the leader.",
 	})
 
+	leaseRenewCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd_debugging",
+		Subsystem: "lease",
+		Name:      "renew_coalesced_total",
+		Help:      "The number of renewed leases seen by the leader that did not refresh the expiry because the lease was renewed shortly before.",
+	})
+
+	leaseItemExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd_debugging",
+		Subsystem: "lease",
+		Name:      "item_expired_total",
+		Help:      "The total number of lease items deleted on expiry of their own TTL.",
+	})
+
+	leaseExpiredBatchesBlocked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd_debugging",
+		Subsystem: "lease",
+		Name:      "expired_batches_blocked_total",
+		Help:      "The total number of times a batch of expired leases could not be sent because the receiver was behind.",
+	})
+
+	leaseExpiredBatchesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "etcd_debugging",
+		Subsystem: "lease",
+		Name:      "expired_batches_dropped_total",
+		Help:      "The total number of notifications about revoked expired leases dropped because the receiver was behind.",
+	})
+
+	leaseExpiryScanDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "etcd_debugging",
+			Subsystem: "lease",
+			Name:      "expiry_scan_duration_seconds",
+			Help:      "Bucketed histogram of the time the primary lessor takes to scan for expired leases and due checkpoints.",
+			// 100 microseconds -> 3.2 seconds
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		})
+
 	leaseTotalTTLs = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Namespace: "etcd_debugging",
@@ -55,5 +93,10 @@ func init() {
 	prometheus.MustRegister(leaseGranted)
 	prometheus.MustRegister(leaseRevoked)
 	prometheus.MustRegister(leaseRenewed)
+	prometheus.MustRegister(leaseRenewCoalesced)
+	prometheus.MustRegister(leaseItemExpired)
+	prometheus.MustRegister(leaseExpiredBatchesBlocked)
+	prometheus.MustRegister(leaseExpiredBatchesDropped)
+	prometheus.MustRegister(leaseExpiryScanDuration)
 	prometheus.MustRegister(leaseTotalTTLs)
 }
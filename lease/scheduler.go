@@ -0,0 +1,44 @@
+// Copyright 2019 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import "time"
+
+// ExpiryScheduler decides when a lessor looks for expired leases and due
+// checkpoints. It lets embedders drive expiry from their own event loop
+// instead of the default polling.
+type ExpiryScheduler interface {
+	// Run calls ScanExpired of the lessor whenever a scan is due, until
+	// stopc is closed. Stop of the lessor waits for Run to return, and
+	// ScanExpired does nothing once the lessor is stopped.
+	Run(le Lessor, stopc <-chan struct{})
+}
+
+// pollingScheduler scans at a fixed interval.
+type pollingScheduler struct {
+	interval time.Duration
+}
+
+func (s pollingScheduler) Run(le Lessor, stopc <-chan struct{}) {
+	for {
+		le.ScanExpired()
+
+		select {
+		case <-time.After(s.interval):
+		case <-stopc:
+			return
+		}
+	}
+}
@@ -419,20 +419,23 @@ func (s *store) restore() error {
 		scheduledCompact = 0
 	}
 
-	for key, lid := range keyToLease {
+	if len(keyToLease) != 0 {
 		if s.le == nil {
 			panic("no lessor to attach lease")
 		}
-		err := s.le.Attach(lid, []lease.LeaseItem{{Key: key}})
-		if err != nil {
+		leaseToItems := make(map[lease.LeaseID][]lease.LeaseItem)
+		for key, lid := range keyToLease {
+			leaseToItems[lid] = append(leaseToItems[lid], lease.LeaseItem{Key: key})
+		}
+		for _, lid := range s.le.Reattach(leaseToItems) {
 			if s.lg != nil {
 				s.lg.Warn(
 					"failed to attach a lease",
 					zap.String("lease-id", fmt.Sprintf("%016x", lid)),
-					zap.Error(err),
+					zap.Error(lease.ErrLeaseNotFound),
 				)
 			} else {
-				plog.Errorf("unexpected Attach error: %v", err)
+				plog.Errorf("unexpected Attach error: %v", lease.ErrLeaseNotFound)
 			}
 		}
 	}
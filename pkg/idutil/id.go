@@ -17,6 +17,7 @@
 package idutil
 
 import (
+	"fmt"
 	"math"
 	"sync/atomic"
 	"time"
@@ -28,6 +29,13 @@ const (
 	suffixLen = tsLen + cntLen
 )
 
+// MaxCounterLen bounds the counter width of NewGeneratorWithCounterLen,
+// exclusive.
+const MaxCounterLen = suffixLen
+
+// SuffixMask masks the low order 6 bytes of an id, below the member ID.
+const SuffixMask = 1<<suffixLen - 1
+
 // Generator generates unique identifiers based on counters, timestamps, and
 // a node member ID.
 //
@@ -54,9 +62,23 @@ type Generator struct {
 }
 
 func NewGenerator(memberID uint16, now time.Time) *Generator {
+	return NewGeneratorWithCounterLen(memberID, now, cntLen)
+}
+
+// NewGeneratorWithCounterLen creates a generator whose counter is cntBits
+// wide instead of one byte. It panics unless cntBits is in
+// [1, MaxCounterLen). Ids stay unique across restarts only as long as the
+// generator issues fewer than 2^cntBits ids per millisecond on average, as
+// the counter otherwise overflows ahead of the timestamp of the next start.
+// A wider counter raises this rate at the cost of a timestamp wrapping after
+// 2^(48-cntBits) milliseconds.
+func NewGeneratorWithCounterLen(memberID uint16, now time.Time, cntBits uint) *Generator {
+	if cntBits == 0 || cntBits >= MaxCounterLen {
+		panic(fmt.Sprintf("idutil: counter width %d out of range [1, %d)", cntBits, MaxCounterLen))
+	}
 	prefix := uint64(memberID) << suffixLen
 	unixMilli := uint64(now.UnixNano()) / uint64(time.Millisecond/time.Nanosecond)
-	suffix := lowbit(unixMilli, tsLen) << cntLen
+	suffix := lowbit(unixMilli, suffixLen-cntBits) << cntBits
 	return &Generator{
 		prefix: prefix,
 		suffix: suffix,
@@ -54,6 +54,38 @@ func TestNext(t *testing.T) {
 	}
 }
 
+func TestNewGeneratorWithCounterLen(t *testing.T) {
+	g := NewGeneratorWithCounterLen(0x12, time.Unix(0, 0).Add(0x3456*time.Millisecond), 16)
+	wid := uint64(0x12000034560001)
+	if id := g.Next(); id != wid {
+		t.Errorf("id = %x, want %x", id, wid)
+	}
+}
+
+func TestNextCounterOverflow(t *testing.T) {
+	// the 2 bit counter overflows into the timestamp every 4 ids
+	g := NewGeneratorWithCounterLen(0x12, time.Unix(0, 0).Add(0x3456*time.Millisecond), 2)
+	wid := uint64(0x12000000000000 | 0x3456<<2 | 1)
+	for i := 0; i < 1000; i++ {
+		if id := g.Next(); id != wid+uint64(i) {
+			t.Fatalf("id = %x, want %x", id, wid+uint64(i))
+		}
+	}
+}
+
+func TestNewGeneratorWithCounterLenOutOfRange(t *testing.T) {
+	for _, n := range []uint{0, MaxCounterLen, 64} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("generator with counter width %d did not panic", n)
+				}
+			}()
+			NewGeneratorWithCounterLen(0, time.Now(), n)
+		}()
+	}
+}
+
 func BenchmarkNext(b *testing.B) {
 	g := NewGenerator(0x12, time.Now())
 